@@ -1,14 +1,17 @@
 package main
 
 import (
+	"dnsadminserver/internal/config"
 	"dnsadminserver/internal/service"
 	"fmt"
 	"log"
 	"net"
+	"net/http"
 
 	"os"
 
 	pb "github.com/coredns/coredns/pb"
+	"github.com/prometheus/client_golang/prometheus/promhttp"
 	"google.golang.org/grpc"
 )
 
@@ -23,7 +26,25 @@ func main() {
 		log.Fatal(err)
 	}
 
-	pb.RegisterDnsServiceServer(grpcServer, &service.DnsServiceServer{})
+	dnsService := &service.DnsServiceServer{}
+	pb.RegisterDnsServiceServer(grpcServer, dnsService)
+	service.RegisterNotifyServiceServer(grpcServer, dnsService)
+	if addr := config.GetConfig().TransferAddr; addr != "" {
+		go func() {
+			if err := service.ServeTransfer(addr); err != nil {
+				log.Fatal(err)
+			}
+		}()
+	}
+	if addr := config.GetConfig().MetricsAddr; addr != "" {
+		go func() {
+			mux := http.NewServeMux()
+			mux.Handle("/metrics", promhttp.Handler())
+			if err := http.ListenAndServe(addr, mux); err != nil {
+				log.Fatal(err)
+			}
+		}()
+	}
 	if err := grpcServer.Serve(lis); err != nil {
 		log.Fatal(err)
 	}
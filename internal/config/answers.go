@@ -0,0 +1,53 @@
+package config
+
+import (
+	"fmt"
+
+	"github.com/miekg/dns"
+)
+
+const (
+	AnswerSequential = "sequential"  // 保持记录的顺序
+	AnswerRoundRobin = "round_robin" // 每次查询轮换第一条记录
+	AnswerRandom     = "random"      // 随机排序
+	AnswerSticky     = "sticky"      // 按客户端地址的哈希轮换,同一客户端的顺序固定
+)
+
+// AnswerPolicyConfig 多条记录的应答顺序,max大于0时只返回排序后的前max条记录
+type AnswerPolicyConfig struct {
+	Policy string                        `json:"policy"`
+	Max    int                           `json:"max"`
+	Names  map[string]AnswerPolicyConfig `json:"names"` // 域名 -> 覆盖集群配置的策略
+}
+
+func (c AnswerPolicyConfig) validate() error {
+	switch c.Policy {
+	case "", AnswerSequential, AnswerRoundRobin, AnswerRandom, AnswerSticky:
+	default:
+		return fmt.Errorf("未知的应答策略: %s", c.Policy)
+	}
+	if c.Max < 0 {
+		return fmt.Errorf("max 不能为负数")
+	}
+	for name, n := range c.Names {
+		if len(n.Names) > 0 {
+			return fmt.Errorf("域名 %s 的应答策略不能再配置names", name)
+		}
+		if err := n.validate(); err != nil {
+			return fmt.Errorf("域名 %s: %v", name, err)
+		}
+	}
+	return nil
+}
+
+// AnswerPolicy 返回集群中域名的应答策略,域名的配置优先于集群的配置
+func AnswerPolicy(cluster, name string) AnswerPolicyConfig {
+	c := GetConfig().AnswerPolicies[cluster]
+	for k, v := range c.Names {
+		if dns.CanonicalName(k) == dns.CanonicalName(name) {
+			return v
+		}
+	}
+	c.Names = nil
+	return c
+}
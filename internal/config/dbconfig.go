@@ -1,21 +1,39 @@
 package config
 
 import (
+	"database/sql"
 	"log"
 	"time"
 
+	"github.com/glebarez/sqlite"
 	"gorm.io/driver/mysql"
+	"gorm.io/driver/postgres"
 	"gorm.io/gorm"
 )
 
 var Orm *gorm.DB
 
 func initDB() {
+	if !Config.RecordSource.isSQL() {
+		return
+	}
 	Orm = gormDB()
 }
 
+// dialector 根据记录来源类型返回数据库驱动
+func dialector(sourceType, dsn string) gorm.Dialector {
+	switch sourceType {
+	case "postgres":
+		return postgres.Open(dsn)
+	case "sqlite":
+		return sqlite.Open(dsn)
+	default:
+		return mysql.Open(dsn)
+	}
+}
+
 func gormDB() *gorm.DB {
-	db, err := gorm.Open(mysql.Open(Config.DbConfig.Dsn), &gorm.Config{})
+	db, err := gorm.Open(dialector(Config.RecordSource.Type, Config.DbConfig.Dsn), &gorm.Config{})
 	if err != nil {
 		log.Fatal(err)
 	}
@@ -24,8 +42,24 @@ func gormDB() *gorm.DB {
 		log.Fatal(err)
 	}
 
-	mysqlDb.SetMaxOpenConns(50)
-	mysqlDb.SetConnMaxIdleTime(10)
+	setDbPool(mysqlDb, Config.DbConfig)
 	mysqlDb.SetConnMaxLifetime(time.Hour)
 	return db
 }
+
+// setDbPool 设置连接池大小,未配置时使用默认值
+func setDbPool(mysqlDb *sql.DB, c DbConfig) {
+	maxOpen := 50
+	if c.DbMaxOpenCon > 0 {
+		maxOpen = c.DbMaxOpenCon
+	}
+	mysqlDb.SetMaxOpenConns(maxOpen)
+	if c.DbMaxIdleCon > 0 {
+		mysqlDb.SetMaxIdleConns(c.DbMaxIdleCon)
+	}
+	idleTimeout := 10 * time.Second
+	if c.DbMaxIdleContimeout > 0 {
+		idleTimeout = time.Duration(c.DbMaxIdleContimeout) * time.Second
+	}
+	mysqlDb.SetConnMaxIdleTime(idleTimeout)
+}
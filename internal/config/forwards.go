@@ -0,0 +1,169 @@
+package config
+
+import (
+	"context"
+	"dnsadminserver/internal/models"
+	"dnsadminserver/internal/source"
+	"fmt"
+	"log"
+	"net"
+	"strings"
+	"sync"
+
+	"github.com/miekg/dns"
+)
+
+// forwardReload 转发规则变化时管理后台发布的变更消息
+const forwardReload = "forward:reload"
+
+// ForwardConfig 将本服务没有记录且不负责的名称转发到上游,字段与forward插件的同名配置相同
+type ForwardConfig struct {
+	Cluster       string              `json:"cluster"` // 为空时适用于所有集群
+	From          string              `json:"from"`    // 转发的zone,"." 表示全部名称
+	To            []string            `json:"to"`      // 上游地址,如 8.8.8.8:53、tls://1.1.1.1、https://dns.google/dns-query、quic://94.140.14.140
+	Except        []string            `json:"except"`
+	Types         []string            `json:"types"`         // 只转发这些查询类型,为空时转发全部
+	AllowNets     []string            `json:"allowNets"`     // 只转发这些网段的客户端的查询,为空时不限制
+	DenyNets      []string            `json:"denyNets"`      // 不转发这些网段的客户端的查询
+	Metadata      map[string][]string `json:"metadata"`      // 元数据 -> 允许的值,如 {"cluster": ["a"]}
+	Policy        string              `json:"policy"`        // random(默认)、round_robin、sequential、fastest、weighted
+	Weights       []float64           `json:"weights"`       // weighted策略中按to的顺序配置的上游权重,未配置的为1
+	MaxFails      *uint32             `json:"maxFails"`      // 默认2,0表示不做健康检查
+	HealthCheck   int                 `json:"healthCheck"`   // 健康检查间隔毫秒数,默认500
+	HcDomain      string              `json:"hcDomain"`      // 健康检查查询的域名,默认 .
+	HcNoRec       bool                `json:"hcNoRec"`       // 健康检查不设置RD位
+	ForceTcp      bool                `json:"forceTcp"`      // 总是使用TCP连接上游
+	PreferUdp     bool                `json:"preferUdp"`     // 总是使用UDP连接上游
+	Expire        int                 `json:"expire"`        // 上游连接的缓存秒数,默认10
+	MaxConcurrent int                 `json:"maxConcurrent"` // 最大并发转发数,超过时返回REFUSED,0表示不限制
+	TlsServerName string              `json:"tlsServerName"`
+	Timeout       int                 `json:"timeout"`     // 一次转发的总毫秒数,包括所有重试,默认5000
+	ReadTimeout   int                 `json:"readTimeout"` // 每次查询等待上游应答的毫秒数,默认2000
+	HedgeDelay    int                 `json:"hedgeDelay"`  // 上游超过该毫秒数没有应答时同时查询下一个上游,0表示不并行
+	Cache         ForwardCacheConfig  `json:"cache"`
+}
+
+// ForwardCacheConfig 转发应答的缓存,按应答的TTL缓存,NXDOMAIN和NODATA按SOA缓存
+type ForwardCacheConfig struct {
+	Size               int `json:"size"`               // 最多缓存的应答数,0表示不缓存
+	MinTtl             int `json:"minTtl"`             // 最短缓存秒数
+	MaxTtl             int `json:"maxTtl"`             // 最长缓存秒数,默认3600
+	NegativeTtl        int `json:"negativeTtl"`        // 否定应答的最长缓存秒数,默认1800
+	Prefetch           int `json:"prefetch"`           // 命中次数达到该值的应答在过期前后台刷新,0表示不预取
+	PrefetchPercentage int `json:"prefetchPercentage"` // 剩余TTL低于该百分比时预取,默认10
+	ServeStale         int `json:"serveStale"`         // 所有上游失败时过期应答还可以使用的秒数(RFC 8767),0表示不使用
+}
+
+func (c ForwardCacheConfig) validate() error {
+	if c.Size < 0 || c.MinTtl < 0 || c.MaxTtl < 0 || c.NegativeTtl < 0 || c.Prefetch < 0 || c.ServeStale < 0 {
+		return fmt.Errorf("forwards.cache 不能为负数")
+	}
+	if c.PrefetchPercentage < 0 || c.PrefetchPercentage > 100 {
+		return fmt.Errorf("forwards.cache.prefetchPercentage 应在0到100之间: %d", c.PrefetchPercentage)
+	}
+	return nil
+}
+
+func (c ForwardConfig) validate() error {
+	if c.From == "" || len(c.To) == 0 {
+		return fmt.Errorf("forwards 的 from 和 to 不能为空")
+	}
+	switch c.Policy {
+	case "", "random", "round_robin", "sequential", "fastest", "weighted":
+	default:
+		return fmt.Errorf("forwards.policy 不正确: %s", c.Policy)
+	}
+	for _, t := range c.Types {
+		if _, ok := dns.StringToType[strings.ToUpper(t)]; !ok {
+			return fmt.Errorf("forwards.types 不正确: %s", t)
+		}
+	}
+	for _, n := range append(append([]string{}, c.AllowNets...), c.DenyNets...) {
+		if net.ParseIP(n) == nil {
+			if _, _, err := net.ParseCIDR(n); err != nil {
+				return fmt.Errorf("forwards 的网段不正确: %s", n)
+			}
+		}
+	}
+	for label, values := range c.Metadata {
+		if len(values) == 0 {
+			return fmt.Errorf("forwards.metadata.%s 不能为空", label)
+		}
+	}
+	if len(c.Weights) > len(c.To) {
+		return fmt.Errorf("forwards.weights 不能多于上游数")
+	}
+	for _, w := range c.Weights {
+		if w < 0 {
+			return fmt.Errorf("forwards.weights 不能为负数")
+		}
+	}
+	if c.HealthCheck < 0 || c.Expire < 0 || c.MaxConcurrent < 0 || c.Timeout < 0 || c.ReadTimeout < 0 || c.HedgeDelay < 0 {
+		return fmt.Errorf("forwards 的 healthCheck、expire、maxConcurrent、timeout、readTimeout、hedgeDelay 不能为负数")
+	}
+	return c.Cache.validate()
+}
+
+// forwardRules 从数据库加载的转发规则
+var (
+	forwardRules     []models.DnsForwards
+	forwardRulesLock sync.RWMutex
+	forwardHooks     []func()
+)
+
+// OnForwardChange 注册数据库中的转发规则重新加载后的回调,需在 init 阶段注册
+func OnForwardChange(f func()) {
+	forwardHooks = append(forwardHooks, f)
+}
+
+// loadForwardRules 从记录来源加载转发规则,来源不支持时不加载,加载失败时保留原有规则
+func loadForwardRules() {
+	l, ok := Source.(source.ForwardLoader)
+	if !ok {
+		return
+	}
+	ctx, cancel := context.WithTimeout(context.Background(), sourceLoadTimeout)
+	defer cancel()
+	list, err := l.LoadForwards(ctx)
+	if err != nil {
+		log.Println("forwards.go: loadForwardRules() error: ", "加载转发规则失败,保留原有规则", err)
+		return
+	}
+	forwardRulesLock.Lock()
+	forwardRules = list
+	forwardRulesLock.Unlock()
+	log.Println("forwards.go: loadForwardRules() success: ", "加载转发规则成功", len(list))
+	for _, f := range forwardHooks {
+		f()
+	}
+}
+
+// ForwardRules 返回数据库中的转发规则
+func ForwardRules() (list []ForwardConfig) {
+	forwardRulesLock.RLock()
+	defer forwardRulesLock.RUnlock()
+	for _, r := range forwardRules {
+		c := ForwardConfig{
+			Cluster:       r.ClusterName,
+			From:          r.Zone,
+			To:            splitList(r.Upstreams),
+			Except:        splitList(r.ExceptList),
+			Policy:        r.Policy,
+			TlsServerName: r.TlsServerName,
+		}
+		if c.Cluster == "" {
+			// 集群已被删除的规则不能变成所有集群的规则
+			continue
+		}
+		if err := c.validate(); err != nil {
+			log.Println("forwards.go: ForwardRules() error: ", "转发规则不正确", r.Id, err)
+			continue
+		}
+		list = append(list, c)
+	}
+	return
+}
+
+func splitList(s string) []string {
+	return strings.FieldsFunc(s, func(r rune) bool { return r == ',' || r == ' ' })
+}
@@ -0,0 +1,70 @@
+package config
+
+import (
+	"fmt"
+	"time"
+)
+
+const (
+	HealthTcp  = "tcp"
+	HealthHttp = "http"
+	HealthDns  = "dns"
+)
+
+// HealthCheckConfig 域名下A/AAAA记录的健康检查,每个地址单独检查
+type HealthCheckConfig struct {
+	Type     string `json:"type"`     // tcp、http、dns
+	Port     int    `json:"port"`     // 默认tcp/http为80,dns为53
+	Path     string `json:"path"`     // http请求的路径,默认 /
+	Host     string `json:"host"`     // http请求的Host头;dns探测查询的域名,默认为记录的域名
+	Interval int    `json:"interval"` // 检查间隔秒数,默认10
+	Timeout  int    `json:"timeout"`  // 超时秒数,默认2
+	Fails    int    `json:"fails"`    // 连续失败多少次后标记为不健康,默认3,成功一次即恢复
+}
+
+func (c HealthCheckConfig) validate() error {
+	switch c.Type {
+	case HealthTcp, HealthHttp, HealthDns:
+	default:
+		return fmt.Errorf("未知的检查类型: %s", c.Type)
+	}
+	if c.Port < 0 || c.Port > 65535 || c.Interval < 0 || c.Timeout < 0 || c.Fails < 0 {
+		return fmt.Errorf("port、interval、timeout、fails 不正确")
+	}
+	return nil
+}
+
+// CheckPort 返回检查的端口
+func (c HealthCheckConfig) CheckPort() int {
+	if c.Port > 0 {
+		return c.Port
+	}
+	if c.Type == HealthDns {
+		return 53
+	}
+	return 80
+}
+
+// CheckInterval 返回检查间隔
+func (c HealthCheckConfig) CheckInterval() time.Duration {
+	if c.Interval > 0 {
+		return time.Duration(c.Interval) * time.Second
+	}
+	return 10 * time.Second
+}
+
+// CheckTimeout 返回检查超时
+func (c HealthCheckConfig) CheckTimeout() time.Duration {
+	if c.Timeout > 0 {
+		return time.Duration(c.Timeout) * time.Second
+	}
+	return 2 * time.Second
+}
+
+// MaxFails 返回标记为不健康前允许的连续失败次数
+func (c HealthCheckConfig) MaxFails() int {
+	if c.Fails > 0 {
+		return c.Fails
+	}
+	return 3
+}
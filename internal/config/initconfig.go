@@ -1,26 +1,86 @@
 package config
 
 import (
+	"encoding/base64"
 	"encoding/json"
+	"fmt"
 	"log"
+	"net"
 	"os"
 	"strings"
+	"sync"
+	"testing"
+
+	"github.com/miekg/dns"
 )
 
 // 定义配置结构体
 type AppConfig struct {
-	RedisConfig RedisConfig `json:"redisConfig"`
-	DbConfig    DbConfig    `json:"dbConfig"`
-	CacheFile   string      `json:"cacheFile"`
-	IsMaster    bool        `json:"isMaster"`
+	RedisConfig    RedisConfig                             `json:"redisConfig"`
+	DbConfig       DbConfig                                `json:"dbConfig"`
+	CacheFile      string                                  `json:"cacheFile"`
+	IsMaster       bool                                    `json:"isMaster"`
+	LogLevel       string                                  `json:"logLevel"`
+	AuthTokens     map[string]string                       `json:"authTokens"`   // 集群名 -> 认证token,未配置的集群不校验
+	RateLimit      RateLimitConfig                         `json:"rateLimit"`    // 每个集群的查询限流
+	TtlOverrides   map[string]uint32                       `json:"ttlOverrides"` // 集群名 -> 应答中统一使用的ttl
+	RecordSource   RecordSourceConfig                      `json:"recordSource"`
+	ZoneFiles      []ZoneFileConfig                        `json:"zoneFiles"`    // 按集群加载的zone文件,与记录来源中的记录合并
+	Zones          []ZoneConfig                            `json:"zones"`        // 由本服务负责的zone
+	TransferAddr   string                                  `json:"transferAddr"` // 区域传送的TCP监听地址,为空时只能通过grpc传送
+	NotifyDelay    int                                     `json:"notifyDelay"`  // zone变化后延迟发送NOTIFY的毫秒数,合并短时间内的多次变更,默认1000
+	Tsig           map[string]TsigConfig                   `json:"tsig"`         // 集群名 -> TSIG配置
+	Views          map[string][]string                     `json:"views"`        // view名称 -> 客户端网段(CIDR),记录的view可以使用这里的名称
+	GeoIP          GeoIPConfig                             `json:"geoip"`
+	Weights        map[string]map[string]string            `json:"weights"`        // 集群名 -> 域名 -> 按权重选择记录的方式
+	HealthChecks   map[string]map[string]HealthCheckConfig `json:"healthChecks"`   // 集群名 -> 域名 -> A/AAAA记录的健康检查
+	AnswerPolicies map[string]AnswerPolicyConfig           `json:"answerPolicies"` // 集群名 -> 多条记录的应答顺序
+	Forwards       []ForwardConfig                         `json:"forwards"`       // 不由本服务负责的名称转发到上游
+	MetricsAddr    string                                  `json:"metricsAddr"`    // prometheus指标的HTTP监听地址,为空时不启动
+}
+
+// TsigConfig 集群的TSIG密钥和校验策略
+type TsigConfig struct {
+	Keys      map[string]string `json:"keys"`      // 密钥名称 -> base64编码的密钥
+	Policy    string            `json:"policy"`    // optional(默认): 校验带签名的请求; require: 拒绝没有签名的请求
+	OnFailure string            `json:"onFailure"` // badsig(默认): 返回带TSIG错误码的NOTAUTH应答; reject: 返回grpc错误
+}
+
+const (
+	TsigOptional = "optional"
+	TsigRequire  = "require"
+
+	TsigFailBadsig = "badsig"
+	TsigFailReject = "reject"
+)
+
+// TsigSecret 返回集群中名称为name的TSIG密钥
+func TsigSecret(cluster, name string) (string, bool) {
+	for k, v := range GetConfig().Tsig[cluster].Keys {
+		if dns.CanonicalName(k) == dns.CanonicalName(name) {
+			return v, true
+		}
+	}
+	return "", false
 }
 
 type RedisConfig struct {
-	RedisAddrs    string `json:"redisAddrs"`
-	RedisPassword string `json:"redisPassword"`
-	RedisDb       int    `json:"redisDb"`
-	RedisPrefix   string `json:"redisPrefix"`
-	RedisChannel  string `json:"redisChannel"`
+	RedisAddrs         string `json:"redisAddrs"` // 多个地址用逗号分隔,哨兵模式下为哨兵地址
+	RedisUsername      string `json:"redisUsername"`
+	RedisPassword      string `json:"redisPassword"`
+	RedisDb            int    `json:"redisDb"`
+	RedisPrefix        string `json:"redisPrefix"`
+	RedisRecordCache   bool   `json:"redisRecordCache"` // 将记录同步到redis,作为数据库之外的第二级记录源
+	RedisChannel       string `json:"redisChannel"`
+	RedisHealthKey     string `json:"redisHealthKey"`  // 保存健康检查状态的哈希,默认 dnsadmin:health,不能以 redisPrefix 开头
+	RedisSerialKey     string `json:"redisSerialKey"`  // 保存zone serial的哈希,默认 dnsadmin:serial,不能以 redisPrefix 开头
+	RedisMasterName    string `json:"redisMasterName"` // 配置后使用哨兵模式
+	SentinelUsername   string `json:"sentinelUsername"`
+	SentinelPassword   string `json:"sentinelPassword"`
+	RedisCluster       bool   `json:"redisCluster"` // 使用redis集群模式
+	RedisTls           bool   `json:"redisTls"`
+	RedisTlsServerName string `json:"redisTlsServerName"`
+	RedisTlsInsecure   bool   `json:"redisTlsInsecure"`
 }
 
 type DbConfig struct {
@@ -30,23 +90,180 @@ type DbConfig struct {
 	DbMaxIdleContimeout int    `json:"dbMaxIdleContimeoout"`
 }
 
+// RecordSourceConfig 记录来源配置,数据库类型的来源使用 dbConfig.dsn
+type RecordSourceConfig struct {
+	Type          string   `json:"type"` // mysql(默认)、postgres、sqlite、zonedir、etcd
+	Dir           string   `json:"dir"`  // zonedir 的目录,每个子目录为一个集群
+	EtcdEndpoints []string `json:"etcdEndpoints"`
+	EtcdPrefix    string   `json:"etcdPrefix"`
+	EtcdUsername  string   `json:"etcdUsername"`
+	EtcdPassword  string   `json:"etcdPassword"`
+}
+
+// isSQL 返回记录来源是否为数据库
+func (c RecordSourceConfig) isSQL() bool {
+	switch c.Type {
+	case "", "mysql", "postgres", "sqlite":
+		return true
+	}
+	return false
+}
+
+func (c RecordSourceConfig) validate() error {
+	switch c.Type {
+	case "", "mysql", "postgres", "sqlite":
+	case "zonedir":
+		if c.Dir == "" {
+			return fmt.Errorf("recordSource.dir 不能为空")
+		}
+	case "etcd":
+		if len(c.EtcdEndpoints) == 0 {
+			return fmt.Errorf("recordSource.etcdEndpoints 不能为空")
+		}
+	default:
+		return fmt.Errorf("未知的记录来源: %s", c.Type)
+	}
+	return nil
+}
+
+type RateLimitConfig struct {
+	Qps   float64 `json:"qps"` // 0 表示不限流
+	Burst int     `json:"burst"`
+}
+
+// GeoIPConfig MaxMind数据库文件,用于按客户端的国家、大洲和ASN选择记录
+type GeoIPConfig struct {
+	Db    string `json:"db"`    // GeoIP2/GeoLite2 Country或City数据库
+	AsnDb string `json:"asnDb"` // GeoLite2 ASN数据库
+}
+
+const configFile = "./appsetting.json"
+
 var Config AppConfig
 
+// configLock 保护热加载时对 Config 的替换
+var configLock sync.RWMutex
+
+// GetConfig 返回当前配置的副本,热加载期间读取配置应使用该方法
+func GetConfig() AppConfig {
+	configLock.RLock()
+	defer configLock.RUnlock()
+	return Config
+}
+
+// loadConfig 读取并解析配置文件
+func loadConfig(path string) (cfg AppConfig, err error) {
+	file, err := os.Open(path)
+	if err != nil {
+		return cfg, err
+	}
+	defer file.Close()
+	// 将文件内容解析到结构体中
+	err = json.NewDecoder(file).Decode(&cfg)
+	return cfg, err
+}
+
+// validate 校验配置是否可用
+func (c AppConfig) validate() error {
+	if err := c.RecordSource.validate(); err != nil {
+		return err
+	}
+	if c.RedisConfig.enabled() {
+		if err := c.RedisConfig.validate(); err != nil {
+			return err
+		}
+	} else if c.RecordSource.isSQL() {
+		return fmt.Errorf("数据库记录来源的变更通过redis通知,redisConfig.redisAddrs 不能为空")
+	} else if c.RedisConfig.RedisRecordCache {
+		return fmt.Errorf("redisConfig.redisRecordCache 需要配置 redisAddrs")
+	}
+	if c.RecordSource.isSQL() && c.DbConfig.Dsn == "" {
+		return fmt.Errorf("dbConfig.dsn 不能为空")
+	}
+	if c.DbConfig.DbMaxOpenCon < 0 || c.DbConfig.DbMaxIdleCon < 0 || c.DbConfig.DbMaxIdleContimeout < 0 {
+		return fmt.Errorf("dbConfig 连接池配置不能为负数")
+	}
+	if _, ok := parseLogLevel(c.LogLevel); !ok {
+		return fmt.Errorf("未知的日志级别: %s", c.LogLevel)
+	}
+	for _, zf := range c.ZoneFiles {
+		if err := zf.validate(); err != nil {
+			return err
+		}
+	}
+	for _, z := range c.Zones {
+		if err := z.validate(); err != nil {
+			return err
+		}
+	}
+	for cluster, t := range c.Tsig {
+		if t.Policy != "" && t.Policy != TsigOptional && t.Policy != TsigRequire {
+			return fmt.Errorf("集群 %s 的TSIG策略不正确: %s", cluster, t.Policy)
+		}
+		if t.OnFailure != "" && t.OnFailure != TsigFailBadsig && t.OnFailure != TsigFailReject {
+			return fmt.Errorf("集群 %s 的TSIG onFailure不正确: %s", cluster, t.OnFailure)
+		}
+		for name, secret := range t.Keys {
+			if _, err := base64.StdEncoding.DecodeString(secret); err != nil {
+				return fmt.Errorf("集群 %s 的TSIG密钥 %s 不是base64编码", cluster, name)
+			}
+		}
+	}
+	for name, cidrs := range c.Views {
+		for _, cidr := range cidrs {
+			if _, _, err := net.ParseCIDR(cidr); err != nil {
+				return fmt.Errorf("views.%s 网段不正确: %s", name, cidr)
+			}
+		}
+	}
+	for cluster, names := range c.Weights {
+		for name, mode := range names {
+			if mode != WeightAll && mode != WeightSingle && mode != WeightShuffle {
+				return fmt.Errorf("集群 %s 域名 %s 的权重选择方式不正确: %s", cluster, name, mode)
+			}
+		}
+	}
+	for cluster, names := range c.HealthChecks {
+		for name, hc := range names {
+			if err := hc.validate(); err != nil {
+				return fmt.Errorf("集群 %s 域名 %s 的健康检查不正确: %v", cluster, name, err)
+			}
+		}
+	}
+	for cluster, p := range c.AnswerPolicies {
+		if err := p.validate(); err != nil {
+			return fmt.Errorf("集群 %s 的应答策略不正确: %v", cluster, err)
+		}
+	}
+	for _, f := range c.Forwards {
+		if err := f.validate(); err != nil {
+			return err
+		}
+	}
+	if c.NotifyDelay < 0 {
+		return fmt.Errorf("notifyDelay 不能为负数")
+	}
+	if c.RateLimit.Qps < 0 || c.RateLimit.Burst < 0 {
+		return fmt.Errorf("rateLimit 不能为负数")
+	}
+	return nil
+}
+
 // 定义初始化函数，读取appsetting.json配置文件，使用json.Unmarshal()函数将配置文件中的配置信息读取到结构体中
 func init() {
+	if testing.Testing() {
+		// 测试通过 SetForTest 设置配置,不读取配置文件,也不连接数据库和redis
+		return
+	}
 	// 当前目录读取appsetting.json文件
-	file, err := os.Open("./appsetting.json")
+	cfg, err := loadConfig(configFile)
 	if err != nil {
 		log.Fatal(err)
 	}
-	defer file.Close()
-	// 读取文件内容
-	decoder := json.NewDecoder(file)
-	// 将文件内容解析到结构体中
-	err = decoder.Decode(&Config)
-	if err != nil {
+	if err := cfg.validate(); err != nil {
 		log.Fatal(err)
 	}
+	Config = cfg
 	podIndexStr := os.Getenv("POD_NAME")
 	log.Println("podIndexStr:", podIndexStr)
 	isMaster := strings.HasSuffix(podIndexStr, "-0")
@@ -57,7 +274,11 @@ func init() {
 		log.Println("索引不为0的pod为slave")
 		Config.IsMaster = false
 	}
+	level, _ := parseLogLevel(Config.LogLevel)
+	setLogLevel(level)
 
 	initDB()
+	initSource()
 	initRedis()
+	go watchConfig()
 }
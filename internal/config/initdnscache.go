@@ -10,13 +10,68 @@ import (
 	"os"
 	"strconv"
 	"strings"
+	"sync"
+	"testing"
+	"time"
 
 	"github.com/miekg/dns"
+	"github.com/redis/go-redis/v9"
 )
 
 var DnsRecordsCache map[string][]models.DnsRR
 
-func buildDR(v models.DnsRecords) (dr models.DnsRR) {
+// keyClusters DnsRecordsCache中的key所属的集群,由cacheLock保护。
+// 集群名称和域名中都可以有"-",不能从key(集群-类型-域名)中解析出集群
+var keyClusters map[string]string
+
+// cacheLock 保护 DnsRecordsCache,订阅协程修改缓存时持有写锁
+var cacheLock sync.RWMutex
+
+// RecordKey 返回记录在缓存中的key(集群-类型-域名),域名不区分大小写,统一使用小写
+func RecordKey(cluster string, qtype uint16, name string) string {
+	return cluster + "-" + fmt.Sprint(qtype) + "-" + dns.CanonicalName(name)
+}
+
+// GetDnsRecords 返回key对应的记录,返回的切片不可修改
+func GetDnsRecords(key string) []models.DnsRR {
+	cacheLock.RLock()
+	records := DnsRecordsCache[key]
+	cacheLock.RUnlock()
+	return zoneRecords(key, records)
+}
+
+// rdataTypes 中的类型有多个rdata字段,优先按完整的rdata文本解析(zone文件格式),
+// 解析失败时按只有一个字段的旧格式构建
+var rdataTypes = map[uint16]bool{
+	dns.TypeMX: true, dns.TypeSRV: true, dns.TypeSOA: true, dns.TypeCAA: true,
+	dns.TypeNAPTR: true, dns.TypeTLSA: true, dns.TypeDS: true, dns.TypeSSHFP: true,
+	dns.TypeDNSKEY: true, dns.TypeRRSIG: true, dns.TypeNSEC: true, dns.TypeNSEC3: true,
+	dns.TypeNSEC3PARAM: true,
+}
+
+// parseRdata 按完整的rdata文本解析记录
+func parseRdata(v models.DnsRecords) dns.RR {
+	rr, err := dns.NewRR(fmt.Sprintf("%s %d IN %s %s", v.Name, v.Ttl, dns.TypeToString[v.Qtype], v.Rdata))
+	if err != nil || rr == nil {
+		return nil
+	}
+	return rr
+}
+
+func buildDR(v models.DnsRecords) models.DnsRR {
+	dr := buildRecord(v)
+	dr.View = v.View
+	dr.Weight = v.Weight
+	return dr
+}
+
+func buildRecord(v models.DnsRecords) (dr models.DnsRR) {
+	// TXT 的旧格式是不带引号的原始文本,带引号时按zone文件格式解析
+	if rdataTypes[v.Qtype] || (v.Qtype == dns.TypeTXT && strings.HasPrefix(v.Rdata, `"`)) {
+		if rr := parseRdata(v); rr != nil {
+			return models.DnsRR{DnsRR: rr, Id: v.Id}
+		}
+	}
 	switch v.Qtype {
 	case dns.TypeA:
 		return models.DnsRR{
@@ -201,7 +256,7 @@ func buildDR(v models.DnsRecords) (dr models.DnsRR) {
 			Id: v.Id,
 		}
 	case dns.TypeDNSKEY:
-		log.Println("暂未支持DNSKEY")
+		log.Println("DNSKEY rdata格式不正确", v.Rdata)
 	case dns.TypeRRSIG:
 		return models.DnsRR{
 			DnsRR: &dns.RRSIG{
@@ -259,70 +314,93 @@ func buildDR(v models.DnsRecords) (dr models.DnsRR) {
 	}
 	return dr
 }
-func buildDnsRecordsCache(dnsRecordsList []models.DnsRecords, clear bool) {
+
+// buildDnsRecordsCache 将记录加入cache,并在clusters中记录key所属的集群
+func buildDnsRecordsCache(cache map[string][]models.DnsRR, clusters map[string]string, dnsRecordsList []models.DnsRecords, clear bool) {
 	clearKey := map[string]bool{} // 防止重复清理
 	for _, v := range dnsRecordsList {
-		keyname := v.ClusterName + "-" + fmt.Sprint(v.Qtype) + "-" + v.Name
+		keyname := recordKey(v)
 		if clear && !clearKey[keyname] {
-			DnsRecordsCache[keyname] = []models.DnsRR{}
+			cache[keyname] = []models.DnsRR{}
 			clearKey[keyname] = true // 防止重复清理
 		}
+		clusters[keyname] = v.ClusterName
 		dr := buildDR(v)
 		if dr.Id <= 0 {
 			continue
 		}
-		DnsRecordsCache[keyname] = append(DnsRecordsCache[keyname], dr)
+		cache[keyname] = append(cache[keyname], dr)
 	}
 }
 
 func init() {
 	DnsRecordsCache = make(map[string][]models.DnsRR)
-	go subRedis()
+	keyClusters = make(map[string]string)
+	if testing.Testing() {
+		return
+	}
+	startSubRedis()
+	go watchSource(context.Background())
 	// 查询所有的域名放入内存缓存
 	DnsRecordsList := getDnsRecords(0, "", "")
 	if len(DnsRecordsList) == 0 {
 		log.Println("initdnscache.go: init() error: ", "数据库拉取dns配置失败,从缓存文件获取")
 		DnsRecordsList = getDnsRecordsByFile()
-	} else if Config.IsMaster { // 主节点将从数据库中查询到的记录写入缓存文件
-		// 写入缓存文件
-		file, err := os.OpenFile(Config.CacheFile, os.O_CREATE|os.O_WRONLY, 0666)
-		if err != nil {
-			log.Println("initdnscache.go: init() error: ", "打开缓存文件失败")
-		}
-		defer file.Close()
-		// 创建json编码器
-		encoder := json.NewEncoder(file)
-		// 将结构体数据编码到文件中
-		err = encoder.Encode(DnsRecordsList)
-		if err != nil {
-			log.Println("initdnscache.go: init() error: ", "写入缓存文件失败")
+		if len(DnsRecordsList) == 0 {
+			DnsRecordsList = getDnsRecordsByRedis()
 		}
+	} else if Config.IsMaster { // 主节点将从数据库中查询到的记录写入缓存文件和redis
+		writeCacheFile(DnsRecordsList)
+		syncRedisCache(DnsRecordsList)
 	}
-	buildDnsRecordsCache(DnsRecordsList, false)
-	log.Println("initdnscache.go: init() success: ", "初始化缓存成功", DnsRecordsCache)
+	cacheLock.Lock()
+	buildDnsRecordsCache(DnsRecordsCache, keyClusters, DnsRecordsList, false)
+	cacheLock.Unlock()
+	// 加载zone文件后更新zone的serial
+	loadZoneFiles()
+	go watchZoneFiles()
+	loadForwardRules()
+	log.Println("initdnscache.go: init() success: ", "初始化缓存成功", len(DnsRecordsCache))
+	Debugln("initdnscache.go: init() cache: ", DnsRecordsCache)
 }
 
-func getDnsRecords(clusterId int64, name string, qtype string) (list []models.DnsRecords) {
-	sql := `select id,
-            (select cluster_name from envoy_cluster where id=cluster_id) as cluster_name,
-            name,qtype,qclass,ttl,rdata,
-            create_user,create_time,update_user,update_time
-            from dns_records where is_delete=0`
-	if name != "" {
-		sql += fmt.Sprintf(" and name='%s'", name)
+// writeCacheFile 将从数据库中查询到的记录写入缓存文件
+func writeCacheFile(list []models.DnsRecords) {
+	file, err := os.OpenFile(GetConfig().CacheFile, os.O_CREATE|os.O_WRONLY|os.O_TRUNC, 0666)
+	if err != nil {
+		log.Println("initdnscache.go: writeCacheFile() error: ", "打开缓存文件失败")
+		return
 	}
-	if qtype != "" {
-		sql += fmt.Sprintf(" and qtype=%s", qtype)
+	defer file.Close()
+	// 创建json编码器
+	encoder := json.NewEncoder(file)
+	// 将结构体数据编码到文件中
+	err = encoder.Encode(list)
+	if err != nil {
+		log.Println("initdnscache.go: writeCacheFile() error: ", "写入缓存文件失败")
 	}
-	if clusterId > 0 {
-		sql += fmt.Sprintf(" and cluster_id=%d", clusterId)
+}
+
+// resyncDnsRecordsCache 从数据库全量拉取记录并替换缓存,用于订阅断开期间可能丢失变更的情况
+func resyncDnsRecordsCache() {
+	list := getDnsRecords(0, "", "")
+	if len(list) == 0 {
+		log.Println("initdnscache.go: resyncDnsRecordsCache() error: ", "数据库拉取dns配置失败,保留当前缓存")
+		return
 	}
-	log.Println(sql)
-	err := Orm.Raw(sql).Find(&list).Error
-	if err != nil {
-		log.Println("数据库查询数据失败:", err, sql)
+	if GetConfig().IsMaster {
+		writeCacheFile(list)
+		syncRedisCache(list)
 	}
-	return
+	cache := make(map[string][]models.DnsRR)
+	clusters := make(map[string]string)
+	buildDnsRecordsCache(cache, clusters, list, false)
+	cacheLock.Lock()
+	DnsRecordsCache = cache
+	keyClusters = clusters
+	cacheLock.Unlock()
+	updateZones(allZones)
+	log.Println("initdnscache.go: resyncDnsRecordsCache() success: ", "全量同步缓存成功", len(cache))
 }
 
 func getDnsRecordsByFile() (list []models.DnsRecords) {
@@ -349,119 +427,234 @@ func getDnsRecordsByFile() (list []models.DnsRecords) {
 	return
 }
 
-func subRedis() {
-	ctx := context.Background()
-	pubsub := RedisDb.Subscribe(ctx, RedisChannel)
-	defer pubsub.Close()
-	ch := pubsub.Channel()
-	for msg := range ch {
-		log.Printf("收到变更消息：%s", msg.Payload)
-		if strings.HasSuffix(msg.Payload, "delete") {
-			op_signal := strings.Split(msg.Payload, ":")
-			if len(op_signal) != 3 {
-				log.Println("从redis接收到的数据不正确，不做处理，消息内容：", msg.Payload)
-				continue
-			}
-			cacheDr, ok := DnsRecordsCache[op_signal[0]]
-			if ok {
-				result := []models.DnsRR{}
-				for i, v := range cacheDr {
-					id, err := strconv.ParseInt(op_signal[1], 10, 64)
-					if err != nil {
-						continue
-					}
-					if v.Id != id {
-						result = append(result, cacheDr[i])
-						break
-					}
-				}
-				if len(result) > 0 {
-					DnsRecordsCache[op_signal[0]] = result
-				} else {
-					delete(DnsRecordsCache, op_signal[0])
-				}
+const (
+	subMinBackoff = time.Second
+	subMaxBackoff = 30 * time.Second
+
+	subPingInterval = 30 * time.Second
+)
+
+// subRedis 订阅变更消息,连接断开(如redis主从切换)后按退避时间重连,
+// 重连成功后全量同步一次缓存,避免丢失断开期间的变更
+func subRedis(ctx context.Context, client redis.UniversalClient, channel string) {
+	backoff := subMinBackoff
+	connected := false
+	for {
+		pubsub := client.Subscribe(ctx, channel)
+		// 等待订阅确认,确保连接可用
+		_, err := pubsub.Receive(ctx)
+		if err == nil {
+			if connected {
+				log.Println("initdnscache.go: subRedis() ", "重新订阅成功,全量同步缓存")
+				resyncDnsRecordsCache()
+				loadForwardRules()
 			}
-			continue
+			connected = true
+			backoff = subMinBackoff
+			receiveChanges(ctx, pubsub)
+		} else {
+			log.Println("initdnscache.go: subRedis() error: ", "订阅变更失败:", err)
 		}
+		pubsub.Close()
 
-		var list []models.DnsRecords
-		if strings.HasSuffix(msg.Payload, "reload") {
-			op_signal := strings.Split(msg.Payload, ":")
-			if len(op_signal) != 4 {
-				log.Println("从redis接收到的数据不正确，不做处理，消息内容：", msg.Payload)
-				continue
-			}
-			clusterId, _ := strconv.ParseInt(op_signal[0], 10, 64)
-			list = getDnsRecords(clusterId, op_signal[1], op_signal[2])
+		select {
+		case <-ctx.Done():
+			return
+		case <-time.After(backoff):
 		}
+		log.Println("initdnscache.go: subRedis() ", "变更订阅已断开,重新订阅")
+		backoff *= 2
+		if backoff > subMaxBackoff {
+			backoff = subMaxBackoff
+		}
+	}
+}
 
-		if strings.HasSuffix(msg.Payload, "add") {
-			op_signal := strings.Split(msg.Payload, ":")
-			if len(op_signal) != 7 {
-				log.Println("从redis接收到的数据不正确，不做处理，消息内容：", msg.Payload)
-				continue
+// receiveChanges 处理订阅到的变更消息,直到订阅断开或被取消
+func receiveChanges(ctx context.Context, pubsub *redis.PubSub) {
+	done := make(chan struct{})
+	defer close(done)
+	go func() {
+		// 取消订阅时关闭pubsub,使下面的循环退出;订阅断开后随之退出,不在重连时堆积
+		select {
+		case <-ctx.Done():
+			pubsub.Close()
+		case <-done:
+		}
+	}()
+	// 不使用 pubsub.Channel(),它在连接出错时会在内部无限重试,无法感知断开。
+	// 超时没有收到消息时发送ping,上一次ping也没有响应则认为连接已断开
+	pinged := false
+	for {
+		v, err := pubsub.ReceiveTimeout(ctx, subPingInterval)
+		if err != nil {
+			if ctx.Err() != nil {
+				return
 			}
-			keyname := op_signal[0] + "-" + op_signal[3] + "-" + op_signal[1]
-			dnsRecords, ok := DnsRecordsCache[keyname]
-
-			id, _ := strconv.ParseInt(op_signal[5], 10, 64)
-			if ok { // 如果存在则加入列表
-				isAdd := true
-				for _, v := range dnsRecords {
-					if v.Id == id {
-						isAdd = false
-					}
-				}
-				if isAdd {
-					dnsModel := buildModelByChange(id, op_signal)
-					tmpDr := buildDR(dnsModel)
-					dnsRecords = append(dnsRecords, tmpDr)
-					DnsRecordsCache[keyname] = dnsRecords
-				} else {
-					log.Println("要添加的内容已存在,不做添加", op_signal)
+			if ne, ok := err.(net.Error); ok && ne.Timeout() && !pinged {
+				if err = pubsub.Ping(ctx); err == nil {
+					pinged = true
+					continue
 				}
-				continue
-			} else {
-				dnsModel := buildModelByChange(id, op_signal)
-				list = append(list, dnsModel)
 			}
-			if len(list) <= 0 {
-				log.Println("initdnscache.go: subRedis() error: ", "缓存中已存在该记录，不做处理，消息内容：", msg.Payload)
-				continue
+			log.Println("initdnscache.go: receiveChanges() error: ", err)
+			return
+		}
+		pinged = false
+		if msg, ok := v.(*redis.Message); ok {
+			if t, changed := handleChange(msg.Payload); changed {
+				updateZones(t)
 			}
 		}
-		if strings.HasSuffix(msg.Payload, "update") {
-			op_signal := strings.Split(msg.Payload, ":")
-			if len(op_signal) != 7 {
-				log.Println("从redis接收到的update数据不正确，不做处理，消息内容：", msg.Payload)
-				continue
+	}
+}
+
+// handleChange 按变更消息更新缓存,返回缓存可能变化的名称,没有变化时changed为false
+func handleChange(payload string) (t zoneTarget, changed bool) {
+	log.Printf("收到变更消息：%s", payload)
+	if payload == forwardReload {
+		loadForwardRules()
+		return
+	}
+	var list []models.DnsRecords
+	var scope *reloadScope
+	// 从记录来源加载了add/update的记录时为true,否则view和权重不可用
+	loaded := false
+	if op_signal := strings.Split(payload, ":"); strings.HasSuffix(payload, "reload") {
+		if len(op_signal) != 4 {
+			log.Println("从redis接收到的数据不正确，不做处理，消息内容：", payload)
+			return
+		}
+		clusterId, _ := strconv.ParseInt(op_signal[0], 10, 64)
+		var err error
+		if list, scope, err = loadReload(clusterId, op_signal[1], op_signal[2]); err != nil {
+			log.Println("initdnscache.go: handleChange() error: ", "加载reload的记录失败,保留当前缓存", err, payload)
+			return
+		}
+		if scope != nil {
+			t = zoneTarget{cluster: scope.cluster, name: scope.name}
+		}
+		changed = true
+	} else if (strings.HasSuffix(payload, "add") || strings.HasSuffix(payload, "update")) && len(op_signal) == 7 {
+		id, _ := strconv.ParseInt(op_signal[5], 10, 64)
+		r, ok, err := loadChangedRecord(id)
+		if err != nil {
+			// 缺少view的记录会返回给所有客户端,不使用消息中的字段
+			log.Println("initdnscache.go: handleChange() error: ", "加载变更的记录失败,不做处理", err, payload)
+			return
+		}
+		if !ok {
+			r = buildModelByChange(id, op_signal)
+		}
+		list, loaded = []models.DnsRecords{r}, ok
+		t, changed = zoneTarget{cluster: op_signal[0], name: op_signal[1]}, true
+	}
+	syncChangeToRedis(payload, list, scope)
+
+	cacheLock.Lock()
+	defer cacheLock.Unlock()
+	if scope != nil {
+		// reload范围内已经没有记录的key
+		for key := range DnsRecordsCache {
+			if scope.contains(key, keyClusters[key]) {
+				delete(DnsRecordsCache, key)
+				delete(keyClusters, key)
 			}
-			keyname := op_signal[0] + "-" + op_signal[3] + "-" + op_signal[1]
-			cacheDr, ok := DnsRecordsCache[keyname]
-			if ok {
-				id, _ := strconv.ParseInt(op_signal[5], 10, 64)
-				for i, v := range cacheDr {
-					if v.Id == id {
-						dnsModel := buildModelByChange(id, op_signal)
-						cacheDr[i] = buildDR(dnsModel)
-					}
+		}
+	}
+	if strings.HasSuffix(payload, "delete") {
+		op_signal := strings.Split(payload, ":")
+		if len(op_signal) != 3 {
+			log.Println("从redis接收到的数据不正确，不做处理，消息内容：", payload)
+			return
+		}
+		id, err := strconv.ParseInt(op_signal[1], 10, 64)
+		if err != nil {
+			return
+		}
+		cacheDr, ok := DnsRecordsCache[op_signal[0]]
+		if ok {
+			cluster := keyClusters[op_signal[0]]
+			t, changed = zoneTarget{cluster: cluster, name: keyName(op_signal[0], cluster)}, true
+			result := []models.DnsRR{}
+			for i, v := range cacheDr {
+				if v.Id != id {
+					result = append(result, cacheDr[i])
 				}
-				DnsRecordsCache[keyname] = cacheDr
-				continue
+			}
+			if len(result) > 0 {
+				DnsRecordsCache[op_signal[0]] = result
 			} else {
-				log.Println("subRedis() update error: ", "缓存中不存在该记录，不做处理，消息内容：", msg.Payload)
-				continue
+				delete(DnsRecordsCache, op_signal[0])
+				delete(keyClusters, op_signal[0])
 			}
 		}
+		return
+	}
 
-		if len(list) == 0 {
-			log.Println("initdnscache.go: subRedis() error: ", "没有获取到数据，不做处理，消息内容：", msg.Payload)
-			continue
+	if strings.HasSuffix(payload, "add") {
+		op_signal := strings.Split(payload, ":")
+		if len(op_signal) != 7 {
+			log.Println("从redis接收到的数据不正确，不做处理，消息内容：", payload)
+			return
+		}
+		keyname := op_signal[0] + "-" + op_signal[3] + "-" + dns.CanonicalName(op_signal[1])
+		dnsRecords, ok := DnsRecordsCache[keyname]
+
+		id, _ := strconv.ParseInt(op_signal[5], 10, 64)
+		if ok { // 如果存在则加入列表
+			for _, v := range dnsRecords {
+				if v.Id == id {
+					log.Println("要添加的内容已存在,不做添加", op_signal)
+					return
+				}
+			}
+			tmpDr := buildDR(list[0])
+			// 复制后追加,避免修改读取方持有的切片
+			result := make([]models.DnsRR, 0, len(dnsRecords)+1)
+			result = append(result, dnsRecords...)
+			DnsRecordsCache[keyname] = append(result, tmpDr)
+			return
 		}
-		buildDnsRecordsCache(list, true)
-		log.Println("initdnscache.go: subRedis() success: ", "更新缓存成功", list)
-		continue
 	}
+	if strings.HasSuffix(payload, "update") {
+		op_signal := strings.Split(payload, ":")
+		if len(op_signal) != 7 {
+			log.Println("从redis接收到的update数据不正确，不做处理，消息内容：", payload)
+			return
+		}
+		keyname := op_signal[0] + "-" + op_signal[3] + "-" + dns.CanonicalName(op_signal[1])
+		cacheDr, ok := DnsRecordsCache[keyname]
+		if !ok {
+			log.Println("subRedis() update error: ", "缓存中不存在该记录，不做处理，消息内容：", payload)
+			return
+		}
+		id, _ := strconv.ParseInt(op_signal[5], 10, 64)
+		result := make([]models.DnsRR, len(cacheDr))
+		for i, v := range cacheDr {
+			result[i] = v
+			if v.Id == id {
+				dnsModel := list[0]
+				if !loaded {
+					// 变更消息不包含view和权重,保留原记录的值
+					dnsModel.View = v.View
+					dnsModel.Weight = v.Weight
+				}
+				result[i] = buildDR(dnsModel)
+			}
+		}
+		DnsRecordsCache[keyname] = result
+		return
+	}
+
+	if len(list) == 0 {
+		log.Println("initdnscache.go: subRedis() error: ", "没有获取到数据，不做处理，消息内容：", payload)
+		return
+	}
+	buildDnsRecordsCache(DnsRecordsCache, keyClusters, list, true)
+	log.Println("initdnscache.go: subRedis() success: ", "更新缓存成功", len(list))
+	Debugln("initdnscache.go: subRedis() records: ", list)
+	return
 }
 
 func buildModelByChange(id int64, op_signal []string) models.DnsRecords {
@@ -473,6 +666,7 @@ func buildModelByChange(id int64, op_signal []string) models.DnsRecords {
 		Rdata:       op_signal[2],
 		Qtype:       uint16(qty),
 		Ttl:         uint32(ttl),
+		Weight:      1,
 		Id:          id,
 	}
 	return dnsModel
@@ -1,21 +1,178 @@
 package config
 
 import (
+	"context"
+	"crypto/tls"
+	"fmt"
+	"log"
+	"strings"
+	"sync"
+
 	"github.com/redis/go-redis/v9"
 )
 
-var RedisDb *redis.Client
+var RedisDb redis.UniversalClient
 var RedisChannel, RedisPrefix string
 
+var (
+	redisLock sync.Mutex
+	subCancel context.CancelFunc
+)
+
 func initRedis() {
-	address := Config.RedisConfig.RedisAddrs
-	pwd := Config.RedisConfig.RedisPassword
-	db := Config.RedisConfig.RedisDb
-	redis_channel := Config.RedisConfig.RedisChannel
-	RedisChannel = redis_channel
-	RedisDb = redis.NewClient(&redis.Options{
-		Addr:     address,
-		Password: pwd,
-		DB:       db,
-	})
+	RedisChannel = Config.RedisConfig.RedisChannel
+	RedisPrefix = Config.RedisConfig.RedisPrefix
+	RedisDb = newRedisClient(Config.RedisConfig)
+	if RedisDb == nil {
+		log.Println("未配置redis,不订阅变更消息")
+	}
+}
+
+// newRedisClient 根据配置创建单机、哨兵或集群模式的redis客户端,未配置地址时返回nil
+func newRedisClient(c RedisConfig) redis.UniversalClient {
+	addrs := c.addrs()
+	if len(addrs) == 0 {
+		return nil
+	}
+	var tlsConfig *tls.Config
+	if c.RedisTls {
+		tlsConfig = &tls.Config{
+			ServerName:         c.RedisTlsServerName,
+			InsecureSkipVerify: c.RedisTlsInsecure,
+			MinVersion:         tls.VersionTLS12,
+		}
+	}
+	switch {
+	case c.RedisMasterName != "":
+		return redis.NewFailoverClient(&redis.FailoverOptions{
+			MasterName:       c.RedisMasterName,
+			SentinelAddrs:    addrs,
+			SentinelUsername: c.SentinelUsername,
+			SentinelPassword: c.SentinelPassword,
+			Username:         c.RedisUsername,
+			Password:         c.RedisPassword,
+			DB:               c.RedisDb,
+			TLSConfig:        tlsConfig,
+		})
+	case c.RedisCluster:
+		return redis.NewClusterClient(&redis.ClusterOptions{
+			Addrs:     addrs,
+			Username:  c.RedisUsername,
+			Password:  c.RedisPassword,
+			TLSConfig: tlsConfig,
+		})
+	default:
+		return redis.NewClient(&redis.Options{
+			Addr:      addrs[0],
+			Username:  c.RedisUsername,
+			Password:  c.RedisPassword,
+			DB:        c.RedisDb,
+			TLSConfig: tlsConfig,
+		})
+	}
+}
+
+// addrs 返回逗号分隔的redis地址列表,哨兵模式下为哨兵地址
+func (c RedisConfig) addrs() (addrs []string) {
+	for _, a := range strings.Split(c.RedisAddrs, ",") {
+		if a = strings.TrimSpace(a); a != "" {
+			addrs = append(addrs, a)
+		}
+	}
+	return
+}
+
+// enabled 返回是否配置了redis。数据库记录来源的变更通过redis通知,必须配置;
+// zonedir、etcd 来源自己感知变更,redis 只用于健康检查状态和记录缓存,可以不配置
+func (c RedisConfig) enabled() bool {
+	return len(c.addrs()) > 0
+}
+
+func (c RedisConfig) validate() error {
+	if len(c.addrs()) == 0 {
+		return fmt.Errorf("redisConfig.redisAddrs 不能为空")
+	}
+	if c.RedisMasterName != "" && c.RedisCluster {
+		return fmt.Errorf("redisConfig 不能同时配置 redisMasterName 和 redisCluster")
+	}
+	if c.RedisCluster && c.RedisDb != 0 {
+		return fmt.Errorf("redis集群模式只支持 redisDb 0")
+	}
+	if c.RedisMasterName == "" && !c.RedisCluster && len(c.addrs()) > 1 {
+		return fmt.Errorf("单机模式只能配置一个redis地址")
+	}
+	if c.RedisPrefix != "" && strings.HasPrefix(c.healthKey(), c.RedisPrefix) {
+		return fmt.Errorf("redisConfig.redisHealthKey 不能以 redisPrefix 开头")
+	}
+	if c.RedisPrefix != "" && strings.HasPrefix(c.serialKey(), c.RedisPrefix) {
+		return fmt.Errorf("redisConfig.redisSerialKey 不能以 redisPrefix 开头")
+	}
+	return nil
+}
+
+// healthKey 返回保存健康检查状态的哈希
+func (c RedisConfig) healthKey() string {
+	if c.RedisHealthKey == "" {
+		return "dnsadmin:health"
+	}
+	return c.RedisHealthKey
+}
+
+// serialKey 返回保存zone serial的哈希
+func (c RedisConfig) serialKey() string {
+	if c.RedisSerialKey == "" {
+		return "dnsadmin:serial"
+	}
+	return c.RedisSerialKey
+}
+
+// HealthRedis 返回当前的redis客户端和保存健康检查状态的哈希
+func HealthRedis() (redis.UniversalClient, string) {
+	client, _ := redisClient()
+	return client, GetConfig().RedisConfig.healthKey()
+}
+
+// startSubRedis 启动变更订阅,之前的订阅会被取消
+func startSubRedis() {
+	redisLock.Lock()
+	defer redisLock.Unlock()
+	if subCancel != nil {
+		subCancel()
+	}
+	subCancel = nil
+	if RedisDb == nil {
+		return
+	}
+	ctx, cancel := context.WithCancel(context.Background())
+	subCancel = cancel
+	go subRedis(ctx, RedisDb, RedisChannel)
+}
+
+// reconnectRedis 使用当前配置重建redis连接并重新订阅变更
+func reconnectRedis() {
+	c := GetConfig().RedisConfig
+	client := newRedisClient(c)
+
+	redisLock.Lock()
+	old := RedisDb
+	RedisDb = client
+	RedisChannel = c.RedisChannel
+	RedisPrefix = c.RedisPrefix
+	redisLock.Unlock()
+
+	startSubRedis()
+	if old != nil {
+		old.Close()
+	}
+}
+
+// PublishChange 发布变更消息,所有pod(包括自己)订阅到后更新缓存
+func PublishChange(ctx context.Context, payload string) error {
+	redisLock.Lock()
+	client, channel := RedisDb, RedisChannel
+	redisLock.Unlock()
+	if client == nil {
+		return fmt.Errorf("未配置redis,不能发布变更消息")
+	}
+	return client.Publish(ctx, channel, payload).Err()
 }
@@ -0,0 +1,179 @@
+package config
+
+import (
+	"context"
+	"dnsadminserver/internal/models"
+	"dnsadminserver/internal/source"
+	"fmt"
+	"log"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/miekg/dns"
+	clientv3 "go.etcd.io/etcd/client/v3"
+)
+
+// Source 当前使用的记录来源
+var Source source.RecordSource
+
+const (
+	sourceLoadTimeout  = 30 * time.Second
+	sourceRetryBackoff = 5 * time.Second
+)
+
+func initSource() {
+	c := Config.RecordSource
+	switch c.Type {
+	case "zonedir":
+		Source = source.NewZoneDir(c.Dir)
+	case "etcd":
+		client, err := clientv3.New(clientv3.Config{
+			Endpoints:   c.EtcdEndpoints,
+			Username:    c.EtcdUsername,
+			Password:    c.EtcdPassword,
+			DialTimeout: 5 * time.Second,
+		})
+		if err != nil {
+			log.Fatal(err)
+		}
+		Source = source.NewEtcd(client, c.EtcdPrefix)
+	default:
+		name := c.Type
+		if name == "" {
+			name = "mysql"
+		}
+		Source = source.NewSQL(Orm, name)
+	}
+	log.Println("记录来源:", Source.Name())
+}
+
+// getDnsRecords 从记录来源查询记录,参数都为空时查询全部记录。
+// 按集群id查询只有数据库来源支持,用于处理redis中的reload消息
+func getDnsRecords(clusterId int64, name string, qtype string) (list []models.DnsRecords) {
+	ctx, cancel := context.WithTimeout(context.Background(), sourceLoadTimeout)
+	defer cancel()
+	var err error
+	if clusterId == 0 && name == "" && qtype == "" {
+		list, err = Source.LoadAll(ctx)
+	} else if l, ok := Source.(source.ClusterIdLoader); ok {
+		qt, _ := strconv.ParseUint(qtype, 10, 16)
+		list, err = l.LoadByClusterId(ctx, clusterId, name, uint16(qt))
+	} else {
+		log.Println("initsource.go: getDnsRecords() error: ", Source.Name(), "不支持按集群id查询")
+		return
+	}
+	if err != nil {
+		log.Println("数据库查询数据失败:", err, clusterId, name, qtype)
+	}
+	return
+}
+
+// watchSource 监听记录来源的变化,Watch异常返回后重新监听
+func watchSource(ctx context.Context) {
+	for {
+		err := Source.Watch(ctx, reloadCluster)
+		if ctx.Err() != nil {
+			return
+		}
+		if err != nil {
+			log.Println("initsource.go: watchSource() error: ", err)
+		}
+		time.Sleep(sourceRetryBackoff)
+	}
+}
+
+// reloadCluster 从记录来源重新加载一个集群的记录并替换缓存,cluster为空时全量同步
+func reloadCluster(cluster string) {
+	if cluster == "" {
+		resyncDnsRecordsCache()
+		return
+	}
+	ctx, cancel := context.WithTimeout(context.Background(), sourceLoadTimeout)
+	defer cancel()
+	list, err := Source.LoadCluster(ctx, cluster)
+	if err != nil {
+		log.Println("initsource.go: reloadCluster() error: ", cluster, err)
+		return
+	}
+	cache := make(map[string][]models.DnsRR)
+	clusters := make(map[string]string)
+	buildDnsRecordsCache(cache, clusters, list, false)
+
+	cacheLock.Lock()
+	for key := range DnsRecordsCache {
+		if keyInCluster(key, cluster) {
+			delete(DnsRecordsCache, key)
+			delete(keyClusters, key)
+		}
+	}
+	for key, v := range cache {
+		DnsRecordsCache[key] = v
+		keyClusters[key] = clusters[key]
+	}
+	cacheLock.Unlock()
+	updateZones(zoneTarget{cluster: cluster})
+	log.Println("initsource.go: reloadCluster() success: ", cluster, len(list))
+}
+
+// reloadScope reload消息涉及的缓存key:集群中的全部记录,或其中指定域名、类型的记录
+type reloadScope struct {
+	cluster, name, qtype string
+}
+
+// contains 判断属于cluster的缓存key(集群-类型-域名)是否在reload的范围内
+func (r reloadScope) contains(key, cluster string) bool {
+	if cluster != r.cluster {
+		return false
+	}
+	qtype, name, _ := strings.Cut(strings.TrimPrefix(key, cluster+"-"), "-")
+	return (r.qtype == "" || r.qtype == qtype) && (r.name == "" || r.name == name)
+}
+
+// loadReload 加载reload消息涉及的记录。集群id大于0时同时返回reload的范围,
+// 范围内不在list中的key对应的记录已被删除;加载失败时返回错误,不能当作记录已被删除
+func loadReload(clusterId int64, name string, qtype string) (list []models.DnsRecords, scope *reloadScope, err error) {
+	l, ok := Source.(source.ClusterIdLoader)
+	if !ok {
+		return nil, nil, fmt.Errorf("%s 不支持按集群id查询", Source.Name())
+	}
+	ctx, cancel := context.WithTimeout(context.Background(), sourceLoadTimeout)
+	defer cancel()
+	qt, _ := strconv.ParseUint(qtype, 10, 16)
+	if list, err = l.LoadByClusterId(ctx, clusterId, name, uint16(qt)); err != nil {
+		return nil, nil, err
+	}
+	if clusterId > 0 {
+		cluster, err := l.ClusterName(ctx, clusterId)
+		if err != nil {
+			return nil, nil, err
+		}
+		if qt == 0 {
+			qtype = ""
+		}
+		if name != "" {
+			name = dns.CanonicalName(name)
+		}
+		scope = &reloadScope{cluster: cluster, name: name, qtype: qtype}
+	}
+	return list, scope, nil
+}
+
+// loadChangedRecord 从记录来源加载add/update消息对应的记录,消息中不包含view和权重。
+// 记录来源不支持按id加载时ok为false
+func loadChangedRecord(id int64) (r models.DnsRecords, ok bool, err error) {
+	l, ok := Source.(source.ClusterIdLoader)
+	if !ok {
+		return r, false, nil
+	}
+	ctx, cancel := context.WithTimeout(context.Background(), sourceLoadTimeout)
+	defer cancel()
+	r, err = l.LoadById(ctx, id)
+	return r, true, err
+}
+
+// keyInCluster 判断DnsRecordsCache中的key是否属于cluster,调用方需持有cacheLock
+func keyInCluster(key, cluster string) bool {
+	c, ok := keyClusters[key]
+	return ok && c == cluster
+}
@@ -0,0 +1,84 @@
+package config
+
+import (
+	"context"
+	"dnsadminserver/internal/models"
+	"testing"
+)
+
+// testSource 按集群返回固定记录的记录来源
+type testSource map[string][]models.DnsRecords
+
+func (s testSource) LoadAll(ctx context.Context) (list []models.DnsRecords, err error) {
+	for _, v := range s {
+		list = append(list, v...)
+	}
+	return
+}
+
+func (s testSource) LoadCluster(ctx context.Context, cluster string) ([]models.DnsRecords, error) {
+	return s[cluster], nil
+}
+
+func (s testSource) LoadByName(ctx context.Context, cluster, name string, qtype uint16) (list []models.DnsRecords, err error) {
+	for _, v := range s[cluster] {
+		if v.Name == name && (qtype == 0 || v.Qtype == qtype) {
+			list = append(list, v)
+		}
+	}
+	return
+}
+
+func (s testSource) Watch(ctx context.Context, changed func(cluster string)) error {
+	<-ctx.Done()
+	return nil
+}
+
+func (s testSource) Name() string { return "test" }
+
+func testRecord(id int64, cluster, name string, qtype uint16, rdata string) models.DnsRecords {
+	return models.DnsRecords{Id: id, ClusterName: cluster, Name: name, Qtype: qtype, Qclass: 1, Ttl: 60, Rdata: rdata, Weight: 1}
+}
+
+func TestReloadClusterPrefix(t *testing.T) {
+	// prod-1 的key以 "prod-" 和数字开头,不能当作 prod 的key
+	SetForTest(AppConfig{}, []models.DnsRecords{
+		testRecord(1, "prod", "www.x.", 1, "10.0.0.1"),
+		testRecord(2, "prod-1", "www.x.", 1, "10.0.1.1"),
+		testRecord(3, "prod", "old.x.", 1, "10.0.0.3"),
+	})
+	Source = testSource{"prod": {testRecord(4, "prod", "www.x.", 1, "10.0.0.4")}}
+	defer func() { Source = nil }()
+
+	reloadCluster("prod")
+	if r := GetDnsRecords("prod-1-www.x."); len(r) != 1 || r[0].Id != 4 {
+		t.Errorf("prod www.x. = %v, want the reloaded record", r)
+	}
+	if r := GetDnsRecords("prod-1-old.x."); len(r) != 0 {
+		t.Errorf("prod old.x. = %v, want deleted", r)
+	}
+	if r := GetDnsRecords("prod-1-1-www.x."); len(r) != 1 || r[0].Id != 2 {
+		t.Errorf("prod-1 www.x. = %v, want it kept", r)
+	}
+}
+
+func TestReloadScope(t *testing.T) {
+	tests := []struct {
+		scope   reloadScope
+		key     string
+		cluster string
+		want    bool
+	}{
+		{reloadScope{cluster: "prod"}, "prod-1-www.x.", "prod", true},
+		{reloadScope{cluster: "prod"}, "prod-1-1-www.x.", "prod-1", false},
+		{reloadScope{cluster: "prod", qtype: "1"}, "prod-16-www.x.", "prod", false},
+		{reloadScope{cluster: "prod", name: "www.x."}, "prod-1-www.x.", "prod", true},
+		{reloadScope{cluster: "prod", name: "www.x."}, "prod-1-1-www.x.", "prod", false},
+		{reloadScope{cluster: "prod-1", name: "www.x.", qtype: "1"}, "prod-1-1-www.x.", "prod-1", true},
+	}
+	for i, tc := range tests {
+		if got := tc.scope.contains(tc.key, tc.cluster); got != tc.want {
+			t.Errorf("test %d: contains(%s, %s) = %v, want %v", i, tc.key, tc.cluster, got, tc.want)
+		}
+	}
+}
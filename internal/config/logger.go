@@ -0,0 +1,41 @@
+package config
+
+import (
+	"log"
+	"sync/atomic"
+)
+
+const (
+	LevelDebug int32 = iota
+	LevelInfo
+)
+
+var logLevel atomic.Int32
+
+func parseLogLevel(s string) (int32, bool) {
+	switch s {
+	case "debug":
+		return LevelDebug, true
+	case "", "info":
+		return LevelInfo, true
+	}
+	return LevelInfo, false
+}
+
+func setLogLevel(level int32) {
+	logLevel.Store(level)
+}
+
+// Debugln 仅在日志级别为debug时输出
+func Debugln(v ...any) {
+	if logLevel.Load() <= LevelDebug {
+		log.Println(v...)
+	}
+}
+
+// Debugf 仅在日志级别为debug时输出
+func Debugf(format string, v ...any) {
+	if logLevel.Load() <= LevelDebug {
+		log.Printf(format, v...)
+	}
+}
@@ -0,0 +1,229 @@
+package config
+
+import (
+	"context"
+	"dnsadminserver/internal/models"
+	"encoding/json"
+	"log"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/redis/go-redis/v9"
+)
+
+// redis 作为第二级记录源:主节点将数据库中的记录同步到redis哈希中,
+// 每个 集群-类型-域名 一个哈希,字段为记录id,值为记录的json。
+// 数据库不可用且缓存文件不存在时,从redis加载记录。
+
+const redisCacheTimeout = 30 * time.Second
+
+func redisCacheEnabled() bool {
+	return GetConfig().RedisConfig.RedisRecordCache
+}
+
+func redisClient() (redis.UniversalClient, string) {
+	redisLock.Lock()
+	defer redisLock.Unlock()
+	return RedisDb, RedisPrefix
+}
+
+func recordKey(v models.DnsRecords) string {
+	return RecordKey(v.ClusterName, v.Qtype, v.Name)
+}
+
+func sampleRecord(v models.DnsRecords) models.SampleDnsRecords {
+	return models.SampleDnsRecords{
+		Id:          v.Id,
+		ClusterName: v.ClusterName,
+		Name:        v.Name,
+		Qtype:       v.Qtype,
+		Qclass:      v.Qclass,
+		Ttl:         v.Ttl,
+		Rdata:       v.Rdata,
+		View:        v.View,
+		Weight:      v.Weight,
+	}
+}
+
+// scanRedisKeys 返回所有以prefix开头的key,集群模式下遍历所有主节点
+func scanRedisKeys(ctx context.Context, client redis.UniversalClient, prefix string) (keys []string, err error) {
+	scan := func(ctx context.Context, c redis.Cmdable) error {
+		iter := c.Scan(ctx, 0, prefix+"*", 1000).Iterator()
+		for iter.Next(ctx) {
+			keys = append(keys, iter.Val())
+		}
+		return iter.Err()
+	}
+	if cc, ok := client.(*redis.ClusterClient); ok {
+		// ForEachMaster 并发执行,keys 需要加锁
+		var mu sync.Mutex
+		err = cc.ForEachMaster(ctx, func(ctx context.Context, c *redis.Client) error {
+			mu.Lock()
+			defer mu.Unlock()
+			return scan(ctx, c)
+		})
+		return
+	}
+	err = scan(ctx, client)
+	return
+}
+
+// getDnsRecordsByRedis 从redis加载全部记录
+func getDnsRecordsByRedis() (list []models.DnsRecords) {
+	if !redisCacheEnabled() {
+		return
+	}
+	log.Println("从redis获取dns配置")
+	client, prefix := redisClient()
+	ctx, cancel := context.WithTimeout(context.Background(), redisCacheTimeout)
+	defer cancel()
+	keys, err := scanRedisKeys(ctx, client, prefix)
+	if err != nil {
+		log.Println("rediscache.go: getDnsRecordsByRedis() error: ", err)
+		return
+	}
+	for _, key := range keys {
+		values, err := client.HGetAll(ctx, key).Result()
+		if err != nil {
+			log.Println("rediscache.go: getDnsRecordsByRedis() error: ", key, err)
+			continue
+		}
+		for _, v := range values {
+			// 增加权重之前写入的记录没有weight字段,权重为1
+			r := models.SampleDnsRecords{Weight: 1}
+			if err := json.Unmarshal([]byte(v), &r); err != nil {
+				log.Println("rediscache.go: getDnsRecordsByRedis() error: ", key, err)
+				continue
+			}
+			list = append(list, models.DnsRecords{
+				Id:          r.Id,
+				ClusterName: r.ClusterName,
+				Name:        r.Name,
+				Qtype:       r.Qtype,
+				Qclass:      r.Qclass,
+				Ttl:         r.Ttl,
+				Rdata:       r.Rdata,
+				View:        r.View,
+				Weight:      r.Weight,
+			})
+		}
+	}
+	return
+}
+
+// redisKeyCluster 返回redis中key保存的记录所属的集群,key为空时返回空字符串
+func redisKeyCluster(ctx context.Context, client redis.UniversalClient, key string) (string, error) {
+	values, err := client.HVals(ctx, key).Result()
+	if err != nil || len(values) == 0 {
+		return "", err
+	}
+	var r models.SampleDnsRecords
+	if err := json.Unmarshal([]byte(values[0]), &r); err != nil {
+		return "", err
+	}
+	return r.ClusterName, nil
+}
+
+// setRedisRecords 用list替换其中涉及的哈希
+func setRedisRecords(ctx context.Context, client redis.UniversalClient, prefix string, list []models.DnsRecords) (map[string]bool, error) {
+	grouped := map[string][]any{}
+	for _, v := range list {
+		data, err := json.Marshal(sampleRecord(v))
+		if err != nil {
+			return nil, err
+		}
+		key := prefix + recordKey(v)
+		grouped[key] = append(grouped[key], strconv.FormatInt(v.Id, 10), string(data))
+	}
+	written := map[string]bool{}
+	for key, fields := range grouped {
+		// 集群模式下同一个key在同一个槽位,事务可用
+		_, err := client.TxPipelined(ctx, func(pipe redis.Pipeliner) error {
+			pipe.Del(ctx, key)
+			pipe.HSet(ctx, key, fields...)
+			return nil
+		})
+		if err != nil {
+			return written, err
+		}
+		written[key] = true
+	}
+	return written, nil
+}
+
+// syncRedisCache 主节点将数据库中的全部记录同步到redis,并删除已经不存在的key
+func syncRedisCache(list []models.DnsRecords) {
+	if !redisCacheEnabled() || !GetConfig().IsMaster {
+		return
+	}
+	client, prefix := redisClient()
+	ctx, cancel := context.WithTimeout(context.Background(), redisCacheTimeout)
+	defer cancel()
+	existing, err := scanRedisKeys(ctx, client, prefix)
+	if err != nil {
+		log.Println("rediscache.go: syncRedisCache() error: ", err)
+		return
+	}
+	written, err := setRedisRecords(ctx, client, prefix, list)
+	if err != nil {
+		log.Println("rediscache.go: syncRedisCache() error: ", err)
+		return
+	}
+	for _, key := range existing {
+		if !written[key] {
+			client.Del(ctx, key)
+		}
+	}
+	log.Println("rediscache.go: syncRedisCache() success: ", "同步记录到redis成功", len(written))
+}
+
+// syncChangeToRedis 主节点将变更消息同步到redis,list为reload消息从数据库查询到的记录或add/update的记录,
+// scope不为nil时删除范围内不在list中的key
+func syncChangeToRedis(payload string, list []models.DnsRecords, scope *reloadScope) {
+	if !redisCacheEnabled() || !GetConfig().IsMaster {
+		return
+	}
+	client, prefix := redisClient()
+	ctx, cancel := context.WithTimeout(context.Background(), redisCacheTimeout)
+	defer cancel()
+	op_signal := strings.Split(payload, ":")
+	var err error
+	switch {
+	case strings.HasSuffix(payload, "delete") && len(op_signal) == 3:
+		err = client.HDel(ctx, prefix+op_signal[0], op_signal[1]).Err()
+	case (strings.HasSuffix(payload, "add") || strings.HasSuffix(payload, "update")) && len(list) == 1:
+		v := list[0]
+		var data []byte
+		if data, err = json.Marshal(sampleRecord(v)); err == nil {
+			err = client.HSet(ctx, prefix+recordKey(v), op_signal[5], string(data)).Err()
+		}
+	case strings.HasSuffix(payload, "reload"):
+		var written map[string]bool
+		if written, err = setRedisRecords(ctx, client, prefix, list); err != nil || scope == nil {
+			break
+		}
+		var keys []string
+		if keys, err = scanRedisKeys(ctx, client, prefix+scope.cluster+"-"); err != nil {
+			break
+		}
+		for _, key := range keys {
+			if written[key] {
+				continue
+			}
+			var cluster string
+			if cluster, err = redisKeyCluster(ctx, client, key); err != nil {
+				break
+			}
+			if scope.contains(strings.TrimPrefix(key, prefix), cluster) {
+				if err = client.Del(ctx, key).Err(); err != nil {
+					break
+				}
+			}
+		}
+	}
+	if err != nil {
+		log.Println("rediscache.go: syncChangeToRedis() error: ", err, payload)
+	}
+}
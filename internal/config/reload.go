@@ -0,0 +1,131 @@
+package config
+
+import (
+	"log"
+	"os"
+	"os/signal"
+	"reflect"
+	"syscall"
+	"time"
+)
+
+// 配置文件检查间隔。ConfigMap 挂载的文件通过替换符号链接更新,轮询修改时间比监听inode更可靠
+const configCheckInterval = 10 * time.Second
+
+var reloadHooks []func(old, new AppConfig)
+
+// OnReload 注册配置热加载成功后的回调,需在 init 阶段注册
+func OnReload(f func(old, new AppConfig)) {
+	reloadHooks = append(reloadHooks, f)
+}
+
+// watchConfig 监听配置文件变化和 SIGHUP 信号,触发配置热加载
+func watchConfig() {
+	sighup := make(chan os.Signal, 1)
+	signal.Notify(sighup, syscall.SIGHUP)
+	ticker := time.NewTicker(configCheckInterval)
+	defer ticker.Stop()
+
+	modTime := configModTime()
+	for {
+		select {
+		case <-sighup:
+			log.Println("收到SIGHUP信号,重新加载配置")
+		case <-ticker.C:
+			t := configModTime()
+			if t.Equal(modTime) {
+				continue
+			}
+			modTime = t
+			log.Println("配置文件已变更,重新加载配置")
+		}
+		if err := Reload(); err != nil {
+			log.Println("reload.go: watchConfig() error: ", "配置热加载失败,继续使用原配置:", err)
+		}
+	}
+}
+
+func configModTime() time.Time {
+	fi, err := os.Stat(configFile)
+	if err != nil {
+		return time.Time{}
+	}
+	return fi.ModTime()
+}
+
+// Reload 重新读取配置文件,校验通过后应用可以在运行时修改的配置,
+// 并返回需要重启才能生效的字段
+func Reload() error {
+	cfg, err := loadConfig(configFile)
+	if err != nil {
+		return err
+	}
+	if err := cfg.validate(); err != nil {
+		return err
+	}
+
+	old := GetConfig()
+	// isMaster 由pod名称决定,不从配置文件读取
+	cfg.IsMaster = old.IsMaster
+
+	if restart := restartFields(old, cfg); len(restart) > 0 {
+		log.Println("以下配置修改需要重启才能生效:", restart)
+		// 需要重启的字段保留原值,避免运行中的状态与配置不一致
+		cfg.DbConfig.Dsn = old.DbConfig.Dsn
+		cfg.CacheFile = old.CacheFile
+		cfg.RecordSource = old.RecordSource
+		cfg.TransferAddr = old.TransferAddr
+		cfg.MetricsAddr = old.MetricsAddr
+	}
+
+	if old.LogLevel != cfg.LogLevel {
+		level, _ := parseLogLevel(cfg.LogLevel)
+		setLogLevel(level)
+		log.Println("日志级别修改为:", cfg.LogLevel)
+	}
+	if old.DbConfig != cfg.DbConfig && Orm != nil {
+		if mysqlDb, err := Orm.DB(); err == nil {
+			setDbPool(mysqlDb, cfg.DbConfig)
+			log.Println("数据库连接池配置已更新")
+		}
+	}
+
+	configLock.Lock()
+	Config = cfg
+	configLock.Unlock()
+
+	if !reflect.DeepEqual(old.ZoneFiles, cfg.ZoneFiles) {
+		loadZoneFiles()
+	} else if !reflect.DeepEqual(old.Zones, cfg.Zones) {
+		updateZones(allZones)
+	}
+	if old.RedisConfig != cfg.RedisConfig {
+		reconnectRedis()
+		log.Println("redis连接已更新")
+	}
+	for _, f := range reloadHooks {
+		f(old, cfg)
+	}
+	log.Println("配置热加载成功")
+	return nil
+}
+
+// restartFields 返回修改后需要重启才能生效的字段
+func restartFields(old, new AppConfig) (fields []string) {
+	if old.DbConfig.Dsn != new.DbConfig.Dsn {
+		fields = append(fields, "dbConfig.dsn")
+	}
+	if old.CacheFile != new.CacheFile {
+		fields = append(fields, "cacheFile")
+	}
+	if !reflect.DeepEqual(old.RecordSource, new.RecordSource) {
+		fields = append(fields, "recordSource")
+	}
+	if old.TransferAddr != new.TransferAddr {
+		fields = append(fields, "transferAddr")
+	}
+	if old.MetricsAddr != new.MetricsAddr {
+		fields = append(fields, "metricsAddr")
+	}
+	return
+}
@@ -0,0 +1,34 @@
+package config
+
+import "dnsadminserver/internal/models"
+
+// SetForTest 使用cfg替换当前配置,使用list替换内存中的记录,并重新加载zone文件和计算zone,只用于测试。
+// 测试中不读取 appsetting.json,也不连接数据库和redis
+func SetForTest(cfg AppConfig, list []models.DnsRecords) {
+	configLock.Lock()
+	Config = cfg
+	configLock.Unlock()
+	cache := make(map[string][]models.DnsRR)
+	clusters := make(map[string]string)
+	buildDnsRecordsCache(cache, clusters, list, false)
+	cacheLock.Lock()
+	DnsRecordsCache = cache
+	keyClusters = clusters
+	cacheLock.Unlock()
+	zoneStateLock.Lock()
+	zoneStates = map[string]*zoneState{}
+	zoneStateLock.Unlock()
+	loadZoneFiles()
+}
+
+// SetRecordsForTest 使用list替换内存中的记录并重新计算全部zone,保留zone的serial和变更记录,只用于测试
+func SetRecordsForTest(list []models.DnsRecords) {
+	cache := make(map[string][]models.DnsRR)
+	clusters := make(map[string]string)
+	buildDnsRecordsCache(cache, clusters, list, false)
+	cacheLock.Lock()
+	DnsRecordsCache = cache
+	keyClusters = clusters
+	cacheLock.Unlock()
+	updateZones(allZones)
+}
@@ -0,0 +1,18 @@
+package config
+
+import "net"
+
+// ViewNets 返回记录的view对应的客户端网段:view是CIDR时返回该网段,
+// 否则返回views中该名称配置的网段,名称不存在时返回nil
+func ViewNets(view string) []*net.IPNet {
+	if _, n, err := net.ParseCIDR(view); err == nil {
+		return []*net.IPNet{n}
+	}
+	var nets []*net.IPNet
+	for _, cidr := range GetConfig().Views[view] {
+		if _, n, err := net.ParseCIDR(cidr); err == nil {
+			nets = append(nets, n)
+		}
+	}
+	return nets
+}
@@ -0,0 +1,19 @@
+package config
+
+import "github.com/miekg/dns"
+
+const (
+	WeightAll     = "all"     // 返回全部记录,保持原有顺序
+	WeightSingle  = "single"  // 按权重随机返回一条记录
+	WeightShuffle = "shuffle" // 返回全部记录,按权重随机排序
+)
+
+// WeightMode 返回集群中域名按权重选择记录的方式,未配置时为 all
+func WeightMode(cluster, name string) string {
+	for k, v := range GetConfig().Weights[cluster] {
+		if dns.CanonicalName(k) == dns.CanonicalName(name) {
+			return v
+		}
+	}
+	return WeightAll
+}
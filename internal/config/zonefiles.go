@@ -0,0 +1,150 @@
+package config
+
+import (
+	"dnsadminserver/internal/models"
+	"dnsadminserver/internal/source"
+	"fmt"
+	"log"
+	"os"
+	"sync"
+	"time"
+)
+
+// zone文件中的记录与记录来源中同一个 集群-类型-域名 的记录的合并方式
+const (
+	PrecedenceMerge    = "merge"    // 合并两边的记录(默认)
+	PrecedenceOverride = "override" // zone文件中有记录时只使用zone文件的记录
+	PrecedenceFallback = "fallback" // 记录来源中没有记录时才使用zone文件的记录
+)
+
+const zoneFileCheckInterval = 10 * time.Second
+
+// ZoneFileConfig 一个集群加载的zone文件
+type ZoneFileConfig struct {
+	Cluster    string `json:"cluster"`
+	File       string `json:"file"`
+	Origin     string `json:"origin"`     // 为空时使用文件中的$ORIGIN或文件名
+	Precedence string `json:"precedence"` // merge、override、fallback
+}
+
+func (c ZoneFileConfig) validate() error {
+	if c.Cluster == "" || c.File == "" {
+		return fmt.Errorf("zoneFiles 的 cluster 和 file 不能为空")
+	}
+	switch c.Precedence {
+	case "", PrecedenceMerge, PrecedenceOverride, PrecedenceFallback:
+		return nil
+	}
+	return fmt.Errorf("未知的zone文件优先级: %s", c.Precedence)
+}
+
+type zoneEntry struct {
+	cluster    string
+	records    []models.DnsRR
+	precedence string
+}
+
+// zoneFileKey 区分每个集群加载的zone文件
+type zoneFileKey struct {
+	cluster, file string
+}
+
+var (
+	zoneCache     = map[string]zoneEntry{}
+	zoneFileLists = map[zoneFileKey][]models.DnsRecords{} // 每个zone文件上次加载成功的记录
+	zoneCacheLock sync.RWMutex
+)
+
+// loadZoneFiles 加载配置的全部zone文件并替换zone缓存,解析失败的文件保留上次加载的记录
+func loadZoneFiles() {
+	files := GetConfig().ZoneFiles
+	zoneCacheLock.RLock()
+	old := zoneFileLists
+	zoneCacheLock.RUnlock()
+
+	cache := map[string]zoneEntry{}
+	lists := map[zoneFileKey][]models.DnsRecords{}
+	for _, zf := range files {
+		precedence := zf.Precedence
+		if precedence == "" {
+			precedence = PrecedenceMerge
+		}
+		fk := zoneFileKey{cluster: zf.Cluster, file: zf.File}
+		list, err := source.ParseZoneFile(zf.File, zf.Cluster, zf.Origin)
+		if err != nil {
+			log.Println("zonefiles.go: loadZoneFiles() error: ", "解析zone文件失败,保留上次加载的记录", zf.File, err)
+			list = old[fk]
+		}
+		lists[fk] = list
+		for _, v := range list {
+			key := recordKey(v)
+			e := cache[key]
+			e.cluster = v.ClusterName
+			e.precedence = precedence
+			if dr := buildDR(v); dr.Id > 0 {
+				e.records = append(e.records, dr)
+			}
+			cache[key] = e
+		}
+	}
+
+	zoneCacheLock.Lock()
+	zoneCache = cache
+	zoneFileLists = lists
+	zoneCacheLock.Unlock()
+	updateZones(allZones)
+	log.Println("zonefiles.go: loadZoneFiles() success: ", len(files), len(cache))
+}
+
+// zoneRecords 按优先级合并zone文件和记录来源中key对应的记录
+func zoneRecords(key string, records []models.DnsRR) []models.DnsRR {
+	zoneCacheLock.RLock()
+	e, ok := zoneCache[key]
+	zoneCacheLock.RUnlock()
+	if !ok || len(e.records) == 0 {
+		return records
+	}
+	switch e.precedence {
+	case PrecedenceOverride:
+		return e.records
+	case PrecedenceFallback:
+		if len(records) > 0 {
+			return records
+		}
+		return e.records
+	default:
+		if len(records) == 0 {
+			return e.records
+		}
+		merged := make([]models.DnsRR, 0, len(records)+len(e.records))
+		merged = append(merged, records...)
+		return append(merged, e.records...)
+	}
+}
+
+// watchZoneFiles 定时检查zone文件的修改时间,有变化时重新加载
+func watchZoneFiles() {
+	ticker := time.NewTicker(zoneFileCheckInterval)
+	defer ticker.Stop()
+	last := zoneFilesSnapshot()
+	for range ticker.C {
+		cur := zoneFilesSnapshot()
+		if cur != last {
+			log.Println("zone文件已变更,重新加载")
+			loadZoneFiles()
+			last = cur
+		}
+	}
+}
+
+func zoneFilesSnapshot() string {
+	sig := ""
+	for _, zf := range GetConfig().ZoneFiles {
+		if fi, err := os.Stat(zf.File); err == nil {
+			sig += fmt.Sprintf("%s:%d:%d;", zf.File, fi.Size(), fi.ModTime().UnixNano())
+		} else {
+			sig += zf.File + ":-;"
+		}
+	}
+	return sig
+}
@@ -0,0 +1,530 @@
+package config
+
+import (
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"fmt"
+	"log"
+	"net"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/miekg/dns"
+	"github.com/redis/go-redis/v9"
+)
+
+// 每个zone保留的变更记录数量,IXFR请求的serial早于最早的变更时返回完整的zone
+const zoneJournalSize = 200
+
+// ZoneConfig 集群中由本服务负责的zone
+type ZoneConfig struct {
+	Cluster      string   `json:"cluster"`
+	Name         string   `json:"name"`
+	Transfer     bool     `json:"transfer"`     // 是否允许AXFR/IXFR
+	TransferFrom []string `json:"transferFrom"` // 允许通过TCP监听进行区域传送的网段,为空时不限制
+
+	// zone顶点的SOA和NS,由服务生成。未配置的SOA字段使用记录中的SOA或默认值,
+	// 配置了Ns时忽略记录中顶点的NS记录
+	Ns      []string `json:"ns"`
+	Mbox    string   `json:"mbox"`
+	Ttl     uint32   `json:"ttl"`
+	Refresh uint32   `json:"refresh"`
+	Retry   uint32   `json:"retry"`
+	Expire  uint32   `json:"expire"`
+	Minttl  uint32   `json:"minttl"`
+
+	Notify []string `json:"notify"` // zone变化后发送NOTIFY的地址,host:port
+
+	AllowUpdate bool `json:"allowUpdate"` // 是否接受TSIG签名的动态更新(RFC 2136)
+
+	// 在线签名使用的密钥,BIND格式密钥文件的路径(不含.key/.private后缀),
+	// 配置后对设置了DO位的查询返回签名的应答
+	DnssecKeys []string `json:"dnssecKeys"`
+	Denial     string   `json:"denial"` // 否定应答的证明方式: blacklies(默认)、nsec、nsec3
+}
+
+const (
+	DenialBlackLies = "blacklies"
+	DenialNsec      = "nsec"
+	DenialNsec3     = "nsec3"
+)
+
+func (c ZoneConfig) validate() error {
+	if c.Cluster == "" || c.Name == "" {
+		return fmt.Errorf("zones 的 cluster 和 name 不能为空")
+	}
+	if _, ok := dns.IsDomainName(c.Name); !ok {
+		return fmt.Errorf("zone名称不正确: %s", c.Name)
+	}
+	for _, ns := range c.Ns {
+		if _, ok := dns.IsDomainName(ns); !ok {
+			return fmt.Errorf("zones.ns 不正确: %s", ns)
+		}
+	}
+	for _, cidr := range c.TransferFrom {
+		if _, _, err := net.ParseCIDR(cidr); err != nil {
+			return fmt.Errorf("zones.transferFrom 网段不正确: %s", cidr)
+		}
+	}
+	switch c.Denial {
+	case "", DenialBlackLies, DenialNsec, DenialNsec3:
+	default:
+		return fmt.Errorf("zones.denial 不正确: %s", c.Denial)
+	}
+	for _, addr := range c.Notify {
+		if _, _, err := net.SplitHostPort(addr); err != nil {
+			return fmt.Errorf("zones.notify 地址不正确: %s", addr)
+		}
+	}
+	return nil
+}
+
+// AllowTransferFrom 判断ip是否在允许区域传送的网段中
+func (c ZoneConfig) AllowTransferFrom(ip net.IP) bool {
+	if len(c.TransferFrom) == 0 {
+		return true
+	}
+	for _, cidr := range c.TransferFrom {
+		if _, n, err := net.ParseCIDR(cidr); err == nil && n.Contains(ip) {
+			return true
+		}
+	}
+	return false
+}
+
+// ZoneDelta 一次变更中zone删除和新增的记录
+type ZoneDelta struct {
+	OldSerial uint32
+	NewSerial uint32
+	Removed   []dns.RR
+	Added     []dns.RR
+}
+
+type zoneState struct {
+	serial  uint32
+	hash    string            // zone内容的hash,决定serial
+	soa     *dns.SOA          // zone顶点的SOA,serial为0
+	records map[string]dns.RR // 记录文本 -> 记录,不含顶点SOA
+	names   map[string]bool   // zone中存在的名称,包括空的非终端名称
+	journal []ZoneDelta
+}
+
+var (
+	zoneStates    = map[string]*zoneState{}
+	zoneStateLock sync.Mutex
+)
+
+// ZoneChange zone的一次变更,SOA中为变更后的serial
+type ZoneChange struct {
+	Zone  ZoneConfig
+	SOA   *dns.SOA
+	Delta ZoneDelta
+}
+
+var zoneChangeHooks []func(ZoneChange)
+
+// OnZoneChange 注册zone的serial变化后的回调,需在 init 阶段注册。回调在变更协程中同步执行,不能阻塞
+func OnZoneChange(f func(ZoneChange)) {
+	zoneChangeHooks = append(zoneChangeHooks, f)
+}
+
+func zoneStateKey(cluster, zone string) string {
+	return cluster + "/" + dns.CanonicalName(zone)
+}
+
+// FindZone 返回集群中包含name的最长的zone
+func FindZone(cluster, name string) (zone ZoneConfig, ok bool) {
+	for _, z := range GetConfig().Zones {
+		if z.Cluster == cluster && dns.IsSubDomain(dns.Fqdn(z.Name), name) &&
+			(!ok || dns.CountLabel(z.Name) > dns.CountLabel(zone.Name)) {
+			zone, ok = z, true
+		}
+	}
+	zone.Name = dns.CanonicalName(zone.Name)
+	return
+}
+
+// zoneTarget 缓存中发生变化的名称,只需要重新计算包含它的zone。
+// cluster为空表示全部集群,name为空表示集群中的全部zone
+type zoneTarget struct {
+	cluster, name string
+}
+
+// allZones 重新计算全部zone
+var allZones = zoneTarget{}
+
+// covers 判断zone是否包含变化的名称
+func (t zoneTarget) covers(z ZoneConfig) bool {
+	if t.cluster == "" {
+		return true
+	}
+	return z.Cluster == t.cluster && (t.name == "" || dns.IsSubDomain(dns.Fqdn(z.Name), t.name))
+}
+
+// keyName 返回属于cluster的缓存key(集群-类型-域名)中的域名
+func keyName(key, cluster string) string {
+	_, name, _ := strings.Cut(strings.TrimPrefix(key, cluster+"-"), "-")
+	return name
+}
+
+// clusterKeys 返回clusters中每个集群在记录来源和zone文件中的全部key
+func clusterKeys(clusters map[string]bool) map[string]map[string]bool {
+	keys := map[string]map[string]bool{}
+	add := func(cluster, key string) {
+		if !clusters[cluster] {
+			return
+		}
+		if keys[cluster] == nil {
+			keys[cluster] = map[string]bool{}
+		}
+		keys[cluster][key] = true
+	}
+	cacheLock.RLock()
+	for key, cluster := range keyClusters {
+		add(cluster, key)
+	}
+	cacheLock.RUnlock()
+	zoneCacheLock.RLock()
+	for key, e := range zoneCache {
+		add(e.cluster, key)
+	}
+	zoneCacheLock.RUnlock()
+	return keys
+}
+
+// clusterRecords 返回集群的keys中属于zone的全部记录,已按zone文件优先级合并
+func clusterRecords(cluster, zone string, keys map[string]bool) (records []dns.RR) {
+	for key := range keys {
+		if !dns.IsSubDomain(zone, keyName(key, cluster)) {
+			continue
+		}
+		for _, r := range GetDnsRecords(key) {
+			if r.DnsRR != nil && dns.IsSubDomain(zone, r.DnsRR.Header().Name) {
+				records = append(records, r.DnsRR)
+			}
+		}
+	}
+	return
+}
+
+// updateZones 在缓存变更后对比t涉及的zone的记录,有变化时增加serial并记录变更
+func updateZones(t zoneTarget) {
+	zones := GetConfig().Zones
+	var changes []ZoneChange
+	defer func() {
+		// 释放锁之后再执行回调,回调中可以读取zone
+		for _, c := range changes {
+			for _, f := range zoneChangeHooks {
+				f(c)
+			}
+		}
+	}()
+	clusters := map[string]bool{}
+	for _, z := range zones {
+		if t.covers(z) {
+			clusters[z.Cluster] = true
+		}
+	}
+	keys := clusterKeys(clusters)
+
+	zoneStateLock.Lock()
+	defer zoneStateLock.Unlock()
+	current := map[string]bool{}
+	for _, z := range zones {
+		name := dns.Fqdn(z.Name)
+		key := zoneStateKey(z.Cluster, name)
+		current[key] = true
+		if _, ok := zoneStates[key]; ok && !t.covers(z) {
+			continue
+		}
+
+		var recordSoa *dns.SOA
+		records := map[string]dns.RR{}
+		for _, rr := range clusterRecords(z.Cluster, name, keys[z.Cluster]) {
+			apex := dns.CanonicalName(rr.Header().Name) == dns.CanonicalName(name)
+			if s, ok := rr.(*dns.SOA); ok && apex {
+				recordSoa = s
+				continue
+			}
+			if rr.Header().Rrtype == dns.TypeNS && apex && len(z.Ns) > 0 {
+				continue
+			}
+			records[rr.String()] = rr
+		}
+		for _, rr := range apexNS(z, name) {
+			records[rr.String()] = rr
+		}
+		soa := apexSOA(z, name, recordSoa)
+		names := zoneNames(name, records)
+		hash := zoneHash(soa, recordSoa, records)
+
+		st, ok := zoneStates[key]
+		if ok && st.hash == hash {
+			continue
+		}
+		serial, shared := sharedSerial(key, hash)
+		switch {
+		case shared:
+		case recordSoa != nil && recordSoa.Serial != 0 && (!ok || recordSoa.Serial != st.serial):
+			// 没有redis时使用记录中SOA的serial,所有pod加载相同的记录时serial相同
+			serial = recordSoa.Serial
+		case ok:
+			serial = nextSerial(st.serial)
+		default:
+			// 使用当前时间作为初始serial,保证重启后serial仍然递增
+			serial = uint32(time.Now().Unix())
+		}
+		if !ok {
+			zoneStates[key] = &zoneState{serial: serial, hash: hash, soa: soa, records: records, names: names}
+			continue
+		}
+		delta := ZoneDelta{OldSerial: st.serial}
+		for k, rr := range st.records {
+			if _, ok := records[k]; !ok {
+				delta.Removed = append(delta.Removed, rr)
+			}
+		}
+		for k, rr := range records {
+			if _, ok := st.records[k]; !ok {
+				delta.Added = append(delta.Added, rr)
+			}
+		}
+		if serial == st.serial {
+			serial = nextSerial(st.serial)
+		}
+		delta.NewSerial = serial
+		st.serial = serial
+		st.hash = hash
+		st.soa = soa
+		st.records = records
+		st.names = names
+		st.journal = append(st.journal, delta)
+		if len(st.journal) > zoneJournalSize {
+			st.journal = st.journal[len(st.journal)-zoneJournalSize:]
+		}
+		z.Name = name
+		changes = append(changes, ZoneChange{Zone: z, SOA: st.soaRecord(), Delta: delta})
+		log.Println("zones.go: updateZones() ", z.Cluster, name, "serial:", st.serial, "删除:", len(delta.Removed), "新增:", len(delta.Added))
+	}
+	for key := range zoneStates {
+		if !current[key] {
+			delete(zoneStates, key)
+		}
+	}
+}
+
+// zoneHash 返回zone内容的hash,包括顶点的SOA和记录中SOA的serial
+func zoneHash(soa, recordSoa *dns.SOA, records map[string]dns.RR) string {
+	keys := make([]string, 0, len(records))
+	for k := range records {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+	h := sha256.New()
+	fmt.Fprintln(h, soa.String())
+	if recordSoa != nil {
+		fmt.Fprintln(h, recordSoa.Serial)
+	}
+	for _, k := range keys {
+		fmt.Fprintln(h, k)
+	}
+	return hex.EncodeToString(h.Sum(nil))
+}
+
+// zoneSerialScript 在哈希中按zone保存 "serial:内容hash"。内容与保存的相同时返回保存的serial,
+// 不同时按RFC 1982递增serial:尽量使用当前时间(ARGV[3]),否则加1
+var zoneSerialScript = redis.NewScript(`
+local cur = redis.call('HGET', KEYS[1], ARGV[1])
+local now = tonumber(ARGV[3])
+local serial = now
+if cur then
+	local s, hash = string.match(cur, '^(%d+):(.*)$')
+	if hash == ARGV[2] then
+		return tonumber(s)
+	end
+	s = tonumber(s)
+	local d = (now - s) % 4294967296
+	if d == 0 or d >= 2147483648 then
+		serial = (s + 1) % 4294967296
+	end
+end
+redis.call('HSET', KEYS[1], ARGV[1], serial .. ':' .. ARGV[2])
+return serial
+`)
+
+const zoneSerialTimeout = 2 * time.Second
+
+// sharedSerial 返回所有pod共用的、内容为hash时zone的serial。最先处理变更的pod递增serial,
+// 其他pod和重启后内容相同的pod沿用该serial。未配置redis或redis不可用时返回false
+func sharedSerial(key, hash string) (uint32, bool) {
+	client, _ := redisClient()
+	if client == nil {
+		return 0, false
+	}
+	ctx, cancel := context.WithTimeout(context.Background(), zoneSerialTimeout)
+	defer cancel()
+	serialKey := GetConfig().RedisConfig.serialKey()
+	serial, err := zoneSerialScript.Run(ctx, client, []string{serialKey}, key, hash, time.Now().Unix()).Int64()
+	if err != nil {
+		log.Println("zones.go: sharedSerial() error: ", "读取redis中的serial失败,使用本pod的serial", key, err)
+		return 0, false
+	}
+	return uint32(serial), true
+}
+
+// nextSerial 返回下一个serial,尽量使用当前时间,保证重启后serial仍然递增
+func nextSerial(serial uint32) uint32 {
+	now := uint32(time.Now().Unix())
+	if int32(now-serial) > 0 {
+		return now
+	}
+	return serial + 1
+}
+
+// apexSOA 生成zone顶点的SOA,配置优先,其次是记录中的SOA,最后使用默认值
+func apexSOA(z ZoneConfig, zone string, recordSoa *dns.SOA) *dns.SOA {
+	soa := &dns.SOA{
+		Hdr:     dns.RR_Header{Name: zone, Rrtype: dns.TypeSOA, Class: dns.ClassINET, Ttl: 3600},
+		Ns:      zone,
+		Mbox:    "hostmaster." + zone,
+		Refresh: 3600,
+		Retry:   600,
+		Expire:  604800,
+		Minttl:  300,
+	}
+	if recordSoa != nil {
+		soa = dns.Copy(recordSoa).(*dns.SOA)
+		soa.Hdr.Name = zone
+	}
+	if len(z.Ns) > 0 {
+		soa.Ns = dns.Fqdn(z.Ns[0])
+	}
+	if z.Mbox != "" {
+		soa.Mbox = dns.Fqdn(strings.Replace(z.Mbox, "@", ".", 1))
+	}
+	setIfNotZero := func(dst *uint32, v uint32) {
+		if v != 0 {
+			*dst = v
+		}
+	}
+	setIfNotZero(&soa.Hdr.Ttl, z.Ttl)
+	setIfNotZero(&soa.Refresh, z.Refresh)
+	setIfNotZero(&soa.Retry, z.Retry)
+	setIfNotZero(&soa.Expire, z.Expire)
+	setIfNotZero(&soa.Minttl, z.Minttl)
+	soa.Serial = 0
+	return soa
+}
+
+// apexNS 根据配置生成zone顶点的NS记录
+func apexNS(z ZoneConfig, zone string) (rrs []dns.RR) {
+	ttl := z.Ttl
+	if ttl == 0 {
+		ttl = 3600
+	}
+	for _, ns := range z.Ns {
+		rrs = append(rrs, &dns.NS{
+			Hdr: dns.RR_Header{Name: zone, Rrtype: dns.TypeNS, Class: dns.ClassINET, Ttl: ttl},
+			Ns:  dns.Fqdn(ns),
+		})
+	}
+	return
+}
+
+// zoneNames 返回zone中存在的全部名称,包括记录名称与zone顶点之间的空非终端名称
+func zoneNames(zone string, records map[string]dns.RR) map[string]bool {
+	names := map[string]bool{dns.CanonicalName(zone): true}
+	apexLabels := dns.CountLabel(zone)
+	for _, rr := range records {
+		name := dns.CanonicalName(rr.Header().Name)
+		for !names[name] && dns.CountLabel(name) > apexLabels {
+			names[name] = true
+			i, _ := dns.NextLabel(name, 0)
+			name = name[i:]
+		}
+	}
+	return names
+}
+
+// ZoneSOA 返回zone的SOA记录,serial为zone当前的serial
+func ZoneSOA(cluster, zone string) (*dns.SOA, bool) {
+	zoneStateLock.Lock()
+	defer zoneStateLock.Unlock()
+	st, ok := zoneStates[zoneStateKey(cluster, zone)]
+	if !ok {
+		return nil, false
+	}
+	return st.soaRecord(), true
+}
+
+func (st *zoneState) soaRecord() *dns.SOA {
+	soa := dns.Copy(st.soa).(*dns.SOA)
+	soa.Serial = st.serial
+	return soa
+}
+
+// ZoneNameExists 判断name是否存在于zone中,用于区分NXDOMAIN和NODATA
+func ZoneNameExists(cluster, zone, name string) bool {
+	zoneStateLock.Lock()
+	defer zoneStateLock.Unlock()
+	st, ok := zoneStates[zoneStateKey(cluster, zone)]
+	return ok && st.names[dns.CanonicalName(name)]
+}
+
+// ZoneApex 返回zone顶点由服务生成的记录(SOA或配置的NS),qtype不是这两种类型时返回false
+func ZoneApex(cluster string, zone ZoneConfig, qtype uint16) ([]dns.RR, bool) {
+	switch qtype {
+	case dns.TypeSOA:
+		soa, ok := ZoneSOA(cluster, zone.Name)
+		if !ok {
+			return nil, false
+		}
+		return []dns.RR{soa}, true
+	case dns.TypeNS:
+		if len(zone.Ns) == 0 {
+			return nil, false
+		}
+		return apexNS(zone, zone.Name), true
+	}
+	return nil, false
+}
+
+// ZoneRecords 返回zone的SOA和其余全部记录,记录按名称排序
+func ZoneRecords(cluster, zone string) (soa *dns.SOA, records []dns.RR, ok bool) {
+	zoneStateLock.Lock()
+	defer zoneStateLock.Unlock()
+	st, ok := zoneStates[zoneStateKey(cluster, zone)]
+	if !ok {
+		return nil, nil, false
+	}
+	for _, rr := range st.records {
+		records = append(records, rr)
+	}
+	sort.Slice(records, func(i, j int) bool {
+		ni, nj := dns.CanonicalName(records[i].Header().Name), dns.CanonicalName(records[j].Header().Name)
+		if ni != nj {
+			return strings.Compare(ni, nj) < 0
+		}
+		return records[i].String() < records[j].String()
+	})
+	return st.soaRecord(), records, true
+}
+
+// ZoneJournal 返回serial之后的全部变更,变更记录不完整时返回false
+func ZoneJournal(cluster, zone string, serial uint32) ([]ZoneDelta, bool) {
+	zoneStateLock.Lock()
+	defer zoneStateLock.Unlock()
+	st, ok := zoneStates[zoneStateKey(cluster, zone)]
+	if !ok {
+		return nil, false
+	}
+	for i, d := range st.journal {
+		if d.OldSerial == serial {
+			return append([]ZoneDelta(nil), st.journal[i:]...), true
+		}
+	}
+	return nil, false
+}
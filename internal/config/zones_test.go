@@ -0,0 +1,116 @@
+package config
+
+import (
+	"dnsadminserver/internal/models"
+	"fmt"
+	"testing"
+
+	"github.com/miekg/dns"
+)
+
+func zoneSerialOf(t *testing.T) uint32 {
+	t.Helper()
+	soa, ok := ZoneSOA("c1", "example.com.")
+	if !ok {
+		t.Fatal("zone example.com. not found")
+	}
+	return soa.Serial
+}
+
+func TestZoneSerial(t *testing.T) {
+	cfg := AppConfig{Zones: []ZoneConfig{{Cluster: "c1", Name: "example.com."}}}
+	soa := testRecord(1, "c1", "example.com.", dns.TypeSOA, "ns1.example.com. hostmaster.example.com. 2024010101 3600 600 604800 300")
+	www := testRecord(2, "c1", "www.example.com.", dns.TypeA, "10.0.0.1")
+	SetForTest(cfg, []models.DnsRecords{soa, www})
+
+	// 没有redis时使用记录中SOA的serial,重启后和其他pod上相同
+	if serial := zoneSerialOf(t); serial != 2024010101 {
+		t.Fatalf("got serial %d, want the serial of the SOA record", serial)
+	}
+	SetForTest(cfg, []models.DnsRecords{soa, www})
+	if serial := zoneSerialOf(t); serial != 2024010101 {
+		t.Errorf("got serial %d after a restart, want 2024010101", serial)
+	}
+
+	// 内容不变时serial不变
+	SetRecordsForTest([]models.DnsRecords{www, soa})
+	if serial := zoneSerialOf(t); serial != 2024010101 {
+		t.Errorf("got serial %d without changes, want 2024010101", serial)
+	}
+
+	// SOA的serial没有增加时递增本pod的serial
+	www.Rdata = "10.0.0.2"
+	SetRecordsForTest([]models.DnsRecords{soa, www})
+	if serial := zoneSerialOf(t); serial != 2024010102 {
+		t.Errorf("got serial %d, want 2024010102", serial)
+	}
+	soa.Rdata = "ns1.example.com. hostmaster.example.com. 2024010105 3600 600 604800 300"
+	www.Rdata = "10.0.0.3"
+	SetRecordsForTest([]models.DnsRecords{soa, www})
+	if serial := zoneSerialOf(t); serial != 2024010105 {
+		t.Errorf("got serial %d, want the new serial of the SOA record", serial)
+	}
+
+	deltas, ok := ZoneJournal("c1", "example.com.", 2024010101)
+	if !ok || len(deltas) != 2 {
+		t.Fatalf("got %d journal entries, want 2", len(deltas))
+	}
+	if d := deltas[1]; d.OldSerial != 2024010102 || d.NewSerial != 2024010105 || len(d.Removed) != 1 || len(d.Added) != 1 {
+		t.Errorf("got delta %d -> %d, -%d +%d", d.OldSerial, d.NewSerial, len(d.Removed), len(d.Added))
+	}
+}
+
+func TestUpdateZonesTarget(t *testing.T) {
+	cfg := AppConfig{Zones: []ZoneConfig{
+		{Cluster: "c1", Name: "example.com."},
+		{Cluster: "c1", Name: "sub.example.com."},
+		{Cluster: "c1", Name: "other.com."},
+		{Cluster: "c2", Name: "example.com."},
+	}}
+	list := []models.DnsRecords{
+		testRecord(1, "c1", "www.example.com.", dns.TypeA, "10.0.0.1"),
+		testRecord(2, "c1", "www.sub.example.com.", dns.TypeA, "10.0.0.2"),
+		testRecord(3, "c1", "www.other.com.", dns.TypeA, "10.0.0.3"),
+		testRecord(4, "c2", "www.example.com.", dns.TypeA, "10.0.1.1"),
+	}
+	SetForTest(cfg, list)
+	serials := func() map[string]uint32 {
+		m := map[string]uint32{}
+		for _, z := range cfg.Zones {
+			soa, _ := ZoneSOA(z.Cluster, z.Name)
+			m[z.Cluster+"/"+z.Name] = soa.Serial
+		}
+		return m
+	}
+	before := serials()
+
+	// 修改全部记录,只重新计算包含 www.sub.example.com. 的zone
+	changed := make([]models.DnsRecords, len(list))
+	for i, r := range list {
+		r.Rdata = fmt.Sprintf("10.0.2.%d", i+1)
+		changed[i] = r
+	}
+	cache := make(map[string][]models.DnsRR)
+	clusters := make(map[string]string)
+	buildDnsRecordsCache(cache, clusters, changed, false)
+	cacheLock.Lock()
+	DnsRecordsCache, keyClusters = cache, clusters
+	cacheLock.Unlock()
+	updateZones(zoneTarget{cluster: "c1", name: "www.sub.example.com."})
+
+	after := serials()
+	for zone, want := range map[string]bool{
+		"c1/example.com.": true, "c1/sub.example.com.": true, "c1/other.com.": false, "c2/example.com.": false,
+	} {
+		if got := after[zone] != before[zone]; got != want {
+			t.Errorf("%s: serial changed %v, want %v", zone, got, want)
+		}
+	}
+
+	// 全部zone
+	updateZones(allZones)
+	now := serials()
+	if now["c1/other.com."] == after["c1/other.com."] || now["c2/example.com."] == after["c2/example.com."] {
+		t.Error("updating all zones did not pick up the other changes")
+	}
+}
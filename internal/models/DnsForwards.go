@@ -0,0 +1,16 @@
+package models
+
+// DnsForwards dns_forwards 表中集群的转发规则
+type DnsForwards struct {
+	Id            int64  `gorm:"column:id;primary_key"`
+	ClusterName   string `gorm:"column:cluster_name"`
+	Zone          string `gorm:"column:zone"`
+	Upstreams     string `gorm:"column:upstreams"` // 多个上游用逗号或空格分隔
+	Policy        string `gorm:"column:policy"`
+	TlsServerName string `gorm:"column:tls_server_name"`
+	ExceptList    string `gorm:"column:except_list"` // 多个名称用逗号或空格分隔
+}
+
+func (DnsForwards) TableName() string {
+	return "dns_forwards"
+}
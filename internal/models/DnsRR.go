@@ -3,6 +3,8 @@ package models
 import "github.com/miekg/dns"
 
 type DnsRR struct {
-	Id    int64  `json:"id"`
-	DnsRR dns.RR `json:"dns_rr"`
+	Id     int64  `json:"id"`
+	DnsRR  dns.RR `json:"dns_rr"`
+	View   string `json:"view"`
+	Weight uint32 `json:"weight"`
 }
@@ -12,6 +12,8 @@ type DnsRecords struct {
 	Qclass      uint16    `gorm:"column:qclass"`
 	Ttl         uint32    `gorm:"column:ttl"`
 	Rdata       string    `gorm:"column:rdata"`
+	View        string    `gorm:"column:view"`   // 记录适用的客户端网段(CIDR)或views中配置的名称,为空时适用于所有客户端
+	Weight      uint32    `gorm:"column:weight"` // 按权重选择记录时的权重
 	CreateUser  string    `gorm:"column:create_user"`
 	UpdateUser  string    `gorm:"column:update_user"`
 	CreateTime  time.Time `gorm:"column:create_time"`
@@ -30,6 +32,8 @@ type SampleDnsRecords struct {
 	Qclass      uint16 `gorm:"column:qclass"`
 	Ttl         uint32 `gorm:"column:ttl"`
 	Rdata       string `gorm:"column:rdata"`
+	View        string `gorm:"column:view"`
+	Weight      uint32 `gorm:"column:weight"`
 }
 
 func (SampleDnsRecords) TableName() string {
@@ -0,0 +1,294 @@
+package forward
+
+import (
+	"context"
+	"encoding/binary"
+	"net"
+	"strings"
+	"sync/atomic"
+	"time"
+
+	"github.com/coredns/coredns/plugin/pkg/cache"
+	"github.com/coredns/coredns/request"
+
+	"github.com/miekg/dns"
+)
+
+const (
+	defaultCacheMaxTTL = time.Hour
+	defaultCacheNegTTL = 30 * time.Minute
+	defaultPrefetchPct = 10
+	staleTTL           = 30 // TTL of stale answers, RFC 8767 section 4
+)
+
+// responseCache caches the replies of the upstreams. Positive replies are cached for the lowest TTL of
+// the answer and authority sections, negative replies (NXDOMAIN and NODATA) for the TTL of the SOA (RFC 2308).
+// The entries are sharded by the hash of the question, a full shard evicts a random entry.
+type responseCache struct {
+	c *cache.Cache
+
+	minTTL, maxTTL, negTTL time.Duration
+
+	prefetch    int           // hits before an entry is prefetched, 0 disables prefetching
+	prefetchPct int           // an entry is prefetched when less than prefetchPct percent of its TTL is left
+	serveStale  time.Duration // how long an expired entry can be served when the upstreams fail
+}
+
+// cacheEntry is a cached reply, the TTLs in msg are the TTLs at stored.
+type cacheEntry struct {
+	msg      *dns.Msg
+	stored   time.Time
+	ttl      time.Duration
+	negative bool
+	ecs      *dns.EDNS0_SUBNET // client subnet option of the reply, returned with the cached reply
+
+	hits        uint32 // atomic
+	prefetching uint32 // atomic
+}
+
+func newResponseCache(size int) *responseCache {
+	return &responseCache{c: cache.New(size), maxTTL: defaultCacheMaxTTL, negTTL: defaultCacheNegTTL, prefetchPct: defaultPrefetchPct}
+}
+
+// cacheKey hashes the question and the DO and CD bits, replies to DNSSEC aware requests differ.
+// Requests with a client subnet option (RFC 7871) are cached per source prefix, upstreams may tailor
+// the reply to the subnet.
+func cacheKey(state request.Request) uint64 {
+	b := make([]byte, 4, 5+len(state.Name())+20)
+	binary.BigEndian.PutUint16(b, state.QType())
+	binary.BigEndian.PutUint16(b[2:], state.QClass())
+	var flags byte
+	if state.Do() {
+		flags |= 1
+	}
+	if state.Req.CheckingDisabled {
+		flags |= 2
+	}
+	b = append(b, flags)
+	b = append(b, strings.ToLower(state.Name())...)
+	if ecs := subnetOption(state.Req); ecs != nil {
+		b = append(b, 0, byte(ecs.Family>>8), byte(ecs.Family), ecs.SourceNetmask)
+		b = append(b, maskedSubnet(ecs)...)
+	}
+	return cache.Hash(b)
+}
+
+// subnetOption returns the client subnet option of m, or nil.
+func subnetOption(m *dns.Msg) *dns.EDNS0_SUBNET {
+	o := m.IsEdns0()
+	if o == nil {
+		return nil
+	}
+	for _, e := range o.Option {
+		if ecs, ok := e.(*dns.EDNS0_SUBNET); ok {
+			return ecs
+		}
+	}
+	return nil
+}
+
+// maskedSubnet returns the address of ecs masked to its source prefix length.
+func maskedSubnet(ecs *dns.EDNS0_SUBNET) []byte {
+	bits := 32
+	ip := ecs.Address.To4()
+	if ecs.Family == 2 {
+		bits, ip = 128, ecs.Address.To16()
+	}
+	if ip == nil {
+		return nil
+	}
+	return ip.Mask(net.CIDRMask(int(ecs.SourceNetmask), bits))
+}
+
+// get returns the entry of key and whether it is still fresh. Expired entries are returned while
+// they can be served stale, entries past that are removed.
+func (rc *responseCache) get(key uint64, now time.Time) (e *cacheEntry, fresh bool) {
+	el, ok := rc.c.Get(key)
+	if !ok {
+		return nil, false
+	}
+	e = el.(*cacheEntry)
+	age := now.Sub(e.stored)
+	if age < e.ttl {
+		return e, true
+	}
+	if age < e.ttl+rc.serveStale {
+		return e, false
+	}
+	rc.c.Remove(key)
+	return nil, false
+}
+
+// set caches ret if it is cacheable: NOERROR or NXDOMAIN, not truncated and with a TTL above 0.
+// It returns whether ret was stored.
+func (rc *responseCache) set(key uint64, ret *dns.Msg, now time.Time) bool {
+	if ret.Truncated || (ret.Rcode != dns.RcodeSuccess && ret.Rcode != dns.RcodeNameError) {
+		return false
+	}
+	negative := ret.Rcode == dns.RcodeNameError || len(ret.Answer) == 0
+	ttl, ok := msgTTL(ret, negative)
+	if !ok {
+		return false
+	}
+	if ttl < rc.minTTL {
+		ttl = rc.minTTL
+	}
+	if negative && ttl > rc.negTTL {
+		ttl = rc.negTTL
+	}
+	if !negative && ttl > rc.maxTTL {
+		ttl = rc.maxTTL
+	}
+	if ttl <= 0 {
+		return false
+	}
+
+	m := ret.Copy()
+	// The OPT record is rebuilt for every request.
+	extra := m.Extra[:0]
+	for _, rr := range m.Extra {
+		if rr.Header().Rrtype != dns.TypeOPT {
+			extra = append(extra, rr)
+		}
+	}
+	m.Extra = extra
+	rc.c.Add(key, &cacheEntry{msg: m, stored: now, ttl: ttl, negative: negative, ecs: subnetOption(ret)})
+	return true
+}
+
+// msgTTL returns the lowest TTL of the answer and authority sections. Negative replies use the
+// minimum of the SOA TTL and its MINIMUM field and are not cacheable without SOA.
+func msgTTL(m *dns.Msg, negative bool) (time.Duration, bool) {
+	if negative {
+		for _, rr := range m.Ns {
+			if soa, ok := rr.(*dns.SOA); ok {
+				ttl := soa.Hdr.Ttl
+				if soa.Minttl < ttl {
+					ttl = soa.Minttl
+				}
+				return time.Duration(ttl) * time.Second, true
+			}
+		}
+		return 0, false
+	}
+	var ttl uint32
+	first := true
+	for _, section := range [][]dns.RR{m.Answer, m.Ns} {
+		for _, rr := range section {
+			if first || rr.Header().Ttl < ttl {
+				ttl = rr.Header().Ttl
+				first = false
+			}
+		}
+	}
+	return time.Duration(ttl) * time.Second, !first
+}
+
+// reply returns the entry as a reply to state with the TTLs decremented by its age, stale entries
+// use staleTTL.
+func (e *cacheEntry) reply(state request.Request, now time.Time) *dns.Msg {
+	m := e.msg.Copy()
+	m.Id = state.Req.Id
+	// Keep the case of the question of the request.
+	m.Question = state.Req.Question
+
+	age := uint32(now.Sub(e.stored) / time.Second)
+	for _, section := range [][]dns.RR{m.Answer, m.Ns, m.Extra} {
+		for _, rr := range section {
+			h := rr.Header()
+			switch {
+			case now.Sub(e.stored) >= e.ttl:
+				h.Ttl = staleTTL
+			case h.Ttl > age:
+				h.Ttl -= age
+			default:
+				h.Ttl = 0
+			}
+		}
+	}
+	if o := state.Req.IsEdns0(); o != nil {
+		opt := new(dns.OPT)
+		opt.Hdr.Name = "."
+		opt.Hdr.Rrtype = dns.TypeOPT
+		opt.SetUDPSize(o.UDPSize())
+		if o.Do() {
+			opt.SetDo()
+		}
+		if e.ecs != nil {
+			opt.Option = append(opt.Option, e.ecs)
+		}
+		m.Extra = append(m.Extra, opt)
+	}
+	return m
+}
+
+// shouldPrefetch counts a hit and returns true if the entry is popular and close to expiring and no
+// prefetch of it is running.
+func (rc *responseCache) shouldPrefetch(e *cacheEntry, now time.Time) bool {
+	if rc.prefetch <= 0 {
+		return false
+	}
+	if atomic.AddUint32(&e.hits, 1) < uint32(rc.prefetch) {
+		return false
+	}
+	left := e.ttl - now.Sub(e.stored)
+	if left*100 > e.ttl*time.Duration(rc.prefetchPct) {
+		return false
+	}
+	return atomic.CompareAndSwapUint32(&e.prefetching, 0, 1)
+}
+
+// cachedExchange answers from the cache and queries the upstreams on a miss. Popular entries are
+// refreshed in the background before they expire, expired entries are served when the upstreams fail.
+func (f *Forward) cachedExchange(ctx context.Context, state request.Request) (*dns.Msg, error) {
+	rc := f.cache
+	key := cacheKey(state)
+	now := time.Now()
+	e, fresh := rc.get(key, now)
+	if fresh {
+		cacheHits.WithLabelValues(entryType(e)).Inc()
+		if rc.shouldPrefetch(e, now) {
+			f.prefetches.Add(1)
+			go f.prefetch(key, request.Request{W: state.W, Req: state.Req.Copy()})
+		}
+		return e.reply(state, now), nil
+	}
+	cacheMisses.Inc()
+
+	ret, err := f.exchange(ctx, state)
+	if err == nil && ret.Rcode != dns.RcodeServerFailure {
+		if state.Match(ret) {
+			rc.set(key, ret, time.Now())
+		}
+		return ret, nil
+	}
+	if e != nil {
+		cacheServedStale.Inc()
+		return e.reply(state, time.Now()), nil
+	}
+	return ret, err
+}
+
+// prefetch refreshes the entry of key in the background, state holds a copy of the request.
+func (f *Forward) prefetch(key uint64, state request.Request) {
+	defer f.prefetches.Done()
+	cachePrefetches.Inc()
+	ctx, cancel := context.WithTimeout(context.Background(), f.timeout)
+	defer cancel()
+	ret, err := f.exchange(ctx, state)
+	if err == nil && state.Match(ret) && f.cache.set(key, ret, time.Now()) {
+		// The new entry replaced the prefetched one.
+		return
+	}
+	// Allow a new prefetch on the next hit, the reply failed or is not cacheable (SERVFAIL).
+	if el, ok := f.cache.c.Get(key); ok {
+		atomic.StoreUint32(&el.(*cacheEntry).prefetching, 0)
+	}
+}
+
+func entryType(e *cacheEntry) string {
+	if e.negative {
+		return "denial"
+	}
+	return "success"
+}
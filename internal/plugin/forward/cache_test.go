@@ -0,0 +1,75 @@
+package forward
+
+import (
+	"net"
+	"testing"
+	"time"
+
+	"github.com/coredns/coredns/plugin/test"
+	"github.com/coredns/coredns/request"
+
+	"github.com/miekg/dns"
+)
+
+// subnetQuery returns a query for example.org. with a client subnet option, prefix 0 means no option.
+func subnetQuery(addr string, prefix uint8) request.Request {
+	m := new(dns.Msg)
+	m.SetQuestion("example.org.", dns.TypeA)
+	if prefix > 0 {
+		m.SetEdns0(4096, false)
+		m.IsEdns0().Option = append(m.IsEdns0().Option, &dns.EDNS0_SUBNET{
+			Code: dns.EDNS0SUBNET, Family: 1, SourceNetmask: prefix, Address: net.ParseIP(addr),
+		})
+	}
+	return request.Request{W: &test.ResponseWriter{}, Req: m}
+}
+
+func TestCacheKeySubnet(t *testing.T) {
+	tests := []struct {
+		a, b request.Request
+		same bool
+	}{
+		{subnetQuery("", 0), subnetQuery("", 0), true},
+		{subnetQuery("10.0.0.1", 24), subnetQuery("10.0.0.200", 24), true},
+		{subnetQuery("10.0.0.1", 24), subnetQuery("10.0.1.1", 24), false},
+		{subnetQuery("10.0.0.1", 24), subnetQuery("10.0.0.1", 16), false},
+		{subnetQuery("10.0.0.1", 24), subnetQuery("", 0), false},
+	}
+	for i, tc := range tests {
+		if same := cacheKey(tc.a) == cacheKey(tc.b); same != tc.same {
+			t.Errorf("test %d: same key %v, want %v", i, same, tc.same)
+		}
+	}
+}
+
+func TestCacheSet(t *testing.T) {
+	rc := newResponseCache(16)
+	state := subnetQuery("10.0.0.1", 24)
+	now := time.Now()
+
+	servfail := new(dns.Msg)
+	servfail.SetRcode(state.Req, dns.RcodeServerFailure)
+	if rc.set(1, servfail, now) {
+		t.Error("SERVFAIL stored")
+	}
+
+	ret := answer(state.Req)
+	ret.SetEdns0(4096, false)
+	ret.IsEdns0().Option = append(ret.IsEdns0().Option, &dns.EDNS0_SUBNET{
+		Code: dns.EDNS0SUBNET, Family: 1, SourceNetmask: 24, SourceScope: 24, Address: net.ParseIP("10.0.0.0"),
+	})
+	if !rc.set(1, ret, now) {
+		t.Fatal("reply not stored")
+	}
+	e, fresh := rc.get(1, now.Add(time.Second))
+	if !fresh {
+		t.Fatal("entry not fresh")
+	}
+	reply := e.reply(state, now.Add(time.Second))
+	if ecs := subnetOption(reply); ecs == nil || ecs.SourceScope != 24 {
+		t.Errorf("cached reply lost the client subnet option: %v", reply.IsEdns0())
+	}
+	if ttl := reply.Answer[0].Header().Ttl; ttl != 59 {
+		t.Errorf("got TTL %d, want 59", ttl)
+	}
+}
@@ -0,0 +1,175 @@
+package forward
+
+import (
+	"errors"
+	"fmt"
+	"strconv"
+	"time"
+
+	"github.com/coredns/coredns/plugin"
+	"github.com/coredns/coredns/plugin/pkg/parse"
+	"github.com/miekg/dns"
+)
+
+// Config holds the settings for a Forward that is created from code instead of a Corefile.
+// The fields have the same meaning as the properties of the forward stanza.
+type Config struct {
+	From          string
+	To            []string
+	Except        []string
+	Types         []string            // only forward these query types, empty forwards all
+	AllowNets     []string            // only forward queries of clients in these CIDRs, empty allows all
+	DenyNets      []string            // don't forward queries of clients in these CIDRs
+	Metadata      map[string][]string // metadata label -> values, the label must have one of the values
+	Policy        string              // random (default), round_robin, sequential, fastest or weighted
+	Weights       []float64           // weights of the upstreams in the order of To for the weighted policy, missing ones use 1
+	MaxFails      uint32              // 0 disables in-band healthchecking
+	HealthCheck   time.Duration       // 0 uses the default interval
+	HCDomain      string              // domain used for healthchecks, defaults to "."
+	HCNoRec       bool                // don't set the RD bit in healthchecks
+	ForceTCP      bool
+	PreferUDP     bool
+	Expire        time.Duration // 0 uses the default expire
+	MaxConcurrent int64
+	TLSServerName string
+	Timeout       time.Duration // overall time for a request over all attempts, 0 uses 5s
+	ReadTimeout   time.Duration // time a single attempt waits for the reply, 0 uses 2s
+	HedgeDelay    time.Duration // send the next upstream a query when no reply arrived after this, 0 disables hedging
+
+	CacheSize          int           // maximum number of cached replies, 0 disables the cache
+	CacheMinTTL        time.Duration // replies are cached at least this long
+	CacheMaxTTL        time.Duration // 0 uses 1h
+	CacheNegativeTTL   time.Duration // maximum TTL of NXDOMAIN and NODATA replies, 0 uses 30m
+	Prefetch           int           // hits before an entry is refreshed ahead of expiry, 0 disables prefetching
+	PrefetchPercentage int           // refresh when less than this percentage of the TTL is left, 0 uses 10
+	ServeStale         time.Duration // how long expired replies are served when all upstreams fail, 0 disables
+}
+
+// NewWithConfig returns a Forward configured from c. The proxies are not started, call OnStartup
+// to start healthchecking and OnShutdown to stop it.
+func NewWithConfig(c Config) (*Forward, error) {
+	f := New()
+	zones := plugin.Host(c.From).NormalizeExact()
+	if len(zones) == 0 {
+		return nil, fmt.Errorf("unable to normalize '%s'", c.From)
+	}
+	f.from = zones[0]
+	for _, e := range c.Except {
+		f.ignored = append(f.ignored, plugin.Host(e).NormalizeExact()...)
+	}
+
+	if len(c.Types) > 0 {
+		if err := f.addTypes(c.Types); err != nil {
+			return nil, err
+		}
+	}
+	var err error
+	if f.allowNets, err = parseNets(c.AllowNets); err != nil {
+		return nil, err
+	}
+	if f.denyNets, err = parseNets(c.DenyNets); err != nil {
+		return nil, err
+	}
+	for label, values := range c.Metadata {
+		if len(values) == 0 {
+			return nil, fmt.Errorf("no values for metadata label '%s'", label)
+		}
+	}
+	if len(c.Metadata) > 0 {
+		f.meta = c.Metadata
+	}
+
+	if len(c.To) == 0 {
+		return nil, errors.New("no upstream configured")
+	}
+	toHosts, err := parseUpstreams(c.To)
+	if err != nil {
+		return nil, err
+	}
+	if len(toHosts) > max {
+		return nil, fmt.Errorf("more than %d TOs configured: %d", max, len(toHosts))
+	}
+	transports := make([]string, len(toHosts))
+	allowedTrans := map[string]bool{"dns": true, "tls": true, "https": true, "quic": true}
+	for i, host := range toHosts {
+		trans, h := parse.Transport(host)
+		if !allowedTrans[trans] {
+			return nil, fmt.Errorf("'%s' is not supported as a destination protocol in forward: %s", trans, host)
+		}
+		f.proxies = append(f.proxies, newUpstream(trans, h))
+		transports[i] = trans
+	}
+
+	switch c.Policy {
+	case "", "random":
+		f.p = &random{}
+	case "round_robin":
+		f.p = &roundRobin{}
+	case "sequential":
+		f.p = &sequential{}
+	case "fastest":
+		f.p = &fastest{}
+	case "weighted":
+		if len(c.Weights) > len(f.proxies) {
+			return nil, fmt.Errorf("more weights than TOs configured: %d", len(c.Weights))
+		}
+		for _, w := range c.Weights {
+			if w < 0 {
+				return nil, fmt.Errorf("weight can't be negative: %v", w)
+			}
+		}
+		f.p = &weighted{weights: c.Weights}
+	default:
+		return nil, fmt.Errorf("unknown policy '%s'", c.Policy)
+	}
+
+	f.maxfails = c.MaxFails
+	if c.HealthCheck > 0 {
+		f.hcInterval = c.HealthCheck
+	}
+	if c.HCDomain != "" {
+		if _, ok := dns.IsDomainName(c.HCDomain); !ok {
+			return nil, fmt.Errorf("health_check: invalid domain name %s", c.HCDomain)
+		}
+		f.opts.HCDomain = plugin.Name(c.HCDomain).Normalize()
+	}
+	f.opts.HCRecursionDesired = !c.HCNoRec
+	f.opts.ForceTCP = c.ForceTCP
+	f.opts.PreferUDP = c.PreferUDP
+	if c.Expire > 0 {
+		f.expire = c.Expire
+	}
+	if c.MaxConcurrent > 0 {
+		f.ErrLimitExceeded = errors.New("concurrent queries exceeded maximum " + strconv.FormatInt(c.MaxConcurrent, 10))
+		f.maxConcurrent = c.MaxConcurrent
+	}
+	f.tlsServerName = c.TLSServerName
+	if c.Timeout > 0 {
+		f.timeout = c.Timeout
+	}
+	f.readTimeout = c.ReadTimeout
+	f.hedgeDelay = c.HedgeDelay
+
+	if c.CacheSize > 0 {
+		rc := newResponseCache(c.CacheSize)
+		rc.minTTL = c.CacheMinTTL
+		if c.CacheMaxTTL > 0 {
+			rc.maxTTL = c.CacheMaxTTL
+		}
+		if c.CacheNegativeTTL > 0 {
+			rc.negTTL = c.CacheNegativeTTL
+		}
+		rc.prefetch = c.Prefetch
+		if c.PrefetchPercentage > 0 {
+			if c.PrefetchPercentage > 100 {
+				return nil, fmt.Errorf("prefetch percentage should fall in range [1, 100]: %d", c.PrefetchPercentage)
+			}
+			rc.prefetchPct = c.PrefetchPercentage
+		}
+		rc.serveStale = c.ServeStale
+		f.cache = rc
+	}
+
+	f.setupProxies(transports)
+	return f, nil
+}
@@ -4,6 +4,7 @@ import (
 	"context"
 	"net"
 	"strconv"
+	"strings"
 	"time"
 
 	"github.com/coredns/coredns/plugin/dnstap/msg"
@@ -14,8 +15,10 @@ import (
 	"github.com/miekg/dns"
 )
 
-// toDnstap will send the forward and received message to the dnstap plugin.
-func toDnstap(ctx context.Context, f *Forward, host string, state request.Request, opts proxy.Options, reply *dns.Msg, start time.Time) {
+// toDnstap will send the forward and received message to the dnstap plugin. The upstream and the attempt
+// (the number of queries sent for this request so far) are added to the Extra field, after the extra
+// format of the dnstap plugin.
+func toDnstap(ctx context.Context, f *Forward, host string, attempt int, state request.Request, opts proxy.Options, reply *dns.Msg, start time.Time) {
 	h, p, _ := net.SplitHostPort(host)      // this is preparsed and can't err here
 	port, _ := strconv.ParseUint(p, 10, 32) // same here
 	ip := net.ParseIP(h)
@@ -33,7 +36,18 @@ func toDnstap(ctx context.Context, f *Forward, host string, state request.Reques
 		ta = &net.TCPAddr{IP: ip, Port: int(port)}
 	}
 
-	for _, t := range f.tapPlugins {
+	extra := "upstream=" + host + " attempt=" + strconv.Itoa(attempt)
+
+	for _, tp := range f.tapPlugins {
+		t := *tp
+		format := t.ExtraFormat
+		t.ExtraFormat = strings.TrimSpace(format + " " + extra)
+		send := t.TapMessage
+		if format != "" {
+			// Let the dnstap plugin replace the placeholders of its format.
+			send = func(m *tap.Message) { t.TapMessageWithMetadata(ctx, m, state) }
+		}
+
 		// Query
 		q := new(tap.Message)
 		msg.SetQueryTime(q, start)
@@ -46,7 +60,7 @@ func toDnstap(ctx context.Context, f *Forward, host string, state request.Reques
 			q.QueryMessage = buf
 		}
 		msg.SetType(q, tap.Message_FORWARDER_QUERY)
-		t.TapMessageWithMetadata(ctx, q, state)
+		send(q)
 
 		// Response
 		if reply != nil {
@@ -60,7 +74,7 @@ func toDnstap(ctx context.Context, f *Forward, host string, state request.Reques
 			msg.SetResponseAddress(r, ta)
 			msg.SetResponseTime(r, time.Now())
 			msg.SetType(r, tap.Message_FORWARDER_RESPONSE)
-			t.TapMessageWithMetadata(ctx, r, state)
+			send(r)
 		}
 	}
 }
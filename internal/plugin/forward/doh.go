@@ -0,0 +1,116 @@
+package forward
+
+import (
+	"bytes"
+	"context"
+	"crypto/tls"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"net/url"
+	"time"
+
+	"github.com/coredns/coredns/plugin/pkg/proxy"
+	"github.com/coredns/coredns/request"
+
+	"github.com/miekg/dns"
+)
+
+const dohMimeType = "application/dns-message"
+
+// dohUpstream forwards queries with DNS-over-HTTPS (RFC 8484) POST requests. Connections are kept
+// alive by the http.Transport and reused (with HTTP/2 when the server supports it).
+type dohUpstream struct {
+	upstreamHealth
+	url    string
+	addr   string
+	client *http.Client
+}
+
+func newDoH(rawURL string) *dohUpstream {
+	d := &dohUpstream{url: rawURL}
+	if u, err := url.Parse(rawURL); err == nil {
+		d.addr = u.Host
+	}
+	d.upstreamHealth = newUpstreamHealth(d.exchange)
+	d.setTLSConfig(new(tls.Config))
+	return d
+}
+
+// Addr implements Upstream.
+func (d *dohUpstream) Addr() string { return d.addr }
+
+func (d *dohUpstream) setTLSConfig(cfg *tls.Config) {
+	d.client = &http.Client{
+		Transport: &http.Transport{
+			Proxy:               http.ProxyFromEnvironment,
+			TLSClientConfig:     cfg.Clone(),
+			ForceAttemptHTTP2:   true,
+			MaxIdleConnsPerHost: 16,
+			IdleConnTimeout:     defaultExpire,
+			TLSHandshakeTimeout: upstreamTimeout,
+			DialContext:         (&net.Dialer{Timeout: upstreamTimeout}).DialContext,
+		},
+	}
+}
+
+func (d *dohUpstream) setExpire(expire time.Duration) {
+	if t, ok := d.client.Transport.(*http.Transport); ok {
+		t.IdleConnTimeout = expire
+	}
+}
+
+// Connect implements Upstream.
+func (d *dohUpstream) Connect(ctx context.Context, state request.Request, opts proxy.Options) (*dns.Msg, error) {
+	ret, err := d.exchange(ctx, state.Req)
+	if err != nil {
+		return nil, err
+	}
+	ret.Id = state.Req.Id
+	return ret, nil
+}
+
+func (d *dohUpstream) exchange(ctx context.Context, m *dns.Msg) (*dns.Msg, error) {
+	// The ID should be 0 in DoH so responses are cache friendly.
+	q := m.Copy()
+	q.Id = 0
+	buf, err := q.Pack()
+	if err != nil {
+		return nil, err
+	}
+	ctx, cancel := context.WithTimeout(ctx, d.timeout)
+	defer cancel()
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, d.url, bytes.NewReader(buf))
+	if err != nil {
+		return nil, err
+	}
+	req.Header.Set("Content-Type", dohMimeType)
+	req.Header.Set("Accept", dohMimeType)
+	resp, err := d.client.Do(req)
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return nil, fmt.Errorf("doh upstream %s returned status %d", d.url, resp.StatusCode)
+	}
+	body, err := io.ReadAll(io.LimitReader(resp.Body, dns.MaxMsgSize))
+	if err != nil {
+		return nil, err
+	}
+	ret := new(dns.Msg)
+	if err := ret.Unpack(body); err != nil {
+		return nil, err
+	}
+	return ret, nil
+}
+
+// Start implements Upstream.
+func (d *dohUpstream) Start(hcInterval time.Duration) { d.probe.Start(hcInterval) }
+
+// Stop implements Upstream.
+func (d *dohUpstream) Stop() {
+	d.probe.Stop()
+	d.client.CloseIdleConnections()
+}
@@ -0,0 +1,130 @@
+package forward
+
+import (
+	"context"
+	"io"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/coredns/coredns/plugin/pkg/proxy"
+	"github.com/coredns/coredns/plugin/test"
+	"github.com/coredns/coredns/request"
+
+	"github.com/miekg/dns"
+)
+
+// answer returns a reply to m with an A record for the question.
+func answer(m *dns.Msg) *dns.Msg {
+	ret := new(dns.Msg)
+	ret.SetReply(m)
+	ret.Answer = append(ret.Answer, test.A(m.Question[0].Name+" 60 IN A 10.0.0.1"))
+	return ret
+}
+
+// waitFor polls cond until it is true or the timeout expires.
+func waitFor(t *testing.T, what string, cond func() bool) {
+	t.Helper()
+	deadline := time.Now().Add(5 * time.Second)
+	for !cond() {
+		if time.Now().After(deadline) {
+			t.Fatalf("timed out waiting for %s", what)
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+}
+
+// dohServer is a DoH server that counts the connections and fails the queries while failing is set.
+type dohServer struct {
+	*httptest.Server
+	conns   int32
+	failing atomic.Bool
+}
+
+func newDoHServer(t *testing.T) *dohServer {
+	s := &dohServer{}
+	s.Server = httptest.NewUnstartedServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if s.failing.Load() || r.Method != http.MethodPost || r.Header.Get("Content-Type") != dohMimeType {
+			http.Error(w, "unavailable", http.StatusServiceUnavailable)
+			return
+		}
+		body, _ := io.ReadAll(r.Body)
+		m := new(dns.Msg)
+		if err := m.Unpack(body); err != nil || m.Id != 0 {
+			http.Error(w, "bad query", http.StatusBadRequest)
+			return
+		}
+		buf, _ := answer(m).Pack()
+		w.Header().Set("Content-Type", dohMimeType)
+		w.Write(buf)
+	}))
+	s.Config.ConnState = func(c net.Conn, state http.ConnState) {
+		if state == http.StateNew {
+			atomic.AddInt32(&s.conns, 1)
+		}
+	}
+	s.EnableHTTP2 = true
+	s.StartTLS()
+	t.Cleanup(s.Close)
+	return s
+}
+
+// newTestDoH returns a DoH upstream that trusts the certificate of s.
+func newTestDoH(s *dohServer) *dohUpstream {
+	d := newDoH(s.URL + "/dns-query")
+	d.setTLSConfig(s.Client().Transport.(*http.Transport).TLSClientConfig)
+	return d
+}
+
+func TestDoHExchange(t *testing.T) {
+	s := newDoHServer(t)
+	d := newTestDoH(s)
+	defer d.Stop()
+
+	// The first query opens the connection, the concurrent queries after it share it.
+	m := new(dns.Msg)
+	m.SetQuestion("example.org.", dns.TypeA)
+	if _, err := d.exchange(context.Background(), m); err != nil {
+		t.Fatal(err)
+	}
+	var wg sync.WaitGroup
+	for i := 0; i < 10; i++ {
+		wg.Add(1)
+		go func(id uint16) {
+			defer wg.Done()
+			m := new(dns.Msg)
+			m.SetQuestion("example.org.", dns.TypeA)
+			m.Id = id
+			ret, err := d.Connect(context.Background(), request.Request{W: &test.ResponseWriter{}, Req: m}, proxy.Options{})
+			if err != nil {
+				t.Errorf("query %d: %v", id, err)
+				return
+			}
+			if ret.Id != id || len(ret.Answer) != 1 {
+				t.Errorf("query %d: got id %d and %d answers", id, ret.Id, len(ret.Answer))
+			}
+		}(uint16(i + 1))
+	}
+	wg.Wait()
+	if n := atomic.LoadInt32(&s.conns); n != 1 {
+		t.Errorf("got %d connections, want 1 reused connection", n)
+	}
+}
+
+func TestDoHHealthcheck(t *testing.T) {
+	s := newDoHServer(t)
+	d := newTestDoH(s)
+	d.Start(10 * time.Millisecond)
+	defer d.Stop()
+
+	s.failing.Store(true)
+	d.Healthcheck()
+	waitFor(t, "upstream down", func() bool { return d.Down(2) })
+
+	s.failing.Store(false)
+	waitFor(t, "upstream up", func() bool { return !d.Down(2) })
+}
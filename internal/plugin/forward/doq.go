@@ -0,0 +1,202 @@
+package forward
+
+import (
+	"context"
+	"crypto/tls"
+	"encoding/binary"
+	"errors"
+	"io"
+	"net"
+	"sync"
+	"time"
+
+	"github.com/coredns/coredns/plugin/pkg/proxy"
+	"github.com/coredns/coredns/request"
+
+	"github.com/miekg/dns"
+	"github.com/quic-go/quic-go"
+)
+
+// doqUpstream forwards queries with DNS-over-QUIC (RFC 9250). One QUIC connection is kept and reused,
+// each query is sent on its own stream; the connection is redialed when it fails.
+type doqUpstream struct {
+	upstreamHealth
+	addr      string
+	tlsConfig *tls.Config
+	expire    time.Duration
+
+	mu      sync.Mutex
+	conn    quic.Connection
+	dialing *doqDial // the running dial, concurrent queries wait for it instead of dialing themselves
+	stopped bool
+}
+
+// doqDial is a dial in progress, conn and err are set when done is closed.
+type doqDial struct {
+	done chan struct{}
+	conn quic.Connection
+	err  error
+}
+
+var errStopped = errors.New("upstream stopped")
+
+func newDoQ(addr string) *doqUpstream {
+	d := &doqUpstream{addr: addr, expire: defaultExpire}
+	d.upstreamHealth = newUpstreamHealth(d.exchange)
+	d.setTLSConfig(new(tls.Config))
+	return d
+}
+
+// Addr implements Upstream.
+func (d *doqUpstream) Addr() string { return d.addr }
+
+func (d *doqUpstream) setTLSConfig(cfg *tls.Config) {
+	c := cfg.Clone()
+	c.NextProtos = []string{"doq"}
+	if c.ServerName == "" {
+		c.ServerName, _, _ = net.SplitHostPort(d.addr)
+	}
+	d.mu.Lock()
+	d.tlsConfig = c
+	d.mu.Unlock()
+}
+
+func (d *doqUpstream) setExpire(expire time.Duration) {
+	d.mu.Lock()
+	d.expire = expire
+	d.mu.Unlock()
+}
+
+// Connect implements Upstream.
+func (d *doqUpstream) Connect(ctx context.Context, state request.Request, opts proxy.Options) (*dns.Msg, error) {
+	ret, err := d.exchange(ctx, state.Req)
+	if err != nil {
+		return nil, err
+	}
+	ret.Id = state.Req.Id
+	return ret, nil
+}
+
+func (d *doqUpstream) exchange(ctx context.Context, m *dns.Msg) (*dns.Msg, error) {
+	// The message ID must be 0 in DoQ.
+	q := m.Copy()
+	q.Id = 0
+	buf, err := q.Pack()
+	if err != nil {
+		return nil, err
+	}
+	ctx, cancel := context.WithTimeout(ctx, d.timeout)
+	defer cancel()
+
+	conn, err := d.connection(ctx, nil)
+	if err != nil {
+		return nil, err
+	}
+	stream, err := conn.OpenStreamSync(ctx)
+	if err != nil {
+		// The cached connection is gone (idle timeout, server restart), dial a new one.
+		if conn, err = d.connection(ctx, conn); err != nil {
+			return nil, err
+		}
+		if stream, err = conn.OpenStreamSync(ctx); err != nil {
+			return nil, err
+		}
+	}
+	if deadline, ok := ctx.Deadline(); ok {
+		stream.SetDeadline(deadline)
+	}
+
+	out := make([]byte, 2+len(buf))
+	binary.BigEndian.PutUint16(out, uint16(len(buf)))
+	copy(out[2:], buf)
+	if _, err := stream.Write(out); err != nil {
+		stream.CancelRead(0)
+		return nil, err
+	}
+	// Closing the send side tells the server that the query is complete.
+	stream.Close()
+
+	var l [2]byte
+	if _, err := io.ReadFull(stream, l[:]); err != nil {
+		return nil, err
+	}
+	resp := make([]byte, binary.BigEndian.Uint16(l[:]))
+	if _, err := io.ReadFull(stream, resp); err != nil {
+		return nil, err
+	}
+	ret := new(dns.Msg)
+	if err := ret.Unpack(resp); err != nil {
+		return nil, err
+	}
+	return ret, nil
+}
+
+// connection returns the cached QUIC connection, or dials a new one if there is none or the cached one is
+// failed. The dial runs without holding mu and is shared by the queries that need a connection meanwhile.
+func (d *doqUpstream) connection(ctx context.Context, failed quic.Connection) (quic.Connection, error) {
+	d.mu.Lock()
+	if d.conn != nil && d.conn == failed {
+		d.conn.CloseWithError(0, "")
+		d.conn = nil
+	}
+	if d.conn != nil {
+		select {
+		case <-d.conn.Context().Done():
+			d.conn = nil
+		default:
+			conn := d.conn
+			d.mu.Unlock()
+			return conn, nil
+		}
+	}
+	dial := d.dialing
+	if dial == nil {
+		dial = &doqDial{done: make(chan struct{})}
+		d.dialing = dial
+		go d.dial(dial, d.tlsConfig, d.expire)
+	}
+	d.mu.Unlock()
+
+	select {
+	case <-dial.done:
+		return dial.conn, dial.err
+	case <-ctx.Done():
+		return nil, ctx.Err()
+	}
+}
+
+// dial dials a new connection for the queries waiting on dial. It is not bound to the context of one of
+// them, a canceled query does not fail the others.
+func (d *doqUpstream) dial(dial *doqDial, tlsConfig *tls.Config, expire time.Duration) {
+	ctx, cancel := context.WithTimeout(context.Background(), d.timeout)
+	defer cancel()
+	conn, err := quic.DialAddr(ctx, d.addr, tlsConfig, &quic.Config{MaxIdleTimeout: expire, KeepAlivePeriod: 0})
+
+	d.mu.Lock()
+	d.dialing = nil
+	if err == nil && d.stopped {
+		conn.CloseWithError(0, "")
+		conn, err = nil, errStopped
+	}
+	if err == nil {
+		d.conn = conn
+	}
+	d.mu.Unlock()
+	dial.conn, dial.err = conn, err
+	close(dial.done)
+}
+
+// Start implements Upstream.
+func (d *doqUpstream) Start(hcInterval time.Duration) { d.probe.Start(hcInterval) }
+
+// Stop implements Upstream.
+func (d *doqUpstream) Stop() {
+	d.probe.Stop()
+	d.mu.Lock()
+	d.stopped = true
+	if d.conn != nil {
+		d.conn.CloseWithError(0, "")
+		d.conn = nil
+	}
+	d.mu.Unlock()
+}
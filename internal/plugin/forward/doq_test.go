@@ -0,0 +1,184 @@
+package forward
+
+import (
+	"context"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/tls"
+	"crypto/x509"
+	"encoding/binary"
+	"io"
+	"math/big"
+	"net"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/coredns/coredns/plugin/pkg/proxy"
+	"github.com/coredns/coredns/plugin/test"
+	"github.com/coredns/coredns/request"
+
+	"github.com/miekg/dns"
+	"github.com/quic-go/quic-go"
+)
+
+// testCertificate returns a self-signed certificate for 127.0.0.1 and a pool trusting it.
+func testCertificate(t *testing.T) (tls.Certificate, *x509.CertPool) {
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	tmpl := &x509.Certificate{
+		SerialNumber: big.NewInt(1),
+		IPAddresses:  []net.IP{net.IPv4(127, 0, 0, 1)},
+		NotBefore:    time.Now().Add(-time.Hour),
+		NotAfter:     time.Now().Add(time.Hour),
+		KeyUsage:     x509.KeyUsageDigitalSignature,
+		ExtKeyUsage:  []x509.ExtKeyUsage{x509.ExtKeyUsageServerAuth},
+	}
+	der, err := x509.CreateCertificate(rand.Reader, tmpl, tmpl, &key.PublicKey, key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	cert, err := x509.ParseCertificate(der)
+	if err != nil {
+		t.Fatal(err)
+	}
+	pool := x509.NewCertPool()
+	pool.AddCert(cert)
+	return tls.Certificate{Certificate: [][]byte{der}, PrivateKey: key}, pool
+}
+
+// doqServer is a DoQ server that counts the connections and closes the streams without a reply
+// while failing is set.
+type doqServer struct {
+	ln      *quic.Listener
+	pool    *x509.CertPool
+	conns   int32
+	failing atomic.Bool
+}
+
+func newDoQServer(t *testing.T) *doqServer {
+	cert, pool := testCertificate(t)
+	ln, err := quic.ListenAddr("127.0.0.1:0", &tls.Config{Certificates: []tls.Certificate{cert}, NextProtos: []string{"doq"}}, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	s := &doqServer{ln: ln, pool: pool}
+	t.Cleanup(func() { ln.Close() })
+	go func() {
+		for {
+			conn, err := ln.Accept(context.Background())
+			if err != nil {
+				return
+			}
+			atomic.AddInt32(&s.conns, 1)
+			go s.serve(conn)
+		}
+	}()
+	return s
+}
+
+func (s *doqServer) serve(conn quic.Connection) {
+	for {
+		stream, err := conn.AcceptStream(context.Background())
+		if err != nil {
+			return
+		}
+		go func() {
+			defer stream.Close()
+			var l [2]byte
+			if _, err := io.ReadFull(stream, l[:]); err != nil {
+				return
+			}
+			buf := make([]byte, binary.BigEndian.Uint16(l[:]))
+			if _, err := io.ReadFull(stream, buf); err != nil {
+				return
+			}
+			m := new(dns.Msg)
+			if s.failing.Load() || m.Unpack(buf) != nil || m.Id != 0 {
+				return
+			}
+			ret, _ := answer(m).Pack()
+			out := make([]byte, 2+len(ret))
+			binary.BigEndian.PutUint16(out, uint16(len(ret)))
+			copy(out[2:], ret)
+			stream.Write(out)
+		}()
+	}
+}
+
+// newTestDoQ returns a DoQ upstream that trusts the certificate of s.
+func newTestDoQ(s *doqServer) *doqUpstream {
+	d := newDoQ(s.ln.Addr().String())
+	d.setTLSConfig(&tls.Config{RootCAs: s.pool})
+	return d
+}
+
+func TestDoQExchange(t *testing.T) {
+	s := newDoQServer(t)
+	d := newTestDoQ(s)
+	defer d.Stop()
+
+	// The queries start without a connection, they share one dial.
+	var wg sync.WaitGroup
+	for i := 0; i < 10; i++ {
+		wg.Add(1)
+		go func(id uint16) {
+			defer wg.Done()
+			m := new(dns.Msg)
+			m.SetQuestion("example.org.", dns.TypeA)
+			m.Id = id
+			ret, err := d.Connect(context.Background(), request.Request{W: &test.ResponseWriter{}, Req: m}, proxy.Options{})
+			if err != nil {
+				t.Errorf("query %d: %v", id, err)
+				return
+			}
+			if ret.Id != id || len(ret.Answer) != 1 {
+				t.Errorf("query %d: got id %d and %d answers", id, ret.Id, len(ret.Answer))
+			}
+		}(uint16(i + 1))
+	}
+	wg.Wait()
+	if n := atomic.LoadInt32(&s.conns); n != 1 {
+		t.Errorf("got %d connections, want 1 reused connection", n)
+	}
+}
+
+func TestDoQRedial(t *testing.T) {
+	s := newDoQServer(t)
+	d := newTestDoQ(s)
+	defer d.Stop()
+
+	m := new(dns.Msg)
+	m.SetQuestion("example.org.", dns.TypeA)
+	if _, err := d.exchange(context.Background(), m); err != nil {
+		t.Fatal(err)
+	}
+	// A closed connection is replaced on the next query.
+	d.mu.Lock()
+	d.conn.CloseWithError(0, "")
+	d.mu.Unlock()
+	if _, err := d.exchange(context.Background(), m); err != nil {
+		t.Fatal(err)
+	}
+	if n := atomic.LoadInt32(&s.conns); n != 2 {
+		t.Errorf("got %d connections, want 2", n)
+	}
+}
+
+func TestDoQHealthcheck(t *testing.T) {
+	s := newDoQServer(t)
+	d := newTestDoQ(s)
+	d.Start(10 * time.Millisecond)
+	defer d.Stop()
+
+	s.failing.Store(true)
+	d.Healthcheck()
+	waitFor(t, "upstream down", func() bool { return d.Down(2) })
+
+	s.failing.Store(false)
+	waitFor(t, "upstream up", func() bool { return !d.Down(2) })
+}
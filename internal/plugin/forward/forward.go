@@ -8,6 +8,10 @@ import (
 	"context"
 	"crypto/tls"
 	"errors"
+	"fmt"
+	"net"
+	"strings"
+	"sync"
 	"sync/atomic"
 	"time"
 
@@ -17,6 +21,7 @@ import (
 	"github.com/coredns/coredns/plugin/metadata"
 	clog "github.com/coredns/coredns/plugin/pkg/log"
 	"github.com/coredns/coredns/plugin/pkg/proxy"
+	"github.com/coredns/coredns/plugin/pkg/rcode"
 	"github.com/coredns/coredns/request"
 
 	"github.com/miekg/dns"
@@ -36,18 +41,27 @@ const (
 type Forward struct {
 	concurrent int64 // atomic counters need to be first in struct for proper alignment
 
-	proxies    []*proxy.Proxy
+	proxies    []Upstream
 	p          Policy
 	hcInterval time.Duration
 
 	from    string
 	ignored []string
 
+	// Conditions on the request besides the name, see MatchRequest.
+	types     map[uint16]bool
+	allowNets []*net.IPNet
+	denyNets  []*net.IPNet
+	meta      map[string][]string
+
 	tlsConfig     *tls.Config
 	tlsServerName string
 	maxfails      uint32
 	expire        time.Duration
 	maxConcurrent int64
+	timeout       time.Duration // overall time for a request, over all attempts
+	readTimeout   time.Duration // time a single attempt waits for the reply, 0 keeps the default of the upstream
+	hedgeDelay    time.Duration // 0 disables hedging
 
 	opts proxy.Options // also here for testing
 
@@ -57,17 +71,20 @@ type Forward struct {
 
 	tapPlugins []*dnstap.Dnstap // when dnstap plugins are loaded, we use to this to send messages out.
 
+	cache      *responseCache // nil when caching is disabled
+	prefetches sync.WaitGroup // running prefetches, OnShutdown waits for them
+
 	Next plugin.Handler
 }
 
 // New returns a new Forward.
 func New() *Forward {
-	f := &Forward{maxfails: 2, tlsConfig: new(tls.Config), expire: defaultExpire, p: new(random), from: ".", hcInterval: hcInterval, opts: proxy.Options{ForceTCP: false, PreferUDP: false, HCRecursionDesired: true, HCDomain: "."}}
+	f := &Forward{maxfails: 2, tlsConfig: new(tls.Config), expire: defaultExpire, timeout: defaultTimeout, p: new(random), from: ".", hcInterval: hcInterval, opts: proxy.Options{ForceTCP: false, PreferUDP: false, HCRecursionDesired: true, HCDomain: "."}}
 	return f
 }
 
 // SetProxy appends p to the proxy list and starts healthchecking.
-func (f *Forward) SetProxy(p *proxy.Proxy) {
+func (f *Forward) SetProxy(p Upstream) {
 	f.proxies = append(f.proxies, p)
 	p.Start(f.hcInterval)
 }
@@ -89,27 +106,55 @@ func (f *Forward) Name() string { return "forward" }
 // ServeDNS implements plugin.Handler.
 func (f *Forward) ServeDNS(ctx context.Context, w dns.ResponseWriter, r *dns.Msg) (int, error) {
 	state := request.Request{W: w, Req: r}
-	if !f.match(state) {
+	if !f.MatchRequest(ctx, state) {
 		return plugin.NextOrFailure(f.Name(), f.Next, ctx, w, r)
 	}
 
+	ret, err := f.Exchange(ctx, state)
+	if err != nil {
+		if err == f.ErrLimitExceeded {
+			return dns.RcodeRefused, err
+		}
+		return dns.RcodeServerFailure, err
+	}
+	w.WriteMsg(ret)
+	return 0, nil
+}
+
+// Exchange sends the request in state to the upstreams and returns the reply. A reply that doesn't
+// match the request is replaced by a FormErr. When maxConcurrent is exceeded ErrLimitExceeded is returned.
+// With a cache configured the reply is served from the cache when possible.
+func (f *Forward) Exchange(ctx context.Context, state request.Request) (*dns.Msg, error) {
+	if f.cache != nil {
+		return f.cachedExchange(ctx, state)
+	}
+	return f.exchange(ctx, state)
+}
+
+func (f *Forward) exchange(ctx context.Context, state request.Request) (*dns.Msg, error) {
 	if f.maxConcurrent > 0 {
 		count := atomic.AddInt64(&(f.concurrent), 1)
 		defer atomic.AddInt64(&(f.concurrent), -1)
 		if count > f.maxConcurrent {
 			maxConcurrentRejectCount.Add(1)
-			return dns.RcodeRefused, f.ErrLimitExceeded
+			return nil, f.ErrLimitExceeded
 		}
 	}
 
+	list := f.List()
+	if len(list) > 0 {
+		policySelections.WithLabelValues(f.p.String(), list[0].Addr()).Inc()
+	}
+	if f.hedgeDelay > 0 {
+		return f.hedgedExchange(ctx, state, list)
+	}
+
 	fails := 0
-	var span, child ot.Span
 	var upstreamErr error
-	span = ot.SpanFromContext(ctx)
 	i := 0
-	list := f.List()
-	deadline := time.Now().Add(defaultTimeout)
+	deadline := time.Now().Add(f.timeout)
 	start := time.Now()
+	var attempt int32 // number of queries sent to upstreams, including retries
 	for time.Now().Before(deadline) {
 		if i >= len(list) {
 			// reached the end of list, reset to begin
@@ -132,52 +177,15 @@ func (f *Forward) ServeDNS(ctx context.Context, w dns.ResponseWriter, r *dns.Msg
 			healthcheckBrokenCount.Add(1)
 		}
 
-		if span != nil {
-			child = span.Tracer().StartSpan("connect", ot.ChildOf(span.Context()))
-			otext.PeerAddress.Set(child, proxy.Addr())
-			ctx = ot.ContextWithSpan(ctx, child)
-		}
-
-		metadata.SetValueFunc(ctx, "forward/upstream", func() string {
-			return proxy.Addr()
-		})
-
-		var (
-			ret *dns.Msg
-			err error
-		)
-		opts := f.opts
-
-		for {
-			ret, err = proxy.Connect(ctx, state, opts)
+		setUpstream(ctx, proxy)
+		ret, err := f.attempt(ctx, deadline, proxy, state, &attempt, start)
+		upstreamErr = err
 
-			if err == ErrCachedClosed { // Remote side closed conn, can only happen with TCP.
-				continue
-			}
-			// Retry with TCP if truncated and prefer_udp configured.
-			if ret != nil && ret.Truncated && !opts.ForceTCP && opts.PreferUDP {
-				opts.ForceTCP = true
-				continue
-			}
+		if errors.Is(err, context.DeadlineExceeded) || ctx.Err() != nil {
+			// Out of time, or the request was canceled.
 			break
 		}
-
-		if child != nil {
-			child.Finish()
-		}
-
-		if len(f.tapPlugins) != 0 {
-			toDnstap(ctx, f, proxy.Addr(), state, opts, ret, start)
-		}
-
-		upstreamErr = err
-
 		if err != nil {
-			// Kick off health check to see if *our* upstream is broken.
-			if f.maxfails != 0 {
-				proxy.Healthcheck()
-			}
-
 			if fails < len(f.proxies) {
 				continue
 			}
@@ -186,33 +194,220 @@ func (f *Forward) ServeDNS(ctx context.Context, w dns.ResponseWriter, r *dns.Msg
 
 		// Check if the reply is correct; if not return FormErr.
 		if !state.Match(ret) {
-			debug.Hexdumpf(ret, "Wrong reply for id: %d, %s %d", ret.Id, state.QName(), state.QType())
-
-			formerr := new(dns.Msg)
-			formerr.SetRcode(state.Req, dns.RcodeFormatError)
-			w.WriteMsg(formerr)
-			return 0, nil
+			return formErr(ret, state), nil
 		}
 
-		w.WriteMsg(ret)
-		return 0, nil
+		return ret, nil
 	}
 
 	if upstreamErr != nil {
-		return dns.RcodeServerFailure, upstreamErr
+		return nil, upstreamErr
 	}
 
-	return dns.RcodeServerFailure, ErrNoHealthy
+	return nil, ErrNoHealthy
 }
 
-func (f *Forward) match(state request.Request) bool {
-	if !plugin.Name(f.from).Matches(state.Name()) || !f.isAllowedDomain(state.Name()) {
-		return false
+// attempt connects to proxy and waits for the reply until deadline, the upstream itself only stops waiting
+// after its read timeout. An attempt that is still running at the deadline returns
+// context.DeadlineExceeded and finishes in the background, so it gets its own copy of the request.
+func (f *Forward) attempt(ctx context.Context, deadline time.Time, proxy Upstream, state request.Request, attempt *int32, start time.Time) (*dns.Msg, error) {
+	ctx, cancel := context.WithDeadline(ctx, deadline)
+	defer cancel()
+
+	type result struct {
+		ret *dns.Msg
+		err error
+	}
+	results := make(chan result, 1)
+	st := state
+	st.Req = state.Req.Copy()
+	go func() {
+		ret, err := f.connect(ctx, proxy, st, attempt, start)
+		results <- result{ret, err}
+	}()
+
+	select {
+	case r := <-results:
+		return r.ret, r.err
+	case <-ctx.Done():
+		return nil, ctx.Err()
+	}
+}
+
+// connect sends the request in state to proxy, retrying when a cached connection was closed and over TCP
+// when a UDP reply is truncated and prefer_udp is configured. attempt counts the queries sent for the
+// request, start is the time the request was received. On errors a health check of proxy is started,
+// unless ctx was canceled because another attempt already answered.
+func (f *Forward) connect(ctx context.Context, proxy Upstream, state request.Request, attempt *int32, start time.Time) (*dns.Msg, error) {
+	var child ot.Span
+	if span := ot.SpanFromContext(ctx); span != nil {
+		child = span.Tracer().StartSpan("connect", ot.ChildOf(span.Context()))
+		otext.PeerAddress.Set(child, proxy.Addr())
+		ctx = ot.ContextWithSpan(ctx, child)
+	}
+
+	var (
+		ret *dns.Msg
+		err error
+		n   int32
+	)
+	opts := f.opts
+
+	connectStart := time.Now()
+	for {
+		if n = atomic.AddInt32(attempt, 1); n > 1 {
+			upstreamRetries.WithLabelValues(proxy.Addr()).Inc()
+		}
+		upstreamRequests.WithLabelValues(proxy.Addr()).Inc()
+		queryStart := time.Now()
+		ret, err = proxy.Connect(ctx, state, opts)
+		if ret != nil {
+			upstreamResponses.WithLabelValues(proxy.Addr(), rcode.ToString(ret.Rcode)).Inc()
+			upstreamDuration.WithLabelValues(proxy.Addr()).Observe(time.Since(queryStart).Seconds())
+		}
+
+		if err == ErrCachedClosed { // Remote side closed conn, can only happen with TCP.
+			continue
+		}
+		// Retry with TCP if truncated and prefer_udp configured.
+		if ret != nil && ret.Truncated && !opts.ForceTCP && opts.PreferUDP {
+			opts.ForceTCP = true
+			tcpFallbacks.WithLabelValues(proxy.Addr()).Inc()
+			continue
+		}
+		break
 	}
 
+	if child != nil {
+		child.Finish()
+	}
+
+	if err != nil && errors.Is(ctx.Err(), context.Canceled) {
+		// Another attempt answered first, this upstream isn't at fault.
+		return nil, err
+	}
+
+	if o, ok := f.p.(observer); ok {
+		o.observe(proxy, time.Since(connectStart), err)
+	}
+
+	if len(f.tapPlugins) != 0 {
+		toDnstap(ctx, f, proxy.Addr(), int(n), state, opts, ret, start)
+	}
+
+	// Kick off health check to see if *our* upstream is broken.
+	if err != nil && f.maxfails != 0 {
+		proxy.Healthcheck()
+	}
+	return ret, err
+}
+
+// setUpstream records proxy as the forward/upstream metadata of the request. The metadata map of ctx is
+// not safe for concurrent use, so it is only called by the goroutine handling the request.
+func setUpstream(ctx context.Context, proxy Upstream) {
+	metadata.SetValueFunc(ctx, "forward/upstream", func() string {
+		return proxy.Addr()
+	})
+}
+
+// formErr returns the FormErr that replaces a reply that doesn't match the request.
+func formErr(ret *dns.Msg, state request.Request) *dns.Msg {
+	debug.Hexdumpf(ret, "Wrong reply for id: %d, %s %d", ret.Id, state.QName(), state.QType())
+
+	formerr := new(dns.Msg)
+	formerr.SetRcode(state.Req, dns.RcodeFormatError)
+	return formerr
+}
+
+// Match returns true if name is handled by this forwarder: it is below from and not in the except list.
+func (f *Forward) Match(name string) bool {
+	return plugin.Name(f.from).Matches(name) && f.isAllowedDomain(name)
+}
+
+// MatchRequest returns true if the request in state is handled by this forwarder: the name matches, and
+// if configured, the qtype is one of types, the client is not in deny_net and in allow_net, and the
+// metadata labels in ctx have one of the configured values.
+func (f *Forward) MatchRequest(ctx context.Context, state request.Request) bool {
+	if !f.Match(state.Name()) {
+		return false
+	}
+	if len(f.types) > 0 && !f.types[state.QType()] {
+		return false
+	}
+	if len(f.allowNets) > 0 || len(f.denyNets) > 0 {
+		ip := net.ParseIP(state.IP())
+		if ip == nil || containsIP(f.denyNets, ip) {
+			return false
+		}
+		if len(f.allowNets) > 0 && !containsIP(f.allowNets, ip) {
+			return false
+		}
+	}
+	for label, values := range f.meta {
+		fn := metadata.ValueFunc(ctx, label)
+		if fn == nil || !contains(values, fn()) {
+			return false
+		}
+	}
 	return true
 }
 
+func containsIP(nets []*net.IPNet, ip net.IP) bool {
+	for _, n := range nets {
+		if n.Contains(ip) {
+			return true
+		}
+	}
+	return false
+}
+
+func contains(values []string, v string) bool {
+	for _, x := range values {
+		if x == v {
+			return true
+		}
+	}
+	return false
+}
+
+// addTypes adds the query types to the types condition.
+func (f *Forward) addTypes(types []string) error {
+	if f.types == nil {
+		f.types = map[uint16]bool{}
+	}
+	for _, t := range types {
+		qtype, ok := dns.StringToType[strings.ToUpper(t)]
+		if !ok {
+			return fmt.Errorf("unknown query type '%s'", t)
+		}
+		f.types[qtype] = true
+	}
+	return nil
+}
+
+// parseNets parses the CIDRs of allow_net and deny_net, a single address is a /32 or /128.
+func parseNets(cidrs []string) ([]*net.IPNet, error) {
+	var nets []*net.IPNet
+	for _, c := range cidrs {
+		if !strings.Contains(c, "/") {
+			if ip := net.ParseIP(c); ip != nil {
+				bits := 8 * net.IPv6len
+				if ip.To4() != nil {
+					ip, bits = ip.To4(), 8*net.IPv4len
+				}
+				nets = append(nets, &net.IPNet{IP: ip, Mask: net.CIDRMask(bits, bits)})
+				continue
+			}
+		}
+		_, n, err := net.ParseCIDR(c)
+		if err != nil {
+			return nil, err
+		}
+		nets = append(nets, n)
+	}
+	return nets, nil
+}
+
 func (f *Forward) isAllowedDomain(name string) bool {
 	if dns.Name(name) == dns.Name(f.from) {
 		return true
@@ -233,7 +428,7 @@ func (f *Forward) ForceTCP() bool { return f.opts.ForceTCP }
 func (f *Forward) PreferUDP() bool { return f.opts.PreferUDP }
 
 // List returns a set of proxies to be used for this client depending on the policy in f.
-func (f *Forward) List() []*proxy.Proxy { return f.p.List(f.proxies) }
+func (f *Forward) List() []Upstream { return f.p.List(f.proxies) }
 
 var (
 	// ErrNoHealthy means no healthy proxies left.
@@ -256,4 +451,5 @@ type Options struct {
 	HCDomain string
 }
 
-var defaultTimeout = 5 * time.Second
+// defaultTimeout is the time a request may take over all attempts when no timeout is configured.
+const defaultTimeout = 5 * time.Second
@@ -0,0 +1,102 @@
+package forward
+
+import (
+	"context"
+	"errors"
+	"testing"
+	"time"
+
+	"github.com/coredns/coredns/plugin/metadata"
+	"github.com/coredns/coredns/plugin/pkg/proxy"
+	"github.com/coredns/coredns/plugin/test"
+	"github.com/coredns/coredns/request"
+
+	"github.com/miekg/dns"
+)
+
+func TestExchangeTimeout(t *testing.T) {
+	slow := slowServer(t, 500*time.Millisecond)
+
+	f := New()
+	f.p = new(sequential)
+	f.timeout = 100 * time.Millisecond
+	f.SetProxy(proxy.NewProxy("forward", slow, "dns"))
+	defer f.OnShutdown()
+
+	ctx := metadata.ContextWithMetadata(context.Background())
+	m := new(dns.Msg)
+	m.SetQuestion("example.org.", dns.TypeA)
+	start := time.Now()
+	ret, err := f.Exchange(ctx, request.Request{W: &test.ResponseWriter{}, Req: m})
+	// The upstream waits longer than the timeout for the reply, the request doesn't.
+	if elapsed := time.Since(start); elapsed > 300*time.Millisecond {
+		t.Errorf("returned after %v, want about the timeout of %v", elapsed, f.timeout)
+	}
+	if ret != nil || !errors.Is(err, context.DeadlineExceeded) {
+		t.Errorf("got %v, %v, want %v", ret, err, context.DeadlineExceeded)
+	}
+
+	// An upstream answering within the timeout is not affected.
+	f.timeout = time.Second
+	ret, err = f.Exchange(ctx, request.Request{W: &test.ResponseWriter{}, Req: m})
+	if err != nil || len(ret.Answer) != 1 {
+		t.Errorf("got %v, %v", ret, err)
+	}
+}
+
+func TestMatchRequest(t *testing.T) {
+	tests := []struct {
+		name  string
+		c     Config
+		qname string
+		qtype uint16
+		w     dns.ResponseWriter
+		meta  map[string]string
+		want  bool
+	}{
+		{"from", Config{From: "example.org."}, "www.example.org.", dns.TypeA, &test.ResponseWriter{}, nil, true},
+		{"other zone", Config{From: "example.org."}, "www.example.com.", dns.TypeA, &test.ResponseWriter{}, nil, false},
+		{"except", Config{From: "example.org.", Except: []string{"internal.example.org."}}, "a.internal.example.org.", dns.TypeA, &test.ResponseWriter{}, nil, false},
+
+		{"type", Config{From: ".", Types: []string{"A", "AAAA"}}, "example.org.", dns.TypeAAAA, &test.ResponseWriter{}, nil, true},
+		{"other type", Config{From: ".", Types: []string{"A", "AAAA"}}, "example.org.", dns.TypeMX, &test.ResponseWriter{}, nil, false},
+
+		{"allow_net", Config{From: ".", AllowNets: []string{"10.240.0.0/16"}}, "example.org.", dns.TypeA, &test.ResponseWriter{}, nil, true},
+		{"not in allow_net", Config{From: ".", AllowNets: []string{"10.240.0.0/16"}}, "example.org.", dns.TypeA, &test.ResponseWriter{RemoteIP: "192.0.2.1"}, nil, false},
+		{"allow_net v6", Config{From: ".", AllowNets: []string{"10.240.0.0/16", "fe80::/10"}}, "example.org.", dns.TypeA, &test.ResponseWriter6{}, nil, true},
+		{"deny_net", Config{From: ".", DenyNets: []string{"10.240.0.1/32"}}, "example.org.", dns.TypeA, &test.ResponseWriter{}, nil, false},
+		{"not in deny_net", Config{From: ".", DenyNets: []string{"10.240.0.1/32"}}, "example.org.", dns.TypeA, &test.ResponseWriter{RemoteIP: "10.240.0.2"}, nil, true},
+		// deny_net wins over allow_net.
+		{"deny_net in allow_net", Config{From: ".", AllowNets: []string{"10.0.0.0/8"}, DenyNets: []string{"10.240.0.0/16"}}, "example.org.", dns.TypeA, &test.ResponseWriter{}, nil, false},
+
+		{"metadata", Config{From: ".", Metadata: map[string][]string{"view/name": {"office", "lab"}}}, "example.org.", dns.TypeA, &test.ResponseWriter{}, map[string]string{"view/name": "lab"}, true},
+		{"other metadata value", Config{From: ".", Metadata: map[string][]string{"view/name": {"office", "lab"}}}, "example.org.", dns.TypeA, &test.ResponseWriter{}, map[string]string{"view/name": "public"}, false},
+		{"no metadata", Config{From: ".", Metadata: map[string][]string{"view/name": {"office"}}}, "example.org.", dns.TypeA, &test.ResponseWriter{}, nil, false},
+		{"all metadata labels", Config{From: ".", Metadata: map[string][]string{"view/name": {"office"}, "geo/country": {"GB"}}}, "example.org.", dns.TypeA, &test.ResponseWriter{}, map[string]string{"view/name": "office"}, false},
+	}
+	for _, tc := range tests {
+		tc.c.To = []string{"127.0.0.1:53"}
+		f, err := NewWithConfig(tc.c)
+		if err != nil {
+			t.Fatalf("%s: %v", tc.name, err)
+		}
+		ctx := metadata.ContextWithMetadata(context.Background())
+		for label, v := range tc.meta {
+			v := v
+			metadata.SetValueFunc(ctx, label, func() string { return v })
+		}
+		m := new(dns.Msg)
+		m.SetQuestion(tc.qname, tc.qtype)
+		if got := f.MatchRequest(ctx, request.Request{W: tc.w, Req: m}); got != tc.want {
+			t.Errorf("%s: got %v, want %v", tc.name, got, tc.want)
+		}
+	}
+
+	// A client address that can't be parsed never matches the net conditions.
+	f, _ := NewWithConfig(Config{From: ".", To: []string{"127.0.0.1:53"}, DenyNets: []string{"192.0.2.0/24"}})
+	m := new(dns.Msg)
+	m.SetQuestion("example.org.", dns.TypeA)
+	if f.MatchRequest(context.Background(), request.Request{W: &test.ResponseWriter{RemoteIP: "invalid"}, Req: m}) {
+		t.Errorf("matched a client without an address")
+	}
+}
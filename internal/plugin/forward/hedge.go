@@ -0,0 +1,116 @@
+package forward
+
+import (
+	"context"
+	"time"
+
+	"github.com/coredns/coredns/request"
+
+	"github.com/miekg/dns"
+)
+
+// hedgedExchange sends the request to the first healthy upstream of list and, when no answer arrived
+// after hedgeDelay, to the next one, and so on; a failed attempt starts the next one right away. The first
+// valid answer is returned and the other attempts are canceled. SERVFAIL and REFUSED answers are only
+// returned when no upstream answers better. Each upstream is tried once within the timeout. The upstream
+// whose answer is returned is recorded as forward/upstream metadata.
+func (f *Forward) hedgedExchange(ctx context.Context, state request.Request, list []Upstream) (*dns.Msg, error) {
+	ctx, cancel := context.WithTimeout(ctx, f.timeout)
+	defer cancel()
+
+	var healthy []Upstream
+	for _, p := range list {
+		if !p.Down(f.maxfails) {
+			healthy = append(healthy, p)
+		}
+	}
+	if len(healthy) == 0 {
+		// All upstream proxies are dead, assume healthcheck is completely broken and randomly
+		// select an upstream to connect to.
+		healthy = new(random).List(f.proxies)[:1]
+		healthcheckBrokenCount.Add(1)
+	}
+
+	type result struct {
+		p   Upstream
+		ret *dns.Msg
+		err error
+	}
+	results := make(chan result)
+	start := time.Now()
+	var attempt int32
+	next, inflight := 0, 0
+	launch := func() {
+		p := healthy[next]
+		next++
+		inflight++
+		// The upstream rewrites the id of the request while sending it, each attempt gets its own copy.
+		st := state
+		st.Req = state.Req.Copy()
+		go func() {
+			ret, err := f.connect(ctx, p, st, &attempt, start)
+			select {
+			case results <- result{p, ret, err}:
+			case <-ctx.Done():
+			}
+		}()
+	}
+
+	launch()
+	hedge := time.After(f.hedgeDelay)
+
+	var (
+		fallback  *dns.Msg
+		fallbackP Upstream // upstream that sent fallback
+		lastErr   error
+	)
+	for {
+		select {
+		case r := <-results:
+			inflight--
+			switch {
+			case r.err != nil:
+				lastErr = r.err
+			case !state.Match(r.ret):
+				if fallback == nil {
+					fallback, fallbackP = formErr(r.ret, state), r.p
+				}
+			case r.ret.Rcode == dns.RcodeServerFailure || r.ret.Rcode == dns.RcodeRefused:
+				fallback, fallbackP = r.ret, r.p
+			default:
+				setUpstream(ctx, r.p)
+				return r.ret, nil
+			}
+			if next < len(healthy) {
+				launch()
+				hedge = time.After(f.hedgeDelay)
+			} else if inflight == 0 {
+				return done(ctx, fallback, fallbackP, lastErr)
+			}
+		case <-hedge:
+			if next < len(healthy) {
+				hedgedRequests.WithLabelValues(healthy[next].Addr()).Inc()
+				launch()
+				hedge = time.After(f.hedgeDelay)
+			}
+		case <-ctx.Done():
+			if lastErr == nil {
+				lastErr = ctx.Err()
+			}
+			return done(ctx, fallback, fallbackP, lastErr)
+		}
+	}
+}
+
+// done returns the result of a hedged exchange without a valid answer: fallback from upstream p when
+// there is one, otherwise err.
+func done(ctx context.Context, fallback *dns.Msg, p Upstream, err error) (*dns.Msg, error) {
+	if fallback != nil {
+		setUpstream(ctx, p)
+		return fallback, nil
+	}
+	if err == nil {
+		err = ErrNoHealthy
+	}
+	return nil, err
+}
@@ -0,0 +1,64 @@
+package forward
+
+import (
+	"context"
+	"testing"
+	"time"
+
+	"github.com/coredns/coredns/plugin/metadata"
+	"github.com/coredns/coredns/plugin/pkg/proxy"
+	"github.com/coredns/coredns/plugin/test"
+	"github.com/coredns/coredns/request"
+
+	"github.com/miekg/dns"
+)
+
+// slowServer starts a UDP DNS server that answers the queries after delay and returns its address.
+func slowServer(t *testing.T, delay time.Duration) string {
+	mux := dns.NewServeMux()
+	mux.HandleFunc(".", func(w dns.ResponseWriter, r *dns.Msg) {
+		time.Sleep(delay)
+		w.WriteMsg(answer(r))
+	})
+	started := make(chan struct{})
+	s := &dns.Server{Addr: "127.0.0.1:0", Net: "udp", Handler: mux, NotifyStartedFunc: func() { close(started) }}
+	go s.ListenAndServe()
+	<-started
+	t.Cleanup(func() { s.Shutdown() })
+	return s.PacketConn.LocalAddr().String()
+}
+
+func TestHedgedExchangeUpstream(t *testing.T) {
+	slow := slowServer(t, 300*time.Millisecond)
+	fast := slowServer(t, 50*time.Millisecond)
+
+	// With hedging both upstreams are queried at the same time, run with -race.
+	tests := []struct {
+		name  string
+		hedge time.Duration
+		want  string
+	}{
+		{"hedged", 10 * time.Millisecond, fast},
+		{"sequential", 0, slow},
+	}
+	for _, tc := range tests {
+		f := New()
+		f.p = new(sequential)
+		f.hedgeDelay = tc.hedge
+		f.SetProxy(proxy.NewProxy("forward", slow, "dns"))
+		f.SetProxy(proxy.NewProxy("forward", fast, "dns"))
+
+		ctx := metadata.ContextWithMetadata(context.Background())
+		m := new(dns.Msg)
+		m.SetQuestion("example.org.", dns.TypeA)
+		ret, err := f.Exchange(ctx, request.Request{W: &test.ResponseWriter{}, Req: m})
+		if err != nil || len(ret.Answer) != 1 {
+			t.Errorf("%s: got %v, %v", tc.name, ret, err)
+		}
+		fn := metadata.ValueFunc(ctx, "forward/upstream")
+		if fn == nil || fn() != tc.want {
+			t.Errorf("%s: forward/upstream is not %s", tc.name, tc.want)
+		}
+		f.OnShutdown()
+	}
+}
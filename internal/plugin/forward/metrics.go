@@ -22,4 +22,96 @@ var (
 		Name:      "max_concurrent_rejects_total",
 		Help:      "Counter of the number of queries rejected because the concurrent queries were at maximum.",
 	})
+
+	cacheHits = promauto.NewCounterVec(prometheus.CounterOpts{
+		Namespace: plugin.Namespace,
+		Subsystem: "forward",
+		Name:      "cache_hits_total",
+		Help:      "Counter of the number of queries answered from the forward cache.",
+	}, []string{"type"})
+
+	cacheMisses = promauto.NewCounter(prometheus.CounterOpts{
+		Namespace: plugin.Namespace,
+		Subsystem: "forward",
+		Name:      "cache_misses_total",
+		Help:      "Counter of the number of queries not in the forward cache or expired.",
+	})
+
+	cachePrefetches = promauto.NewCounter(prometheus.CounterOpts{
+		Namespace: plugin.Namespace,
+		Subsystem: "forward",
+		Name:      "cache_prefetch_total",
+		Help:      "Counter of the number of forward cache entries prefetched before expiry.",
+	})
+
+	cacheServedStale = promauto.NewCounter(prometheus.CounterOpts{
+		Namespace: plugin.Namespace,
+		Subsystem: "forward",
+		Name:      "cache_served_stale_total",
+		Help:      "Counter of the number of expired forward cache entries served because the upstreams failed.",
+	})
+
+	upstreamRtt = promauto.NewGaugeVec(prometheus.GaugeOpts{
+		Namespace: plugin.Namespace,
+		Subsystem: "forward",
+		Name:      "upstream_rtt_ewma_seconds",
+		Help:      "Gauge of the moving average of the RTT per upstream, as used by the fastest policy.",
+	}, []string{"to"})
+
+	upstreamErrorRate = promauto.NewGaugeVec(prometheus.GaugeOpts{
+		Namespace: plugin.Namespace,
+		Subsystem: "forward",
+		Name:      "upstream_error_rate_ewma",
+		Help:      "Gauge of the moving average of the error rate per upstream, as used by the fastest policy.",
+	}, []string{"to"})
+
+	policySelections = promauto.NewCounterVec(prometheus.CounterOpts{
+		Namespace: plugin.Namespace,
+		Subsystem: "forward",
+		Name:      "policy_selections_total",
+		Help:      "Counter of the number of times an upstream was the first choice of the policy.",
+	}, []string{"policy", "to"})
+
+	upstreamRequests = promauto.NewCounterVec(prometheus.CounterOpts{
+		Namespace: plugin.Namespace,
+		Subsystem: "forward",
+		Name:      "upstream_requests_total",
+		Help:      "Counter of the number of queries sent per upstream, including retries.",
+	}, []string{"to"})
+
+	upstreamResponses = promauto.NewCounterVec(prometheus.CounterOpts{
+		Namespace: plugin.Namespace,
+		Subsystem: "forward",
+		Name:      "upstream_responses_total",
+		Help:      "Counter of the number of responses per upstream and rcode.",
+	}, []string{"to", "rcode"})
+
+	upstreamDuration = promauto.NewHistogramVec(prometheus.HistogramOpts{
+		Namespace: plugin.Namespace,
+		Subsystem: "forward",
+		Name:      "upstream_request_duration_seconds",
+		Buckets:   plugin.TimeBuckets,
+		Help:      "Histogram of the time each query to an upstream took until the response.",
+	}, []string{"to"})
+
+	upstreamRetries = promauto.NewCounterVec(prometheus.CounterOpts{
+		Namespace: plugin.Namespace,
+		Subsystem: "forward",
+		Name:      "upstream_retries_total",
+		Help:      "Counter of the number of queries sent to an upstream after an earlier attempt for the same request.",
+	}, []string{"to"})
+
+	tcpFallbacks = promauto.NewCounterVec(prometheus.CounterOpts{
+		Namespace: plugin.Namespace,
+		Subsystem: "forward",
+		Name:      "tcp_fallbacks_total",
+		Help:      "Counter of the number of truncated UDP responses retried over TCP because of prefer_udp.",
+	}, []string{"to"})
+
+	hedgedRequests = promauto.NewCounterVec(prometheus.CounterOpts{
+		Namespace: plugin.Namespace,
+		Subsystem: "forward",
+		Name:      "hedged_requests_total",
+		Help:      "Counter of the number of hedged queries sent to an upstream because earlier attempts didn't answer in time.",
+	}, []string{"to"})
 )
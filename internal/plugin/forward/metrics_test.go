@@ -0,0 +1,94 @@
+package forward
+
+import (
+	"context"
+	"net"
+	"testing"
+	"time"
+
+	"github.com/coredns/coredns/plugin/metadata"
+	"github.com/coredns/coredns/plugin/pkg/proxy"
+	"github.com/coredns/coredns/plugin/test"
+	"github.com/coredns/coredns/request"
+
+	"github.com/miekg/dns"
+	"github.com/prometheus/client_golang/prometheus/testutil"
+)
+
+// closedPort returns a UDP address nothing listens on, queries to it fail with connection refused.
+func closedPort(t *testing.T) string {
+	c, err := net.ListenPacket("udp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	addr := c.LocalAddr().String()
+	c.Close()
+	return addr
+}
+
+// The dnstap messages can't be checked here: the output of a dnstap.Dnstap is unexported, it is covered
+// by the dnstap tests of CoreDNS.
+func TestUpstreamMetrics(t *testing.T) {
+	dead := closedPort(t)
+	live := slowServer(t, 0)
+
+	f := New()
+	f.p = new(sequential)
+	f.SetProxy(proxy.NewProxy("forward", dead, "dns"))
+	f.SetProxy(proxy.NewProxy("forward", live, "dns"))
+	defer f.OnShutdown()
+
+	before := map[string]float64{
+		"dead requests": testutil.ToFloat64(upstreamRequests.WithLabelValues(dead)),
+		"dead retries":  testutil.ToFloat64(upstreamRetries.WithLabelValues(dead)),
+		"live requests": testutil.ToFloat64(upstreamRequests.WithLabelValues(live)),
+		"live retries":  testutil.ToFloat64(upstreamRetries.WithLabelValues(live)),
+		"live NOERROR":  testutil.ToFloat64(upstreamResponses.WithLabelValues(live, "NOERROR")),
+	}
+
+	ctx := metadata.ContextWithMetadata(context.Background())
+	m := new(dns.Msg)
+	m.SetQuestion("example.org.", dns.TypeA)
+	ret, err := f.Exchange(ctx, request.Request{W: &test.ResponseWriter{}, Req: m})
+	if err != nil || len(ret.Answer) != 1 {
+		t.Fatalf("got %v, %v", ret, err)
+	}
+
+	// The first query fails, the second one to the next upstream is a retry.
+	after := map[string]float64{
+		"dead requests": testutil.ToFloat64(upstreamRequests.WithLabelValues(dead)),
+		"dead retries":  testutil.ToFloat64(upstreamRetries.WithLabelValues(dead)),
+		"live requests": testutil.ToFloat64(upstreamRequests.WithLabelValues(live)),
+		"live retries":  testutil.ToFloat64(upstreamRetries.WithLabelValues(live)),
+		"live NOERROR":  testutil.ToFloat64(upstreamResponses.WithLabelValues(live, "NOERROR")),
+	}
+	want := map[string]float64{"dead requests": 1, "dead retries": 0, "live requests": 1, "live retries": 1, "live NOERROR": 1}
+	for k, v := range want {
+		if got := after[k] - before[k]; got != v {
+			t.Errorf("%s: got %v, want %v", k, got, v)
+		}
+	}
+}
+
+func TestHedgedRequestsMetric(t *testing.T) {
+	slow := slowServer(t, 300*time.Millisecond)
+	fast := slowServer(t, 0)
+
+	f := New()
+	f.p = new(sequential)
+	f.hedgeDelay = 10 * time.Millisecond
+	f.SetProxy(proxy.NewProxy("forward", slow, "dns"))
+	f.SetProxy(proxy.NewProxy("forward", fast, "dns"))
+	defer f.OnShutdown()
+
+	before := testutil.ToFloat64(hedgedRequests.WithLabelValues(fast))
+	ctx := metadata.ContextWithMetadata(context.Background())
+	m := new(dns.Msg)
+	m.SetQuestion("example.org.", dns.TypeA)
+	if _, err := f.Exchange(ctx, request.Request{W: &test.ResponseWriter{}, Req: m}); err != nil {
+		t.Fatal(err)
+	}
+	if got := testutil.ToFloat64(hedgedRequests.WithLabelValues(fast)) - before; got != 1 {
+		t.Errorf("got %v hedged requests to %s, want 1", got, fast)
+	}
+}
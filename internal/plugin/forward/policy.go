@@ -1,16 +1,18 @@
 package forward
 
 import (
+	"math"
+	"sort"
+	"sync"
 	"sync/atomic"
 	"time"
 
-	"github.com/coredns/coredns/plugin/pkg/proxy"
 	"github.com/coredns/coredns/plugin/pkg/rand"
 )
 
 // Policy defines a policy we use for selecting upstreams.
 type Policy interface {
-	List([]*proxy.Proxy) []*proxy.Proxy
+	List([]Upstream) []Upstream
 	String() string
 }
 
@@ -19,19 +21,19 @@ type random struct{}
 
 func (r *random) String() string { return "random" }
 
-func (r *random) List(p []*proxy.Proxy) []*proxy.Proxy {
+func (r *random) List(p []Upstream) []Upstream {
 	switch len(p) {
 	case 1:
 		return p
 	case 2:
 		if rn.Int()%2 == 0 {
-			return []*proxy.Proxy{p[1], p[0]} // swap
+			return []Upstream{p[1], p[0]} // swap
 		}
 		return p
 	}
 
 	perms := rn.Perm(len(p))
-	rnd := make([]*proxy.Proxy, len(p))
+	rnd := make([]Upstream, len(p))
 
 	for i, p1 := range perms {
 		rnd[i] = p[p1]
@@ -46,11 +48,11 @@ type roundRobin struct {
 
 func (r *roundRobin) String() string { return "round_robin" }
 
-func (r *roundRobin) List(p []*proxy.Proxy) []*proxy.Proxy {
+func (r *roundRobin) List(p []Upstream) []Upstream {
 	poolLen := uint32(len(p))
 	i := atomic.AddUint32(&r.robin, 1) % poolLen
 
-	robin := []*proxy.Proxy{p[i]}
+	robin := []Upstream{p[i]}
 	robin = append(robin, p[:i]...)
 	robin = append(robin, p[i+1:]...)
 
@@ -62,8 +64,128 @@ type sequential struct{}
 
 func (r *sequential) String() string { return "sequential" }
 
-func (r *sequential) List(p []*proxy.Proxy) []*proxy.Proxy {
+func (r *sequential) List(p []Upstream) []Upstream {
 	return p
 }
 
+// observer is implemented by policies that order upstreams by the results of earlier queries.
+type observer interface {
+	observe(u Upstream, rtt time.Duration, err error)
+}
+
+const (
+	ewmaAlpha    = 0.3 // weight of the newest sample
+	errorPenalty = 10  // an upstream failing every query scores as 11 times its RTT
+
+	scoreHalfLife = 15 * time.Second // the score of an upstream halves for every scoreHalfLife without samples
+)
+
+// fastest is a policy that orders upstreams by the exponentially weighted moving average of their RTT,
+// multiplied by a penalty for their error rate. Upstreams without samples come first so they get measured.
+// The score decays toward unmeasured while an upstream gets no queries, so a slow or failing upstream is
+// tried again after a while and recovers once it answers well.
+type fastest struct {
+	mu    sync.Mutex
+	stats map[Upstream]*upstreamStats
+}
+
+type upstreamStats struct {
+	rtt     float64   // EWMA of the RTT in seconds
+	errRate float64   // EWMA of the errors, 0 (none) to 1 (all queries)
+	updated time.Time // time of the last sample
+}
+
+func (s *upstreamStats) score(now time.Time) float64 {
+	decay := math.Exp2(-float64(now.Sub(s.updated)) / float64(scoreHalfLife))
+	return s.rtt * (1 + errorPenalty*s.errRate) * decay
+}
+
+func (r *fastest) String() string { return "fastest" }
+
+func (r *fastest) List(p []Upstream) []Upstream {
+	scores := make([]float64, len(p))
+	now := time.Now()
+	r.mu.Lock()
+	for i, u := range p {
+		if s, ok := r.stats[u]; ok {
+			scores[i] = s.score(now)
+		}
+	}
+	r.mu.Unlock()
+
+	idx := make([]int, len(p))
+	for i := range idx {
+		idx[i] = i
+	}
+	sort.SliceStable(idx, func(i, j int) bool { return scores[idx[i]] < scores[idx[j]] })
+	list := make([]Upstream, len(p))
+	for i, x := range idx {
+		list[i] = p[x]
+	}
+	return list
+}
+
+func (r *fastest) observe(u Upstream, rtt time.Duration, err error) {
+	failed := 0.0
+	if err != nil {
+		failed = 1
+	}
+	r.mu.Lock()
+	if r.stats == nil {
+		r.stats = map[Upstream]*upstreamStats{}
+	}
+	s, ok := r.stats[u]
+	if !ok {
+		s = &upstreamStats{rtt: rtt.Seconds(), errRate: failed}
+		r.stats[u] = s
+	} else {
+		s.rtt += ewmaAlpha * (rtt.Seconds() - s.rtt)
+		s.errRate += ewmaAlpha * (failed - s.errRate)
+	}
+	s.updated = time.Now()
+	rttSeconds, errRate := s.rtt, s.errRate
+	r.mu.Unlock()
+
+	upstreamRtt.WithLabelValues(u.Addr()).Set(rttSeconds)
+	upstreamErrorRate.WithLabelValues(u.Addr()).Set(errRate)
+}
+
+// weighted is a policy that orders upstreams by a weighted random permutation: the first upstream is
+// picked with a probability proportional to its weight, then the next from the remaining ones, and so on.
+// weights are in the order of the configured upstreams, upstreams without a weight use 1 and upstreams
+// with weight 0 are only used when all others failed.
+type weighted struct {
+	weights []float64
+}
+
+func (r *weighted) String() string { return "weighted" }
+
+func (r *weighted) List(p []Upstream) []Upstream {
+	// Efraimidis-Spirakis: every upstream gets the key u^(1/w), ordered from high to low.
+	keys := make([]float64, len(p))
+	for i := range p {
+		w := 1.0
+		if i < len(r.weights) {
+			w = r.weights[i]
+		}
+		keys[i] = -1
+		if w > 0 {
+			keys[i] = math.Pow(randFloat(), 1/w)
+		}
+	}
+	idx := make([]int, len(p))
+	for i := range idx {
+		idx[i] = i
+	}
+	sort.SliceStable(idx, func(i, j int) bool { return keys[idx[i]] > keys[idx[j]] })
+	list := make([]Upstream, len(p))
+	for i, x := range idx {
+		list[i] = p[x]
+	}
+	return list
+}
+
+// randFloat returns a random number in (0, 1).
+func randFloat() float64 { return (float64(rn.Int()>>10) + 0.5) / (1 << 53) }
+
 var rn = rand.New(time.Now().UnixNano())
@@ -0,0 +1,39 @@
+package forward
+
+import (
+	"errors"
+	"testing"
+	"time"
+
+	"github.com/coredns/coredns/plugin/pkg/proxy"
+)
+
+func TestFastestRecovers(t *testing.T) {
+	good := proxy.NewProxy("forward", "10.0.0.1:53", "dns")
+	bad := proxy.NewProxy("forward", "10.0.0.2:53", "dns")
+	r := new(fastest)
+	r.observe(good, 10*time.Millisecond, nil)
+	r.observe(bad, time.Second, errors.New("timeout"))
+
+	if list := r.List([]Upstream{bad, good}); list[0] != good {
+		t.Fatalf("got %s first, want the fast upstream", list[0].Addr())
+	}
+
+	// The fast upstream keeps getting queries, the failing one does not; its score decays until it is
+	// tried again.
+	r.mu.Lock()
+	r.stats[bad].updated = r.stats[bad].updated.Add(-20 * scoreHalfLife)
+	r.mu.Unlock()
+	r.observe(good, 10*time.Millisecond, nil)
+	if list := r.List([]Upstream{good, bad}); list[0] != bad {
+		t.Fatalf("got %s first, want the decayed upstream to be tried again", list[0].Addr())
+	}
+
+	// Good answers make it the fastest again.
+	for i := 0; i < 20; i++ {
+		r.observe(bad, time.Millisecond, nil)
+	}
+	if list := r.List([]Upstream{good, bad}); list[0] != bad {
+		t.Errorf("got %s first, want the recovered upstream", list[0].Addr())
+	}
+}
@@ -5,6 +5,7 @@ import (
 	"errors"
 	"fmt"
 	"strconv"
+	"strings"
 	"time"
 
 	"github.com/coredns/caddy"
@@ -75,8 +76,10 @@ func (f *Forward) OnStartup() (err error) {
 	return nil
 }
 
-// OnShutdown stops all configured proxies.
+// OnShutdown stops all configured proxies after the running prefetches finished. Exchange must not be
+// called anymore, a stopped proxy blocks on connect.
 func (f *Forward) OnShutdown() error {
+	f.prefetches.Wait()
 	for _, p := range f.proxies {
 		p.Stop()
 	}
@@ -117,21 +120,20 @@ func parseStanza(c *caddy.Controller) (*Forward, error) {
 		return f, c.ArgErr()
 	}
 
-	toHosts, err := parse.HostPortOrFile(to...)
+	toHosts, err := parseUpstreams(to)
 	if err != nil {
 		return f, err
 	}
 
 	transports := make([]string, len(toHosts))
-	allowedTrans := map[string]bool{"dns": true, "tls": true}
+	allowedTrans := map[string]bool{"dns": true, "tls": true, "https": true, "quic": true}
 	for i, host := range toHosts {
 		trans, h := parse.Transport(host)
 
 		if !allowedTrans[trans] {
 			return f, fmt.Errorf("'%s' is not supported as a destination protocol in forward: %s", trans, host)
 		}
-		p := proxy.NewProxy("forward", h, trans)
-		f.proxies = append(f.proxies, p)
+		f.proxies = append(f.proxies, newUpstream(trans, h))
 		transports[i] = trans
 	}
 
@@ -141,6 +143,17 @@ func parseStanza(c *caddy.Controller) (*Forward, error) {
 		}
 	}
 
+	if w, ok := f.p.(*weighted); ok && len(w.weights) > len(f.proxies) {
+		return f, fmt.Errorf("more weights than TOs configured: %d", len(w.weights))
+	}
+
+	f.setupProxies(transports)
+
+	return f, nil
+}
+
+// setupProxies applies the TLS, expire and healthcheck settings of f to its proxies.
+func (f *Forward) setupProxies(transports []string) {
 	if f.tlsServerName != "" {
 		f.tlsConfig.ServerName = f.tlsServerName
 	}
@@ -150,20 +163,29 @@ func parseStanza(c *caddy.Controller) (*Forward, error) {
 	f.tlsConfig.ClientSessionCache = tls.NewLRUClientSessionCache(len(f.proxies))
 
 	for i := range f.proxies {
-		// Only set this for proxies that need it.
-		if transports[i] == transport.TLS {
-			f.proxies[i].SetTLSConfig(f.tlsConfig)
+		if f.readTimeout > 0 {
+			f.proxies[i].SetReadTimeout(f.readTimeout)
 		}
-		f.proxies[i].SetExpire(f.expire)
-		f.proxies[i].GetHealthchecker().SetRecursionDesired(f.opts.HCRecursionDesired)
-		// when TLS is used, checks are set to tcp-tls
-		if f.opts.ForceTCP && transports[i] != transport.TLS {
-			f.proxies[i].GetHealthchecker().SetTCPTransport()
+		switch p := f.proxies[i].(type) {
+		case *proxy.Proxy:
+			// Only set this for proxies that need it.
+			if transports[i] == transport.TLS {
+				p.SetTLSConfig(f.tlsConfig)
+			}
+			p.SetExpire(f.expire)
+			p.GetHealthchecker().SetRecursionDesired(f.opts.HCRecursionDesired)
+			// when TLS is used, checks are set to tcp-tls
+			if f.opts.ForceTCP && transports[i] != transport.TLS {
+				p.GetHealthchecker().SetTCPTransport()
+			}
+			p.GetHealthchecker().SetDomain(f.opts.HCDomain)
+		case encrypted:
+			// DoH and DoQ always use TLS, force_tcp and prefer_udp don't apply.
+			p.setTLSConfig(f.tlsConfig)
+			p.setExpire(f.expire)
+			p.setHealthcheck(f.opts.HCDomain, f.opts.HCRecursionDesired)
 		}
-		f.proxies[i].GetHealthchecker().SetDomain(f.opts.HCDomain)
 	}
-
-	return f, nil
 }
 
 func parseBlock(c *caddy.Controller, f *Forward) error {
@@ -266,6 +288,21 @@ func parseBlock(c *caddy.Controller, f *Forward) error {
 			f.p = &roundRobin{}
 		case "sequential":
 			f.p = &sequential{}
+		case "fastest":
+			f.p = &fastest{}
+		case "weighted":
+			w := &weighted{}
+			for c.NextArg() {
+				n, err := strconv.ParseFloat(c.Val(), 64)
+				if err != nil {
+					return err
+				}
+				if n < 0 {
+					return fmt.Errorf("weight can't be negative: %s", c.Val())
+				}
+				w.weights = append(w.weights, n)
+			}
+			f.p = w
 		default:
 			return c.Errf("unknown policy '%s'", x)
 		}
@@ -282,6 +319,138 @@ func parseBlock(c *caddy.Controller, f *Forward) error {
 		}
 		f.ErrLimitExceeded = errors.New("concurrent queries exceeded maximum " + c.Val())
 		f.maxConcurrent = int64(n)
+	case "types":
+		types := c.RemainingArgs()
+		if len(types) == 0 {
+			return c.ArgErr()
+		}
+		if err := f.addTypes(types); err != nil {
+			return err
+		}
+	case "allow_net", "deny_net":
+		prop := c.Val()
+		args := c.RemainingArgs()
+		if len(args) == 0 {
+			return c.ArgErr()
+		}
+		nets, err := parseNets(args)
+		if err != nil {
+			return err
+		}
+		if prop == "allow_net" {
+			f.allowNets = append(f.allowNets, nets...)
+		} else {
+			f.denyNets = append(f.denyNets, nets...)
+		}
+	case "metadata":
+		args := c.RemainingArgs()
+		if len(args) < 2 {
+			return c.ArgErr()
+		}
+		if f.meta == nil {
+			f.meta = map[string][]string{}
+		}
+		f.meta[args[0]] = append(f.meta[args[0]], args[1:]...)
+	case "timeout":
+		if !c.NextArg() {
+			return c.ArgErr()
+		}
+		dur, err := time.ParseDuration(c.Val())
+		if err != nil {
+			return err
+		}
+		if dur <= 0 {
+			return fmt.Errorf("timeout should be positive: %s", dur)
+		}
+		f.timeout = dur
+	case "read_timeout":
+		if !c.NextArg() {
+			return c.ArgErr()
+		}
+		dur, err := time.ParseDuration(c.Val())
+		if err != nil {
+			return err
+		}
+		if dur <= 0 {
+			return fmt.Errorf("read_timeout should be positive: %s", dur)
+		}
+		f.readTimeout = dur
+	case "hedge":
+		if !c.NextArg() {
+			return c.ArgErr()
+		}
+		dur, err := time.ParseDuration(c.Val())
+		if err != nil {
+			return err
+		}
+		if dur <= 0 {
+			return fmt.Errorf("hedge delay should be positive: %s", dur)
+		}
+		f.hedgeDelay = dur
+	case "cache":
+		args := c.RemainingArgs()
+		if len(args) == 0 || len(args) > 3 {
+			return c.ArgErr()
+		}
+		n, err := strconv.Atoi(args[0])
+		if err != nil {
+			return err
+		}
+		if n <= 0 {
+			return fmt.Errorf("cache size should be positive: %d", n)
+		}
+		f.cache = newResponseCache(n)
+		if len(args) > 1 {
+			if f.cache.maxTTL, err = time.ParseDuration(args[1]); err != nil {
+				return err
+			}
+		}
+		if len(args) > 2 {
+			if f.cache.negTTL, err = time.ParseDuration(args[2]); err != nil {
+				return err
+			}
+		}
+	case "prefetch":
+		if f.cache == nil {
+			return c.Err("prefetch needs cache")
+		}
+		args := c.RemainingArgs()
+		if len(args) == 0 || len(args) > 2 {
+			return c.ArgErr()
+		}
+		n, err := strconv.Atoi(args[0])
+		if err != nil {
+			return err
+		}
+		if n < 0 {
+			return fmt.Errorf("prefetch amount can't be negative: %d", n)
+		}
+		f.cache.prefetch = n
+		if len(args) > 1 {
+			pct, err := strconv.Atoi(strings.TrimSuffix(args[1], "%"))
+			if err != nil {
+				return err
+			}
+			if pct < 1 || pct > 100 {
+				return fmt.Errorf("prefetch percentage should fall in range [1, 100]: %d", pct)
+			}
+			f.cache.prefetchPct = pct
+		}
+	case "serve_stale":
+		if f.cache == nil {
+			return c.Err("serve_stale needs cache")
+		}
+		if !c.NextArg() {
+			return c.ArgErr()
+		}
+		dur, err := time.ParseDuration(c.Val())
+		if err != nil {
+			return err
+		}
+		if dur < 0 {
+			return fmt.Errorf("serve_stale can't be negative: %s", dur)
+		}
+		f.cache.serveStale = dur
 
 	default:
 		return c.Errf("unknown property '%s'", c.Val())
@@ -0,0 +1,138 @@
+package forward
+
+import (
+	"context"
+	"crypto/tls"
+	"fmt"
+	"net"
+	"net/url"
+	"sync/atomic"
+	"time"
+
+	"github.com/coredns/coredns/plugin/pkg/parse"
+	"github.com/coredns/coredns/plugin/pkg/proxy"
+	"github.com/coredns/coredns/plugin/pkg/transport"
+	"github.com/coredns/coredns/plugin/pkg/up"
+	"github.com/coredns/coredns/request"
+
+	"github.com/miekg/dns"
+)
+
+// Upstream is a server queries are forwarded to. *proxy.Proxy implements it for the dns:// and tls://
+// transports, dohUpstream and doqUpstream implement it for https:// (RFC 8484) and quic:// (RFC 9250).
+type Upstream interface {
+	// Addr returns the host:port of the upstream.
+	Addr() string
+	// Connect sends the request in state to the upstream and returns the reply.
+	Connect(ctx context.Context, state request.Request, opts proxy.Options) (*dns.Msg, error)
+	// Healthcheck kicks off a round of health checks.
+	Healthcheck()
+	// Down returns true if the upstream has more than maxfails failed health checks.
+	Down(maxfails uint32) bool
+	// Start starts healthchecking with the given interval.
+	Start(hcInterval time.Duration)
+	// Stop stops healthchecking and closes idle connections.
+	Stop()
+	// SetReadTimeout sets how long a single query waits for the reply.
+	SetReadTimeout(timeout time.Duration)
+}
+
+// upstreamTimeout is the default timeout of a single query to a DoH or DoQ upstream, including the health checks.
+const upstreamTimeout = 2 * time.Second
+
+// newUpstream returns the upstream for host as returned by parseUpstreams.
+func newUpstream(trans, host string) Upstream {
+	switch trans {
+	case transport.HTTPS:
+		return newDoH(transport.HTTPS + "://" + host)
+	case transport.QUIC:
+		return newDoQ(host)
+	}
+	return proxy.NewProxy("forward", host, trans)
+}
+
+// parseUpstreams normalizes the TO addresses. https:// addresses are DoH URLs whose path defaults to
+// /dns-query and whose host may be a name; the other addresses are handled by parse.HostPortOrFile.
+func parseUpstreams(to []string) ([]string, error) {
+	var hosts []string
+	for _, h := range to {
+		if trans, _ := parse.Transport(h); trans != transport.HTTPS {
+			ss, err := parse.HostPortOrFile(h)
+			if err != nil {
+				return nil, err
+			}
+			hosts = append(hosts, ss...)
+			continue
+		}
+		u, err := url.Parse(h)
+		if err != nil || u.Host == "" {
+			return nil, fmt.Errorf("invalid DoH url: %q", h)
+		}
+		if u.Port() == "" {
+			u.Host = net.JoinHostPort(u.Hostname(), transport.HTTPSPort)
+		}
+		if u.Path == "" || u.Path == "/" {
+			u.Path = "/dns-query"
+		}
+		hosts = append(hosts, u.String())
+	}
+	return hosts, nil
+}
+
+// upstreamHealth implements the healthchecking of proxy.Proxy for upstreams that are not a *proxy.Proxy:
+// a failed check increments fails and the probe keeps checking with hcInterval until a check succeeds,
+// which resets fails to 0.
+type upstreamHealth struct {
+	fails            uint32
+	timeout          time.Duration // timeout of a query, including the health checks
+	probe            *up.Probe
+	domain           string
+	recursionDesired bool
+	exchange         func(ctx context.Context, m *dns.Msg) (*dns.Msg, error)
+}
+
+func newUpstreamHealth(exchange func(ctx context.Context, m *dns.Msg) (*dns.Msg, error)) upstreamHealth {
+	return upstreamHealth{timeout: upstreamTimeout, probe: up.New(), domain: ".", recursionDesired: true, exchange: exchange}
+}
+
+// Healthcheck implements Upstream.
+func (h *upstreamHealth) Healthcheck() { h.probe.Do(h.check) }
+
+// Down implements Upstream.
+func (h *upstreamHealth) Down(maxfails uint32) bool {
+	if maxfails == 0 {
+		return false
+	}
+	return atomic.LoadUint32(&h.fails) > maxfails
+}
+
+func (h *upstreamHealth) check() error {
+	ping := new(dns.Msg)
+	ping.SetQuestion(h.domain, dns.TypeNS)
+	ping.RecursionDesired = h.recursionDesired
+	ctx, cancel := context.WithTimeout(context.Background(), h.timeout)
+	defer cancel()
+	if _, err := h.exchange(ctx, ping); err != nil {
+		atomic.AddUint32(&h.fails, 1)
+		return err
+	}
+	atomic.StoreUint32(&h.fails, 0)
+	return nil
+}
+
+// SetReadTimeout sets the timeout of a query, like proxy.Proxy.SetReadTimeout.
+func (h *upstreamHealth) SetReadTimeout(timeout time.Duration) { h.timeout = timeout }
+
+// setHealthcheck sets the domain and the RD bit of the health check queries.
+func (h *upstreamHealth) setHealthcheck(domain string, recursionDesired bool) {
+	h.domain = domain
+	h.recursionDesired = recursionDesired
+}
+
+// encrypted is implemented by the DoH and DoQ upstreams to receive the TLS and connection settings
+// that setupProxies applies to proxy.Proxy.
+type encrypted interface {
+	setTLSConfig(cfg *tls.Config)
+	setExpire(expire time.Duration)
+	setHealthcheck(domain string, recursionDesired bool)
+}
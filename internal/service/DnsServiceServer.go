@@ -3,12 +3,13 @@ package service
 import (
 	"context"
 	"dnsadminserver/internal/config"
-	"fmt"
 	"log"
 
 	"github.com/coredns/coredns/pb"
 	"github.com/miekg/dns"
+	"google.golang.org/grpc/codes"
 	"google.golang.org/grpc/metadata"
+	"google.golang.org/grpc/status"
 	// "google.golang.org/grpc/peer"
 )
 
@@ -30,29 +31,147 @@ func (s *DnsServiceServer) Query(ctx context.Context, req *pb.DnsPacket) (resp *
 
 		return resp, nil
 	}
-	cluster := me.Get("cluster")[0]
+	cluster := firstMD(me, "cluster")
+	cfg := config.GetConfig()
+	if err := authorize(me, cluster); err != nil {
+		return nil, err
+	}
+	if !limiter.allow(cluster) {
+		return nil, status.Errorf(codes.ResourceExhausted, "rate limit exceeded for cluster %s", cluster)
+	}
+	t, resp, done, err := checkTsig(cluster, req.Msg, reqMsg)
+	if done {
+		return resp, err
+	}
+	opt, size, badvers := edns(reqMsg, firstMD(me, "proto"))
+	if badvers {
+		msg := new(dns.Msg)
+		msg.SetRcode(reqMsg, dns.RcodeBadVers)
+		msg.Extra = append(msg.Extra, opt)
+		return packSigned(msg, t)
+	}
+	if reqMsg.Opcode == dns.OpcodeUpdate {
+		return s.update(ctx, cluster, t, reqMsg)
+	}
+	if isTransfer(reqMsg) {
+		return packSigned(transfer(cluster, reqMsg), t)
+	}
+	ttl, overrideTtl := cfg.TtlOverrides[cluster]
+	c := clientFor(ctx, me, reqMsg)
 	records := make([]dns.RR, 0)
 	for _, v := range reqMsg.Question {
-		key := cluster + "-" + fmt.Sprint(v.Qtype) + "-" + v.Name
-		rdata := config.DnsRecordsCache[key]
-		for _, r := range rdata {
-			records = append(records, r.DnsRR)
+		for _, rr := range lookup(cluster, v, c) {
+			if overrideTtl {
+				rr = dns.Copy(rr)
+				rr.Header().Ttl = ttl
+			}
+			records = append(records, rr)
 		}
 	}
-	if len(records) == 0 {
-		log.Println("no records found", reqMsg.Question)
+
+	// 没有记录且不属于本服务负责的zone时转发到上游。名称下有其他类型的记录时返回NODATA,
+	// 不转发,以免上游的应答和本服务的记录不一致
+	if len(records) == 0 && len(reqMsg.Question) == 1 {
+		q := reqMsg.Question[0]
+		if _, ok := config.FindZone(cluster, q.Name); !ok && len(nameTypes(cluster, q.Name)) == 0 {
+			if ret, ok := forwardQuery(ctx, cluster, reqMsg, c, firstMD(me, "proto")); ok {
+				truncate(ret, size, t)
+				return packSigned(ret, t)
+			}
+		}
 	}
 
 	msg := new(dns.Msg)
 	msg.SetReply(reqMsg)
 	msg.Authoritative = true
 	msg.Answer = records
+	if len(records) == 0 {
+		log.Println("no records found", reqMsg.Question)
+		negative(cluster, msg)
+	}
+	// 查询设置了DO位时对应答签名
+	if opt != nil {
+		if opt.Do() {
+			signResponse(cluster, msg)
+		}
+		if e := c.option(); e != nil {
+			opt.Option = append(opt.Option, e)
+		}
+		msg.Extra = append(msg.Extra, opt)
+	}
+	truncate(msg, size, t)
+	return packSigned(msg, t)
+}
+
+// lookup 返回问题的应答记录,zone顶点的SOA、配置的NS、DNSKEY和NSEC3PARAM由服务生成,
+// 其余记录按客户端地址选择view,去掉不健康的地址后再按权重选择和应答策略排列
+func lookup(cluster string, q dns.Question, c *client) (records []dns.RR) {
+	if zone, ok := config.FindZone(cluster, q.Name); ok && dns.CanonicalName(q.Name) == zone.Name {
+		if rrs, ok := config.ZoneApex(cluster, zone, q.Qtype); ok {
+			return rrs
+		}
+		if s := getSigner(zone); s != nil {
+			if q.Qtype == dns.TypeDNSKEY {
+				return s.keys
+			}
+			if q.Qtype == dns.TypeNSEC3PARAM && s.mode == config.DenialNsec3 {
+				return []dns.RR{s.nsec3param()}
+			}
+		}
+	}
+	key := config.RecordKey(cluster, q.Qtype, q.Name)
+	rrs := filterHealthy(cluster, q.Name, c.selectView(cluster, config.GetDnsRecords(key)))
+	for _, r := range applyWeights(cluster, q.Name, rrs) {
+		records = append(records, r.DnsRR)
+	}
+	return orderAnswers(cluster, key, q, records, c)
+}
+
+// negative 为zone内没有记录的问题设置否定应答:名称不存在时返回NXDOMAIN,
+// 并在授权部分附带SOA,ttl取SOA的ttl和minttl中较小的值(RFC 2308)
+func negative(cluster string, msg *dns.Msg) {
+	if len(msg.Question) != 1 {
+		return
+	}
+	q := msg.Question[0]
+	zone, ok := config.FindZone(cluster, q.Name)
+	if !ok {
+		return
+	}
+	soa, ok := config.ZoneSOA(cluster, zone.Name)
+	if !ok {
+		return
+	}
+	soa.Hdr.Ttl = min(soa.Hdr.Ttl, soa.Minttl)
+	msg.Ns = []dns.RR{soa}
+	if !config.ZoneNameExists(cluster, zone.Name, q.Name) {
+		msg.Rcode = dns.RcodeNameError
+	}
+}
+
+func packMsg(msg *dns.Msg) (resp *pb.DnsPacket, err error) {
 	responseBytes, err := msg.Pack()
 	if err != nil {
-		log.Fatalf("Error packing DNS response: %v", err)
+		log.Printf("Error packing DNS response: %v", err)
 		return resp, nil
 	}
 	resp = new(pb.DnsPacket)
 	resp.Msg = responseBytes
 	return resp, nil
 }
+
+// authorize 校验集群的认证token,集群未配置token时不校验
+func authorize(me metadata.MD, cluster string) error {
+	if token, ok := config.GetConfig().AuthTokens[cluster]; ok && token != "" && firstMD(me, "token") != token {
+		return status.Errorf(codes.Unauthenticated, "invalid token for cluster %s", cluster)
+	}
+	return nil
+}
+
+// firstMD 返回元数据中key对应的第一个值,不存在时返回空字符串
+func firstMD(md metadata.MD, key string) string {
+	if v := md.Get(key); len(v) > 0 {
+		return v[0]
+	}
+	return ""
+}
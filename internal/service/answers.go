@@ -0,0 +1,95 @@
+package service
+
+import (
+	"dnsadminserver/internal/config"
+	"hash/fnv"
+	"math/rand"
+	"sync"
+	"sync/atomic"
+
+	"github.com/miekg/dns"
+)
+
+// answerPolicy 决定多条记录在应答中的顺序,与forward插件选择上游的Policy相同的思路
+type answerPolicy interface {
+	List(key string, rrs []dns.RR, c *client) []dns.RR
+	String() string
+}
+
+// sequential 保持记录的顺序
+type sequential struct{}
+
+func (s *sequential) String() string { return config.AnswerSequential }
+
+func (s *sequential) List(key string, rrs []dns.RR, c *client) []dns.RR { return rrs }
+
+// roundRobin 每个 集群-类型-域名 单独计数,每次查询轮换第一条记录
+type roundRobin struct {
+	robins sync.Map // key -> *uint32
+}
+
+func (r *roundRobin) String() string { return config.AnswerRoundRobin }
+
+func (r *roundRobin) List(key string, rrs []dns.RR, c *client) []dns.RR {
+	v, _ := r.robins.LoadOrStore(key, new(uint32))
+	i := atomic.AddUint32(v.(*uint32), 1) % uint32(len(rrs))
+	return rotate(rrs, int(i))
+}
+
+// random 随机排序
+type random struct{}
+
+func (r *random) String() string { return config.AnswerRandom }
+
+func (r *random) List(key string, rrs []dns.RR, c *client) []dns.RR {
+	out := make([]dns.RR, len(rrs))
+	for i, p := range rand.Perm(len(rrs)) {
+		out[i] = rrs[p]
+	}
+	return out
+}
+
+// sticky 按客户端地址的哈希轮换,同一客户端总是得到相同的第一条记录
+type sticky struct{}
+
+func (s *sticky) String() string { return config.AnswerSticky }
+
+func (s *sticky) List(key string, rrs []dns.RR, c *client) []dns.RR {
+	if c == nil || c.ip == nil {
+		return rrs
+	}
+	h := fnv.New32a()
+	h.Write(c.ip)
+	h.Write([]byte(key))
+	return rotate(rrs, int(h.Sum32()%uint32(len(rrs))))
+}
+
+func rotate(rrs []dns.RR, i int) []dns.RR {
+	out := make([]dns.RR, 0, len(rrs))
+	out = append(out, rrs[i:]...)
+	return append(out, rrs[:i]...)
+}
+
+var answerPolicies = map[string]answerPolicy{
+	"":                      &sequential{},
+	config.AnswerSequential: &sequential{},
+	config.AnswerRoundRobin: &roundRobin{},
+	config.AnswerRandom:     &random{},
+	config.AnswerSticky:     &sticky{},
+}
+
+// orderAnswers 按集群或域名配置的策略排列记录,max大于0时只返回前max条。
+// 域名配置了按权重选择时已经确定了顺序,不再排列
+func orderAnswers(cluster, key string, q dns.Question, rrs []dns.RR, c *client) []dns.RR {
+	if len(rrs) < 2 {
+		return rrs
+	}
+	p := config.AnswerPolicy(cluster, q.Name)
+	if config.WeightMode(cluster, q.Name) == config.WeightAll {
+		rrs = answerPolicies[p.Policy].List(key, rrs, c)
+	}
+	if p.Max > 0 && len(rrs) > p.Max {
+		rrs = rrs[:p.Max]
+	}
+	return rrs
+}
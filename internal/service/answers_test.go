@@ -0,0 +1,111 @@
+package service
+
+import (
+	"fmt"
+	"net"
+	"testing"
+
+	"dnsadminserver/internal/config"
+
+	"github.com/miekg/dns"
+)
+
+// setAnswersConfig 配置c1的应答策略:集群使用round_robin,sticky.example.com.使用sticky,
+// max.example.com.只返回2条,weighted.example.com.按权重选择
+func setAnswersConfig() {
+	config.SetForTest(config.AppConfig{
+		AnswerPolicies: map[string]config.AnswerPolicyConfig{
+			"c1": {Policy: config.AnswerRoundRobin, Names: map[string]config.AnswerPolicyConfig{
+				"Sticky.example.com.": {Policy: config.AnswerSticky},
+				"max.example.com.":    {Max: 2},
+			}},
+		},
+		Weights: map[string]map[string]string{"c1": {"weighted.example.com.": config.WeightShuffle}},
+	}, nil)
+}
+
+func answerRRs(n int) (rrs []dns.RR) {
+	for i := 0; i < n; i++ {
+		rrs = append(rrs, mustRR(fmt.Sprintf("www.example.com. 60 IN A 10.0.0.%d", i+1)))
+	}
+	return
+}
+
+func first(rrs []dns.RR) string { return rrs[0].(*dns.A).A.String() }
+
+func answerQuestion(name string) dns.Question {
+	return dns.Question{Name: name, Qtype: dns.TypeA, Qclass: dns.ClassINET}
+}
+
+func TestOrderAnswersRoundRobin(t *testing.T) {
+	setAnswersConfig()
+	rrs := answerRRs(3)
+	q := answerQuestion("www.example.com.")
+	key := config.RecordKey("c1", dns.TypeA, q.Name)
+	seen := map[string]int{}
+	for i := 0; i < 6; i++ {
+		out := orderAnswers("c1", key, q, rrs, nil)
+		if len(out) != 3 {
+			t.Fatalf("got %d records, want 3", len(out))
+		}
+		seen[first(out)]++
+	}
+	for _, rr := range rrs {
+		if n := seen[first([]dns.RR{rr})]; n != 2 {
+			t.Errorf("%v was first %d times, want 2", rr, n)
+		}
+	}
+	// 其他集群没有配置策略,保持顺序
+	for i := 0; i < 3; i++ {
+		if out := orderAnswers("c2", key, q, rrs, nil); first(out) != "10.0.0.1" {
+			t.Errorf("c2: got %v first, want the original order", out[0])
+		}
+	}
+}
+
+func TestOrderAnswersSticky(t *testing.T) {
+	setAnswersConfig()
+	rrs := answerRRs(4)
+	q := answerQuestion("sticky.example.com.")
+	key := config.RecordKey("c1", dns.TypeA, q.Name)
+	firsts := map[string]bool{}
+	for i := 0; i < 32; i++ {
+		c := &client{ip: net.IPv4(10, 1, 0, byte(i))}
+		want := first(orderAnswers("c1", key, q, rrs, c))
+		// 同一客户端总是得到相同的顺序
+		for j := 0; j < 3; j++ {
+			if got := first(orderAnswers("c1", key, q, rrs, c)); got != want {
+				t.Fatalf("client %s: got %s first, then %s", c.ip, want, got)
+			}
+		}
+		firsts[want] = true
+	}
+	if len(firsts) < 2 {
+		t.Errorf("all clients got the same first record: %v", firsts)
+	}
+	// 没有客户端地址时保持顺序
+	if out := orderAnswers("c1", key, q, rrs, nil); first(out) != "10.0.0.1" {
+		t.Errorf("without a client got %v first, want the original order", out[0])
+	}
+}
+
+func TestOrderAnswersMax(t *testing.T) {
+	setAnswersConfig()
+	q := answerQuestion("MAX.example.com.")
+	key := config.RecordKey("c1", dns.TypeA, q.Name)
+	if out := orderAnswers("c1", key, q, answerRRs(5), nil); len(out) != 2 || first(out) != "10.0.0.1" {
+		t.Errorf("got %v, want the first 2 records", out)
+	}
+	if out := orderAnswers("c1", key, q, answerRRs(1), nil); len(out) != 1 {
+		t.Errorf("got %d records, want 1", len(out))
+	}
+
+	// 按权重选择的域名保持选择的顺序
+	q = answerQuestion("weighted.example.com.")
+	key = config.RecordKey("c1", dns.TypeA, q.Name)
+	for i := 0; i < 3; i++ {
+		if out := orderAnswers("c1", key, q, answerRRs(3), nil); first(out) != "10.0.0.1" {
+			t.Errorf("weighted name: got %v first, want the weighted order", out[0])
+		}
+	}
+}
@@ -0,0 +1,438 @@
+package service
+
+import (
+	"crypto"
+	"dnsadminserver/internal/config"
+	"encoding/base32"
+	"fmt"
+	"log"
+	"os"
+	"reflect"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/miekg/dns"
+)
+
+const (
+	sigInception = time.Hour          // 签名起始时间提前,容忍客户端时钟偏差
+	sigValidity  = 7 * 24 * time.Hour // 签名有效期
+	sigRefresh   = 24 * time.Hour     // 缓存的签名剩余有效期小于该值时重新签名
+	sigCacheSize = 10000
+)
+
+var nsec3Hex = base32.HexEncoding.WithPadding(base32.NoPadding)
+
+type signingKey struct {
+	key    *dns.DNSKEY
+	signer crypto.Signer
+}
+
+// zoneSigner 对zone的应答在线签名,并生成否定应答的不存在证明
+type zoneSigner struct {
+	zone string
+	mode string // 不存在证明的方式
+	ksk  signingKey
+	zsk  signingKey
+	keys []dns.RR // DNSKEY记录
+
+	mu    sync.Mutex
+	cache map[string]*dns.RRSIG // 记录集合 -> 签名
+}
+
+var signers = struct {
+	sync.Mutex
+	m map[string]*zoneSigner // 加载失败的zone保存nil,配置变化后重新加载
+}{m: map[string]*zoneSigner{}}
+
+func init() {
+	config.OnReload(func(old, new config.AppConfig) {
+		if !reflect.DeepEqual(old.Zones, new.Zones) {
+			signers.Lock()
+			signers.m = map[string]*zoneSigner{}
+			signers.Unlock()
+		}
+	})
+}
+
+// getSigner 返回zone的签名器,zone没有配置密钥或密钥加载失败时返回nil
+func getSigner(zone config.ZoneConfig) *zoneSigner {
+	if len(zone.DnssecKeys) == 0 {
+		return nil
+	}
+	key := zone.Cluster + "/" + zone.Name
+	signers.Lock()
+	defer signers.Unlock()
+	if s, ok := signers.m[key]; ok {
+		return s
+	}
+	s, err := loadSigner(zone)
+	if err != nil {
+		log.Println("dnssec.go: getSigner() error: ", "加载DNSSEC密钥失败,不签名", zone.Name, err)
+	}
+	signers.m[key] = s
+	return s
+}
+
+func loadSigner(zone config.ZoneConfig) (*zoneSigner, error) {
+	s := &zoneSigner{zone: zone.Name, mode: zone.Denial, cache: map[string]*dns.RRSIG{}}
+	if s.mode == "" {
+		s.mode = config.DenialBlackLies
+	}
+	for _, path := range zone.DnssecKeys {
+		k, err := readKey(path)
+		if err != nil {
+			return nil, err
+		}
+		if dns.CanonicalName(k.key.Hdr.Name) != zone.Name {
+			return nil, fmt.Errorf("密钥 %s 不属于zone %s", path, zone.Name)
+		}
+		s.keys = append(s.keys, k.key)
+		if k.key.Flags&dns.SEP != 0 {
+			s.ksk = k
+		} else {
+			s.zsk = k
+		}
+	}
+	// 只有一个密钥时同时作为KSK和ZSK使用
+	if s.zsk.key == nil {
+		s.zsk = s.ksk
+	}
+	if s.ksk.key == nil {
+		s.ksk = s.zsk
+	}
+	if s.zsk.key == nil {
+		return nil, fmt.Errorf("没有可用的密钥")
+	}
+	return s, nil
+}
+
+// readKey 读取BIND格式的密钥文件 path.key 和 path.private
+func readKey(path string) (k signingKey, err error) {
+	f, err := os.Open(path + ".key")
+	if err != nil {
+		return k, err
+	}
+	defer f.Close()
+	rr, err := dns.ReadRR(f, path+".key")
+	if err != nil {
+		return k, err
+	}
+	key, ok := rr.(*dns.DNSKEY)
+	if !ok {
+		return k, fmt.Errorf("%s.key 不是DNSKEY记录", path)
+	}
+	pf, err := os.Open(path + ".private")
+	if err != nil {
+		return k, err
+	}
+	defer pf.Close()
+	priv, err := key.ReadPrivateKey(pf, path+".private")
+	if err != nil {
+		return k, err
+	}
+	signer, ok := priv.(crypto.Signer)
+	if !ok {
+		return k, fmt.Errorf("%s.private 的密钥不能用于签名", path)
+	}
+	return signingKey{key: key, signer: signer}, nil
+}
+
+// sign 对记录集合签名,DNSKEY使用KSK,其余使用ZSK。签名在有效期内时使用缓存
+func (s *zoneSigner) sign(rrset []dns.RR) (*dns.RRSIG, error) {
+	k := s.zsk
+	if rrset[0].Header().Rrtype == dns.TypeDNSKEY {
+		k = s.ksk
+	}
+	strs := make([]string, len(rrset))
+	for i, rr := range rrset {
+		strs[i] = rr.String()
+	}
+	sort.Strings(strs)
+	cacheKey := fmt.Sprint(k.key.KeyTag()) + "\n" + strings.Join(strs, "\n")
+
+	now := time.Now()
+	s.mu.Lock()
+	sig, ok := s.cache[cacheKey]
+	s.mu.Unlock()
+	if ok && time.Unix(int64(sig.Expiration), 0).Sub(now) > sigRefresh {
+		return sig, nil
+	}
+
+	hdr := rrset[0].Header()
+	sig = &dns.RRSIG{
+		Hdr:        dns.RR_Header{Name: hdr.Name, Rrtype: dns.TypeRRSIG, Class: dns.ClassINET, Ttl: hdr.Ttl},
+		KeyTag:     k.key.KeyTag(),
+		SignerName: s.zone,
+		Algorithm:  k.key.Algorithm,
+		Inception:  uint32(now.Add(-sigInception).Unix()),
+		Expiration: uint32(now.Add(sigValidity).Unix()),
+	}
+	if err := sig.Sign(k.signer, rrset); err != nil {
+		return nil, err
+	}
+	s.mu.Lock()
+	if len(s.cache) >= sigCacheSize {
+		s.cache = map[string]*dns.RRSIG{}
+	}
+	s.cache[cacheKey] = sig
+	s.mu.Unlock()
+	return sig, nil
+}
+
+// signSection 在每个属于zone的记录集合后加上签名
+func (s *zoneSigner) signSection(rrs []dns.RR) []dns.RR {
+	type setKey struct {
+		name  string
+		qtype uint16
+	}
+	var order []setKey
+	sets := map[setKey][]dns.RR{}
+	var other []dns.RR
+	for _, rr := range rrs {
+		h := rr.Header()
+		if h.Rrtype == dns.TypeRRSIG || h.Rrtype == dns.TypeOPT || !dns.IsSubDomain(s.zone, h.Name) {
+			other = append(other, rr)
+			continue
+		}
+		k := setKey{dns.CanonicalName(h.Name), h.Rrtype}
+		if _, ok := sets[k]; !ok {
+			order = append(order, k)
+		}
+		sets[k] = append(sets[k], rr)
+	}
+	out := make([]dns.RR, 0, len(rrs)+len(order))
+	for _, k := range order {
+		out = append(out, sets[k]...)
+		sig, err := s.sign(sets[k])
+		if err != nil {
+			log.Println("dnssec.go: signSection() error: ", k.name, err)
+			continue
+		}
+		out = append(out, sig)
+	}
+	return append(out, other...)
+}
+
+// denial 返回否定应答的不存在证明记录和应答的rcode,qname已转换为小写
+func (s *zoneSigner) denial(cluster string, zone config.ZoneConfig, qname string, rcode int, ttl uint32) ([]dns.RR, int) {
+	switch s.mode {
+	case config.DenialNsec3:
+		if rcode == dns.RcodeNameError {
+			ce := closestEncloser(cluster, zone.Name, qname)
+			nc := nextCloser(qname, ce)
+			hce := dns.HashName(ce, dns.SHA1, 0, "")
+			hnc := dns.HashName(nc, dns.SHA1, 0, "")
+			hwc := dns.HashName("*."+ce, dns.SHA1, 0, "")
+			rrs := []dns.RR{
+				s.nsec3(hce, hashAdd(hce, 1), typesAt(cluster, zone, ce), ttl),
+				s.nsec3(hashAdd(hnc, -1), hashAdd(hnc, 1), nil, ttl),
+			}
+			if hwc != hnc {
+				rrs = append(rrs, s.nsec3(hashAdd(hwc, -1), hashAdd(hwc, 1), nil, ttl))
+			}
+			return rrs, rcode
+		}
+		h := dns.HashName(qname, dns.SHA1, 0, "")
+		return []dns.RR{s.nsec3(h, hashAdd(h, 1), typesAt(cluster, zone, qname), ttl)}, rcode
+	case config.DenialNsec:
+		if rcode == dns.RcodeNameError {
+			ce := closestEncloser(cluster, zone.Name, qname)
+			wc := "*." + ce
+			rrs := []dns.RR{nsec(predecessor(qname, ce), "\\000."+qname, nil, ttl)}
+			if !dns.IsSubDomain(wc, qname) {
+				rrs = append(rrs, nsec(predecessor(wc, ce), "\\000."+wc, nil, ttl))
+			}
+			return rrs, rcode
+		}
+		return []dns.RR{nsec(qname, "\\000."+qname, typesAt(cluster, zone, qname), ttl)}, rcode
+	default:
+		// black lies: 不存在的名称也返回NODATA,只需要一条NSEC,不泄露zone的内容
+		types := typesAt(cluster, zone, qname)
+		return []dns.RR{nsec(qname, "\\000."+qname, types, ttl)}, dns.RcodeSuccess
+	}
+}
+
+func nsec(owner, next string, types []uint16, ttl uint32) *dns.NSEC {
+	types = append(types, dns.TypeRRSIG, dns.TypeNSEC)
+	sort.Slice(types, func(i, j int) bool { return types[i] < types[j] })
+	return &dns.NSEC{
+		Hdr:        dns.RR_Header{Name: owner, Rrtype: dns.TypeNSEC, Class: dns.ClassINET, Ttl: ttl},
+		NextDomain: next,
+		TypeBitMap: dedupTypes(types),
+	}
+}
+
+func (s *zoneSigner) nsec3(ownerHash, nextHash string, types []uint16, ttl uint32) *dns.NSEC3 {
+	if len(types) > 0 {
+		types = append(types, dns.TypeRRSIG)
+	}
+	sort.Slice(types, func(i, j int) bool { return types[i] < types[j] })
+	return &dns.NSEC3{
+		Hdr:        dns.RR_Header{Name: strings.ToLower(ownerHash) + "." + s.zone, Rrtype: dns.TypeNSEC3, Class: dns.ClassINET, Ttl: ttl},
+		Hash:       dns.SHA1,
+		HashLength: 20,
+		NextDomain: nextHash,
+		TypeBitMap: dedupTypes(types),
+	}
+}
+
+// nsec3param 返回zone顶点的NSEC3PARAM,参数和nsec3生成的记录相同:SHA1、不迭代、没有salt
+func (s *zoneSigner) nsec3param() *dns.NSEC3PARAM {
+	return &dns.NSEC3PARAM{
+		Hdr:  dns.RR_Header{Name: s.zone, Rrtype: dns.TypeNSEC3PARAM, Class: dns.ClassINET, Ttl: s.keys[0].Header().Ttl},
+		Hash: dns.SHA1,
+	}
+}
+
+func dedupTypes(types []uint16) []uint16 {
+	out := types[:0]
+	for i, t := range types {
+		if i == 0 || t != types[i-1] {
+			out = append(out, t)
+		}
+	}
+	return out
+}
+
+// typesAt 返回名称下存在的记录类型,包括zone顶点由服务生成的记录
+func typesAt(cluster string, zone config.ZoneConfig, name string) []uint16 {
+	types := nameTypes(cluster, name)
+	if name == zone.Name {
+		types = append(types, dns.TypeSOA, dns.TypeDNSKEY)
+		if zone.Denial == config.DenialNsec3 {
+			types = append(types, dns.TypeNSEC3PARAM)
+		}
+		if len(zone.Ns) > 0 {
+			types = append(types, dns.TypeNS)
+		}
+	}
+	return types
+}
+
+// closestEncloser 返回qname在zone中存在的最近的祖先
+func closestEncloser(cluster, zone, qname string) string {
+	name := qname
+	for name != zone && dns.CountLabel(name) > dns.CountLabel(zone) {
+		i, _ := dns.NextLabel(name, 0)
+		name = name[i:]
+		if config.ZoneNameExists(cluster, zone, name) {
+			return name
+		}
+	}
+	return zone
+}
+
+// nextCloser 返回qname中比ce多一个标签的祖先
+func nextCloser(qname, ce string) string {
+	labels := dns.SplitDomainName(qname)
+	n := dns.CountLabel(ce) + 1
+	return dns.Fqdn(strings.Join(labels[len(labels)-n:], "."))
+}
+
+// predecessor 返回规范顺序中略小于name的名称,用于构造只覆盖name的NSEC(RFC 4470)。
+// 修改第一个标签:最后一个字节减一后追加\255;无法构造时返回ce
+func predecessor(name, ce string) string {
+	labels := dns.SplitDomainName(name)
+	if len(labels) == 0 {
+		return ce
+	}
+	b := unescapeLabel(labels[0])
+	if len(b) == 0 {
+		return ce
+	}
+	if last := b[len(b)-1]; last == 0 {
+		b = b[:len(b)-1]
+	} else {
+		last--
+		// 规范顺序不区分大小写,大写字母按小写比较
+		if last >= 'A' && last <= 'Z' {
+			last = '@'
+		}
+		b[len(b)-1] = last
+		if len(b) < 63 {
+			b = append(b, 0xff)
+		}
+	}
+	if len(b) == 0 {
+		return dns.Fqdn(strings.Join(labels[1:], "."))
+	}
+	return dns.Fqdn(strings.Join(append([]string{escapeLabel(b)}, labels[1:]...), "."))
+}
+
+func unescapeLabel(s string) []byte {
+	var b []byte
+	for i := 0; i < len(s); i++ {
+		if s[i] == '\\' && i+3 < len(s) && isDigit(s[i+1]) && isDigit(s[i+2]) && isDigit(s[i+3]) {
+			b = append(b, (s[i+1]-'0')*100+(s[i+2]-'0')*10+(s[i+3]-'0'))
+			i += 3
+			continue
+		}
+		if s[i] == '\\' && i+1 < len(s) {
+			i++
+		}
+		b = append(b, s[i])
+	}
+	return b
+}
+
+func escapeLabel(b []byte) string {
+	var sb strings.Builder
+	for _, c := range b {
+		if c >= 'a' && c <= 'z' || c >= '0' && c <= '9' || c == '-' || c == '_' {
+			sb.WriteByte(c)
+		} else {
+			fmt.Fprintf(&sb, "\\%03d", c)
+		}
+	}
+	return sb.String()
+}
+
+func isDigit(c byte) bool { return c >= '0' && c <= '9' }
+
+// hashAdd 对NSEC3的base32hex哈希加上delta(±1),用于构造只覆盖一个哈希的NSEC3
+func hashAdd(hash string, delta int) string {
+	b, err := nsec3Hex.DecodeString(strings.ToUpper(hash))
+	if err != nil {
+		return hash
+	}
+	for i := len(b) - 1; i >= 0; i-- {
+		if delta > 0 {
+			b[i]++
+			if b[i] != 0 {
+				break
+			}
+		} else {
+			b[i]--
+			if b[i] != 0xff {
+				break
+			}
+		}
+	}
+	return nsec3Hex.EncodeToString(b)
+}
+
+// signResponse 对设置了DO位的查询的应答签名,否定应答加上不存在证明
+func signResponse(cluster string, msg *dns.Msg) {
+	if len(msg.Question) != 1 {
+		return
+	}
+	q := msg.Question[0]
+	zone, ok := config.FindZone(cluster, q.Name)
+	if !ok {
+		return
+	}
+	s := getSigner(zone)
+	if s == nil {
+		return
+	}
+	if len(msg.Answer) == 0 && len(msg.Ns) > 0 && msg.Ns[0].Header().Rrtype == dns.TypeSOA {
+		rrs, rcode := s.denial(cluster, zone, dns.CanonicalName(q.Name), msg.Rcode, msg.Ns[0].Header().Ttl)
+		msg.Ns = append(msg.Ns, rrs...)
+		msg.Rcode = rcode
+	}
+	msg.Answer = s.signSection(msg.Answer)
+	msg.Ns = s.signSection(msg.Ns)
+}
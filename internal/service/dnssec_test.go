@@ -0,0 +1,353 @@
+package service
+
+import (
+	"bytes"
+	"context"
+	"crypto"
+	"strings"
+	"testing"
+	"time"
+
+	"dnsadminserver/internal/config"
+	"dnsadminserver/internal/models"
+
+	"github.com/coredns/coredns/pb"
+	"github.com/miekg/dns"
+	"google.golang.org/grpc/metadata"
+)
+
+// setDnssecConfig 配置c1中的签名zone example.com.,使用生成的密钥,返回zone的签名器
+func setDnssecConfig(t *testing.T, mode string) *zoneSigner {
+	t.Helper()
+	zone := config.ZoneConfig{Cluster: "c1", Name: "example.com.", DnssecKeys: []string{"generated"}, Denial: mode}
+	config.SetForTest(config.AppConfig{Zones: []config.ZoneConfig{zone}}, []models.DnsRecords{
+		{Id: 1, ClusterName: "c1", Name: "www.example.com.", Qtype: dns.TypeA, Qclass: 1, Ttl: 60, Rdata: "10.0.0.1", Weight: 1},
+		{Id: 2, ClusterName: "c1", Name: "www.example.com.", Qtype: dns.TypeA, Qclass: 1, Ttl: 60, Rdata: "10.0.0.2", Weight: 1},
+		{Id: 3, ClusterName: "c1", Name: "a.b.example.com.", Qtype: dns.TypeTXT, Qclass: 1, Ttl: 60, Rdata: "hello", Weight: 1},
+	})
+	key := &dns.DNSKEY{
+		Hdr:       dns.RR_Header{Name: zone.Name, Rrtype: dns.TypeDNSKEY, Class: dns.ClassINET, Ttl: 3600},
+		Flags:     dns.ZONE | dns.SEP,
+		Protocol:  3,
+		Algorithm: dns.ECDSAP256SHA256,
+	}
+	priv, err := key.Generate(256)
+	if err != nil {
+		t.Fatal(err)
+	}
+	k := signingKey{key: key, signer: priv.(crypto.Signer)}
+	s := &zoneSigner{zone: zone.Name, mode: mode, ksk: k, zsk: k, keys: []dns.RR{key}, cache: map[string]*dns.RRSIG{}}
+	signers.Lock()
+	signers.m = map[string]*zoneSigner{"c1/example.com.": s}
+	signers.Unlock()
+	t.Cleanup(func() {
+		signers.Lock()
+		signers.m = map[string]*zoneSigner{}
+		signers.Unlock()
+	})
+	return s
+}
+
+// queryDo 发送设置了DO位的查询,返回应答
+func queryDo(t *testing.T, name string, qtype uint16) *dns.Msg {
+	t.Helper()
+	req := new(dns.Msg)
+	req.SetQuestion(name, qtype)
+	req.SetEdns0(4096, true)
+	buf, err := req.Pack()
+	if err != nil {
+		t.Fatal(err)
+	}
+	ctx := metadata.NewIncomingContext(context.Background(), metadata.Pairs("cluster", "c1"))
+	resp, err := (&DnsServiceServer{}).Query(ctx, &pb.DnsPacket{Msg: buf})
+	if err != nil {
+		t.Fatal(err)
+	}
+	m := new(dns.Msg)
+	if err := m.Unpack(resp.Msg); err != nil {
+		t.Fatal(err)
+	}
+	return m
+}
+
+// verifySection 校验每个记录集合都有有效的签名
+func verifySection(t *testing.T, s *zoneSigner, rrs []dns.RR) {
+	t.Helper()
+	sets := map[[2]string][]dns.RR{}
+	for _, rr := range rrs {
+		if rr.Header().Rrtype != dns.TypeRRSIG {
+			k := [2]string{rr.Header().Name, dns.TypeToString[rr.Header().Rrtype]}
+			sets[k] = append(sets[k], rr)
+		}
+	}
+	for _, rr := range rrs {
+		sig, ok := rr.(*dns.RRSIG)
+		if !ok {
+			continue
+		}
+		k := [2]string{sig.Hdr.Name, dns.TypeToString[sig.TypeCovered]}
+		if err := sig.Verify(s.zsk.key, sets[k]); err != nil {
+			t.Errorf("RRSIG for %v does not verify: %v", k, err)
+		}
+		if !sig.ValidityPeriod(time.Now()) {
+			t.Errorf("RRSIG for %v is not valid now", k)
+		}
+		delete(sets, k)
+	}
+	for k := range sets {
+		t.Errorf("%v is not signed", k)
+	}
+}
+
+func ofType[T dns.RR](rrs []dns.RR) (out []T) {
+	for _, rr := range rrs {
+		if v, ok := rr.(T); ok {
+			out = append(out, v)
+		}
+	}
+	return
+}
+
+// canonicalLess 按规范顺序(RFC 4034 6.1)比较名称
+func canonicalLess(a, b string) bool {
+	la, lb := dns.SplitDomainName(a), dns.SplitDomainName(b)
+	for i, j := len(la)-1, len(lb)-1; i >= 0 && j >= 0; i, j = i-1, j-1 {
+		x := bytes.ToLower(unescapeLabel(la[i]))
+		y := bytes.ToLower(unescapeLabel(lb[j]))
+		if c := bytes.Compare(x, y); c != 0 {
+			return c < 0
+		}
+	}
+	return len(la) < len(lb)
+}
+
+// coveredByNsec 返回覆盖name的NSEC,不存在时返回nil
+func coveredByNsec(nsecs []*dns.NSEC, name string) *dns.NSEC {
+	for _, n := range nsecs {
+		if canonicalLess(n.Hdr.Name, name) && canonicalLess(name, n.NextDomain) {
+			return n
+		}
+	}
+	return nil
+}
+
+// coveredByNsec3 返回覆盖name的哈希的NSEC3,不存在时返回nil
+func coveredByNsec3(nsec3s []*dns.NSEC3, name string) *dns.NSEC3 {
+	h := strings.ToUpper(dns.HashName(name, dns.SHA1, 0, ""))
+	for _, n := range nsec3s {
+		owner := strings.ToUpper(dns.SplitDomainName(n.Hdr.Name)[0])
+		if owner < h && h < strings.ToUpper(n.NextDomain) {
+			return n
+		}
+	}
+	return nil
+}
+
+func hasType(types []uint16, t uint16) bool {
+	for _, v := range types {
+		if v == t {
+			return true
+		}
+	}
+	return false
+}
+
+func TestSignPositive(t *testing.T) {
+	s := setDnssecConfig(t, config.DenialBlackLies)
+	m := queryDo(t, "www.example.com.", dns.TypeA)
+	if len(ofType[*dns.A](m.Answer)) != 2 || len(ofType[*dns.RRSIG](m.Answer)) != 1 {
+		t.Fatalf("answer %v, want 2 A records and 1 RRSIG", m.Answer)
+	}
+	verifySection(t, s, m.Answer)
+
+	m = queryDo(t, "example.com.", dns.TypeDNSKEY)
+	if len(ofType[*dns.DNSKEY](m.Answer)) != 1 {
+		t.Fatalf("answer %v, want the DNSKEY", m.Answer)
+	}
+	verifySection(t, s, m.Answer)
+
+	// 没有设置DO位时不签名
+	req := new(dns.Msg)
+	req.SetQuestion("www.example.com.", dns.TypeA)
+	msg := new(dns.Msg)
+	msg.SetReply(req)
+	msg.Answer = lookup("c1", req.Question[0], nil)
+	if len(ofType[*dns.RRSIG](msg.Answer)) != 0 {
+		t.Error("lookup returned signatures")
+	}
+}
+
+func TestDenialBlackLies(t *testing.T) {
+	s := setDnssecConfig(t, config.DenialBlackLies)
+
+	// 不存在的名称返回NODATA,NSEC只有RRSIG和NSEC
+	m := queryDo(t, "nope.example.com.", dns.TypeA)
+	if m.Rcode != dns.RcodeSuccess || len(m.Answer) != 0 {
+		t.Fatalf("got %s with %d answers, want NODATA", dns.RcodeToString[m.Rcode], len(m.Answer))
+	}
+	nsecs := ofType[*dns.NSEC](m.Ns)
+	if len(nsecs) != 1 || nsecs[0].Hdr.Name != "nope.example.com." {
+		t.Fatalf("got NSEC %v, want one NSEC for nope.example.com.", nsecs)
+	}
+	if bm := nsecs[0].TypeBitMap; len(bm) != 2 || bm[0] != dns.TypeRRSIG || bm[1] != dns.TypeNSEC {
+		t.Errorf("got type bitmap %v, want RRSIG NSEC", bm)
+	}
+	verifySection(t, s, m.Ns)
+
+	// 存在的名称的NSEC包含名称下的类型
+	m = queryDo(t, "www.example.com.", dns.TypeAAAA)
+	nsecs = ofType[*dns.NSEC](m.Ns)
+	if len(nsecs) != 1 || !hasType(nsecs[0].TypeBitMap, dns.TypeA) || hasType(nsecs[0].TypeBitMap, dns.TypeAAAA) {
+		t.Errorf("got NSEC %v, want A and no AAAA in the bitmap", nsecs)
+	}
+	verifySection(t, s, m.Ns)
+}
+
+func TestDenialNsec(t *testing.T) {
+	s := setDnssecConfig(t, config.DenialNsec)
+	m := queryDo(t, "x.nope.example.com.", dns.TypeA)
+	if m.Rcode != dns.RcodeNameError {
+		t.Fatalf("got %s, want NXDOMAIN", dns.RcodeToString[m.Rcode])
+	}
+	verifySection(t, s, m.Ns)
+	nsecs := ofType[*dns.NSEC](m.Ns)
+	if coveredByNsec(nsecs, "x.nope.example.com.") == nil {
+		t.Errorf("no NSEC in %v covers the qname", nsecs)
+	}
+	if coveredByNsec(nsecs, "*.example.com.") == nil {
+		t.Errorf("no NSEC in %v covers the wildcard", nsecs)
+	}
+	for _, name := range []string{"example.com.", "www.example.com.", "a.b.example.com.", "b.example.com."} {
+		if n := coveredByNsec(nsecs, name); n != nil {
+			t.Errorf("NSEC %v covers the existing name %s", n, name)
+		}
+	}
+
+	m = queryDo(t, "www.example.com.", dns.TypeAAAA)
+	nsecs = ofType[*dns.NSEC](m.Ns)
+	if m.Rcode != dns.RcodeSuccess || len(nsecs) != 1 || nsecs[0].Hdr.Name != "www.example.com." || !hasType(nsecs[0].TypeBitMap, dns.TypeA) {
+		t.Errorf("got %s with NSEC %v, want NODATA with the NSEC of www.example.com.", dns.RcodeToString[m.Rcode], nsecs)
+	}
+	verifySection(t, s, m.Ns)
+}
+
+func TestDenialNsec3(t *testing.T) {
+	s := setDnssecConfig(t, config.DenialNsec3)
+	m := queryDo(t, "x.y.a.b.example.com.", dns.TypeA)
+	if m.Rcode != dns.RcodeNameError {
+		t.Fatalf("got %s, want NXDOMAIN", dns.RcodeToString[m.Rcode])
+	}
+	verifySection(t, s, m.Ns)
+	nsec3s := ofType[*dns.NSEC3](m.Ns)
+	hce := strings.ToLower(dns.HashName("a.b.example.com.", dns.SHA1, 0, ""))
+	matched := false
+	for _, n := range nsec3s {
+		if n.Hdr.Name == hce+".example.com." && hasType(n.TypeBitMap, dns.TypeTXT) {
+			matched = true
+		}
+	}
+	if !matched {
+		t.Errorf("no NSEC3 in %v matches the closest encloser", nsec3s)
+	}
+	if coveredByNsec3(nsec3s, "y.a.b.example.com.") == nil {
+		t.Errorf("no NSEC3 in %v covers the next closer name", nsec3s)
+	}
+	if coveredByNsec3(nsec3s, "*.a.b.example.com.") == nil {
+		t.Errorf("no NSEC3 in %v covers the wildcard", nsec3s)
+	}
+
+	// zone顶点发布NSEC3PARAM,NSEC3的类型包含NSEC3PARAM
+	m = queryDo(t, "example.com.", dns.TypeNSEC3PARAM)
+	params := ofType[*dns.NSEC3PARAM](m.Answer)
+	if len(params) != 1 || params[0].Hash != dns.SHA1 || params[0].Iterations != 0 || params[0].SaltLength != 0 {
+		t.Fatalf("got %v, want NSEC3PARAM 1 0 0 -", m.Answer)
+	}
+	verifySection(t, s, m.Answer)
+	m = queryDo(t, "example.com.", dns.TypeA)
+	nsec3s = ofType[*dns.NSEC3](m.Ns)
+	if len(nsec3s) != 1 || !hasType(nsec3s[0].TypeBitMap, dns.TypeNSEC3PARAM) || !hasType(nsec3s[0].TypeBitMap, dns.TypeSOA) {
+		t.Errorf("got NSEC3 %v, want SOA and NSEC3PARAM in the bitmap of the apex", nsec3s)
+	}
+}
+
+func TestPredecessor(t *testing.T) {
+	tests := []struct {
+		name  string
+		below string // 略小于name、必须小于结果的名称,为空时不检查
+	}{
+		{"www.example.", "wwv.example."},
+		{"b.example.", "azzz.example."},
+		{"a0.example.", "a.example."},
+		{"x.y.example.", "w.y.example."},
+		{"\\000.example.", ""},
+		{"a\\000.example.", ""},
+	}
+	for _, tc := range tests {
+		p := predecessor(tc.name, "example.")
+		if !canonicalLess(p, tc.name) {
+			t.Errorf("predecessor(%s) = %s, not before the name", tc.name, p)
+		}
+		if tc.below != "" && !canonicalLess(tc.below, p) {
+			t.Errorf("predecessor(%s) = %s, not after %s", tc.name, p, tc.below)
+		}
+	}
+}
+
+func TestHashAdd(t *testing.T) {
+	h := dns.HashName("www.example.com.", dns.SHA1, 0, "")
+	up := hashAdd(h, 1)
+	if !(up > strings.ToUpper(h)) || hashAdd(up, -1) != strings.ToUpper(h) {
+		t.Errorf("hashAdd(%s, 1) = %s", h, up)
+	}
+	b := make([]byte, 20)
+	b[19] = 0xff
+	up = hashAdd(nsec3Hex.EncodeToString(b), 1)
+	if got, _ := nsec3Hex.DecodeString(up); got[18] != 1 || got[19] != 0 {
+		t.Errorf("hashAdd did not carry: %x", got)
+	}
+	if down := hashAdd(up, -1); down != nsec3Hex.EncodeToString(b) {
+		t.Errorf("hashAdd did not borrow: %s", down)
+	}
+}
+
+func TestClosestEncloser(t *testing.T) {
+	setDnssecConfig(t, config.DenialNsec3)
+	tests := []struct{ qname, ce, nc string }{
+		{"x.y.a.b.example.com.", "a.b.example.com.", "y.a.b.example.com."},
+		{"x.www.example.com.", "www.example.com.", "x.www.example.com."},
+		{"x.c.example.com.", "example.com.", "c.example.com."},
+		{"nope.example.com.", "example.com.", "nope.example.com."},
+	}
+	for _, tc := range tests {
+		ce := closestEncloser("c1", "example.com.", tc.qname)
+		if ce != tc.ce {
+			t.Errorf("closestEncloser(%s) = %s, want %s", tc.qname, ce, tc.ce)
+		}
+		if nc := nextCloser(tc.qname, ce); nc != tc.nc {
+			t.Errorf("nextCloser(%s, %s) = %s, want %s", tc.qname, ce, nc, tc.nc)
+		}
+	}
+}
+
+func TestSignCache(t *testing.T) {
+	s := setDnssecConfig(t, config.DenialNsec)
+	set := []dns.RR{mustRR("www.example.com. 60 IN A 10.0.0.1"), mustRR("www.example.com. 60 IN A 10.0.0.2")}
+	sig1, err := s.sign(set)
+	if err != nil {
+		t.Fatal(err)
+	}
+	// 记录顺序不影响缓存
+	sig2, _ := s.sign([]dns.RR{set[1], set[0]})
+	if sig1 != sig2 {
+		t.Error("the same rrset was signed twice")
+	}
+	other, _ := s.sign(set[:1])
+	if other == sig1 {
+		t.Error("a different rrset got the cached signature")
+	}
+	// 剩余有效期不足时重新签名
+	sig1.Expiration = uint32(time.Now().Add(sigRefresh / 2).Unix())
+	if sig3, _ := s.sign(set); sig3 == sig1 {
+		t.Error("a signature close to expiring was not refreshed")
+	}
+}
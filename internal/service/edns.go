@@ -0,0 +1,41 @@
+package service
+
+import (
+	"strings"
+
+	"github.com/miekg/dns"
+)
+
+const ednsSize = 4096 // 服务在应答中声明的EDNS缓冲区大小
+
+// edns 根据请求的OPT记录返回应答的OPT记录和应答允许的最大长度,请求没有OPT时opt为nil。
+// proto 为 CoreDNS 通过元数据传递的客户端传输协议,tcp 时不限制长度。
+// 请求的EDNS版本不支持时 badvers 为 true(RFC 6891 6.1.3)
+func edns(req *dns.Msg, proto string) (opt *dns.OPT, size int, badvers bool) {
+	size = dns.MinMsgSize
+	if strings.EqualFold(proto, "tcp") {
+		size = dns.MaxMsgSize
+	}
+	reqOpt := req.IsEdns0()
+	if reqOpt == nil {
+		return nil, size, false
+	}
+	opt = new(dns.OPT)
+	opt.Hdr.Name = "."
+	opt.Hdr.Rrtype = dns.TypeOPT
+	opt.SetUDPSize(ednsSize)
+	if reqOpt.Version() != 0 {
+		return opt, size, true
+	}
+	opt.SetDo(reqOpt.Do())
+	// 客户端的cookie原样返回,由CoreDNS处理服务端cookie
+	for _, o := range reqOpt.Option {
+		if o.Option() == dns.EDNS0COOKIE {
+			opt.Option = append(opt.Option, o)
+		}
+	}
+	if size < dns.MaxMsgSize {
+		size = max(int(reqOpt.UDPSize()), dns.MinMsgSize)
+	}
+	return opt, size, false
+}
@@ -0,0 +1,213 @@
+package service
+
+import (
+	"context"
+	"dnsadminserver/internal/config"
+	"dnsadminserver/internal/plugin/forward"
+	"encoding/json"
+	"log"
+	"net"
+	"reflect"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/coredns/coredns/plugin/metadata"
+	"github.com/coredns/coredns/request"
+	"github.com/miekg/dns"
+)
+
+// forwarder forwards或dns_forwards中一条规则对应的Forward
+type forwarder struct {
+	cluster string
+	from    string
+	key     string // 规则的json,规则不变时沿用原来的Forward
+	f       *forward.Forward
+	// inflight 正在使用f转发的查询,在forwarders的读锁内增加,替换后不会再增加
+	inflight *sync.WaitGroup
+}
+
+var forwarders struct {
+	sync.RWMutex
+	list []forwarder
+}
+
+// forwardersLock 保证配置热加载和数据库规则变化时依次重建
+var forwardersLock sync.Mutex
+
+func init() {
+	startForwarders(config.GetConfig().Forwards)
+	config.OnReload(func(old, new config.AppConfig) {
+		if !reflect.DeepEqual(old.Forwards, new.Forwards) {
+			startForwarders(new.Forwards)
+		}
+	})
+	config.OnForwardChange(func() {
+		startForwarders(config.GetConfig().Forwards)
+	})
+}
+
+// startForwarders 按配置文件和数据库中的规则重建Forward:没有变化的规则沿用原来的Forward,
+// 保留上游的健康状态和连接;删除的规则在替换后等正在转发的查询结束,再停止健康检查和连接
+func startForwarders(cfgs []config.ForwardConfig) {
+	forwardersLock.Lock()
+	defer forwardersLock.Unlock()
+	forwarders.RLock()
+	old := forwarders.list
+	forwarders.RUnlock()
+	existing := map[string]forwarder{}
+	for _, fw := range old {
+		existing[fw.key] = fw
+	}
+
+	var list []forwarder
+	used := map[*forward.Forward]bool{}
+	rules := append(append([]config.ForwardConfig{}, cfgs...), config.ForwardRules()...)
+	for _, c := range rules {
+		data, _ := json.Marshal(c)
+		key := string(data)
+		fw, ok := existing[key]
+		if !ok || used[fw.f] {
+			f, err := newForward(c)
+			if err != nil {
+				log.Println("forward.go: startForwarders() error: ", c.Cluster, c.From, err)
+				continue
+			}
+			f.OnStartup()
+			fw = forwarder{f: f, inflight: new(sync.WaitGroup)}
+		}
+		used[fw.f] = true
+		fw.cluster, fw.from, fw.key = c.Cluster, dns.CanonicalName(c.From), key
+		list = append(list, fw)
+	}
+	forwarders.Lock()
+	forwarders.list = list
+	forwarders.Unlock()
+	for _, fw := range old {
+		if !used[fw.f] {
+			// 停止后连接上游会一直阻塞,等正在转发的查询结束
+			go func(fw forwarder) {
+				fw.inflight.Wait()
+				fw.f.OnShutdown()
+			}(fw)
+			used[fw.f] = true
+		}
+	}
+}
+
+func newForward(c config.ForwardConfig) (*forward.Forward, error) {
+	maxFails := uint32(2)
+	if c.MaxFails != nil {
+		maxFails = *c.MaxFails
+	}
+	return forward.NewWithConfig(forward.Config{
+		From:          c.From,
+		To:            c.To,
+		Except:        c.Except,
+		Types:         c.Types,
+		AllowNets:     c.AllowNets,
+		DenyNets:      c.DenyNets,
+		Metadata:      c.Metadata,
+		Policy:        c.Policy,
+		Weights:       c.Weights,
+		MaxFails:      maxFails,
+		HealthCheck:   time.Duration(c.HealthCheck) * time.Millisecond,
+		HCDomain:      c.HcDomain,
+		HCNoRec:       c.HcNoRec,
+		ForceTCP:      c.ForceTcp,
+		PreferUDP:     c.PreferUdp,
+		Expire:        time.Duration(c.Expire) * time.Second,
+		MaxConcurrent: int64(c.MaxConcurrent),
+		TLSServerName: c.TlsServerName,
+		Timeout:       time.Duration(c.Timeout) * time.Millisecond,
+		ReadTimeout:   time.Duration(c.ReadTimeout) * time.Millisecond,
+		HedgeDelay:    time.Duration(c.HedgeDelay) * time.Millisecond,
+
+		CacheSize:          c.Cache.Size,
+		CacheMinTTL:        time.Duration(c.Cache.MinTtl) * time.Second,
+		CacheMaxTTL:        time.Duration(c.Cache.MaxTtl) * time.Second,
+		CacheNegativeTTL:   time.Duration(c.Cache.NegativeTtl) * time.Second,
+		Prefetch:           c.Cache.Prefetch,
+		PrefetchPercentage: c.Cache.PrefetchPercentage,
+		ServeStale:         time.Duration(c.Cache.ServeStale) * time.Second,
+	})
+}
+
+// findForwarder 返回处理集群中该请求的Forward:集群的配置优先于所有集群的配置,
+// 同一级中from最长的优先,相同时按配置的顺序,没有匹配时返回nil。
+// 转发结束后需要调用release,之后被替换的Forward才会停止
+func findForwarder(ctx context.Context, cluster string, state request.Request) (f *forward.Forward, release func()) {
+	forwarders.RLock()
+	defer forwarders.RUnlock()
+	var best *forwarder
+	for i, fw := range forwarders.list {
+		if (fw.cluster != "" && fw.cluster != cluster) || !fw.f.MatchRequest(ctx, state) {
+			continue
+		}
+		if best == nil || (best.cluster == "" && fw.cluster != "") ||
+			(best.cluster == fw.cluster && dns.CountLabel(fw.from) > dns.CountLabel(best.from)) {
+			best = &forwarders.list[i]
+		}
+	}
+	if best == nil {
+		return nil, nil
+	}
+	best.inflight.Add(1)
+	return best.f, best.inflight.Done
+}
+
+// forwardQuery 将请求转发到匹配的上游并返回上游的应答,没有匹配的转发规则时返回false。
+// 集群作为元数据 cluster 供转发规则匹配;转发失败时返回SERVFAIL,超过并发限制时返回REFUSED
+func forwardQuery(ctx context.Context, cluster string, req *dns.Msg, c *client, proto string) (*dns.Msg, bool) {
+	// 上游没有集群的TSIG密钥,转发去掉签名的副本,应答由调用方签名
+	if req.IsTsig() != nil {
+		req = req.Copy()
+		req.Extra = req.Extra[:len(req.Extra)-1]
+	}
+	state := request.Request{W: newGrpcWriter(c, proto), Req: req}
+	ctx = metadata.ContextWithMetadata(ctx)
+	metadata.SetValueFunc(ctx, "cluster", func() string { return cluster })
+	f, release := findForwarder(ctx, cluster, state)
+	if f == nil {
+		return nil, false
+	}
+	ret, err := f.Exchange(ctx, state)
+	release()
+	if err == nil {
+		return ret, true
+	}
+	log.Println("forward.go: forwardQuery() error: ", state.Name(), err)
+	msg := new(dns.Msg)
+	if err == f.ErrLimitExceeded {
+		msg.SetRcode(req, dns.RcodeRefused)
+	} else {
+		msg.SetRcode(req, dns.RcodeServerFailure)
+	}
+	return msg, true
+}
+
+// grpcWriter 让forward插件把grpc的查询当作客户端直接发来的请求,
+// 传输协议和地址决定连接上游的协议和dnstap中的客户端地址,应答由Exchange直接返回
+type grpcWriter struct {
+	local, remote net.Addr
+}
+
+func newGrpcWriter(c *client, proto string) *grpcWriter {
+	ip := net.IPv4zero
+	if c != nil && c.ip != nil {
+		ip = c.ip
+	}
+	if strings.EqualFold(proto, "tcp") {
+		return &grpcWriter{local: &net.TCPAddr{IP: net.IPv4zero}, remote: &net.TCPAddr{IP: ip}}
+	}
+	return &grpcWriter{local: &net.UDPAddr{IP: net.IPv4zero}, remote: &net.UDPAddr{IP: ip}}
+}
+
+func (w *grpcWriter) LocalAddr() net.Addr         { return w.local }
+func (w *grpcWriter) RemoteAddr() net.Addr        { return w.remote }
+func (w *grpcWriter) WriteMsg(m *dns.Msg) error   { return nil }
+func (w *grpcWriter) Write(b []byte) (int, error) { return len(b), nil }
+func (w *grpcWriter) Close() error                { return nil }
+func (w *grpcWriter) TsigStatus() error           { return nil }
+func (w *grpcWriter) TsigTimersOnly(bool)         {}
+func (w *grpcWriter) Hijack()                     {}
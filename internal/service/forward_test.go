@@ -0,0 +1,89 @@
+package service
+
+import (
+	"context"
+	"net"
+	"testing"
+
+	"dnsadminserver/internal/config"
+	"dnsadminserver/internal/models"
+
+	"github.com/coredns/coredns/pb"
+	"github.com/miekg/dns"
+	"google.golang.org/grpc/metadata"
+)
+
+// startUpstream 启动应答A记录的上游,通过返回的通道发送收到的查询
+func startUpstream(t *testing.T) (string, chan *dns.Msg) {
+	t.Helper()
+	pc, err := net.ListenPacket("udp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	reqs := make(chan *dns.Msg, 10)
+	srv := &dns.Server{PacketConn: pc, Handler: dns.HandlerFunc(func(w dns.ResponseWriter, r *dns.Msg) {
+		if r.Question[0].Name != "." { // 不包括健康检查
+			reqs <- r
+		}
+		m := new(dns.Msg)
+		m.SetReply(r)
+		m.Answer = append(m.Answer, mustRR(r.Question[0].Name+" 60 IN A 192.0.2.1"))
+		w.WriteMsg(m)
+	})}
+	go srv.ActivateAndServe()
+	t.Cleanup(func() { srv.Shutdown() })
+	return pc.LocalAddr().String(), reqs
+}
+
+func TestQueryForwardSigned(t *testing.T) {
+	addr, reqs := startUpstream(t)
+	cfg := config.AppConfig{
+		Tsig:     map[string]config.TsigConfig{"c1": {Keys: map[string]string{"key.": testSecret}}},
+		Forwards: []config.ForwardConfig{{From: ".", To: []string{addr}}},
+	}
+	config.SetForTest(cfg, []models.DnsRecords{
+		{Id: 1, ClusterName: "c1", Name: "txt.other.com.", Qtype: dns.TypeTXT, Qclass: 1, Ttl: 60, Rdata: "hello", Weight: 1},
+	})
+	startForwarders(cfg.Forwards)
+	t.Cleanup(func() { startForwarders(nil) })
+	ctx := metadata.NewIncomingContext(context.Background(), metadata.Pairs("cluster", "c1"))
+	s := &DnsServiceServer{}
+
+	query := func(name string) (*dns.Msg, *tsigRequest) {
+		req, tr := signedRequest(t, name, dns.TypeA)
+		buf, err := req.Pack()
+		if err != nil {
+			t.Fatal(err)
+		}
+		resp, err := s.Query(ctx, &pb.DnsPacket{Msg: buf})
+		if err != nil {
+			t.Fatal(err)
+		}
+		if err := dns.TsigVerify(resp.Msg, testSecret, tr.rr.MAC, false); err != nil {
+			t.Errorf("%s: reply not signed with the key of the request: %v", name, err)
+		}
+		m := new(dns.Msg)
+		if err := m.Unpack(resp.Msg); err != nil {
+			t.Fatal(err)
+		}
+		return m, tr
+	}
+
+	// 转发的请求不带TSIG,应答使用请求的密钥签名
+	m, _ := query("www.other.com.")
+	if len(m.Answer) != 1 {
+		t.Errorf("forwarded reply has %d answers, want 1", len(m.Answer))
+	}
+	if r := <-reqs; r.IsTsig() != nil {
+		t.Error("the forwarded request is signed")
+	}
+
+	// 名称下有其他类型的记录时返回NODATA,不转发
+	m, _ = query("TXT.other.com.")
+	if m.Rcode != dns.RcodeSuccess || len(m.Answer) != 0 {
+		t.Errorf("got %s with %d answers, want NODATA", dns.RcodeToString[m.Rcode], len(m.Answer))
+	}
+	if len(reqs) != 0 {
+		t.Error("a name with records in the store was forwarded")
+	}
+}
@@ -0,0 +1,139 @@
+package service
+
+import (
+	"dnsadminserver/internal/config"
+	"log"
+	"net"
+	"strconv"
+	"strings"
+	"sync"
+
+	"github.com/oschwald/geoip2-golang"
+	"github.com/oschwald/maxminddb-golang"
+)
+
+// geo 当前打开的MaxMind数据库,查询期间持有读锁,替换后关闭旧的数据库
+var geo struct {
+	sync.RWMutex
+	db    *maxminddb.Reader
+	asnDb *maxminddb.Reader
+}
+
+// geoInfo 客户端地址在MaxMind数据库中的信息,prefix为数据库中该地址所在网段的前缀长度
+type geoInfo struct {
+	country   string
+	continent string
+	prefix    int
+	asn       uint
+	asnPrefix int
+}
+
+func init() {
+	openGeoIP(config.GetConfig().GeoIP)
+	config.OnReload(func(old, new config.AppConfig) {
+		if old.GeoIP != new.GeoIP {
+			openGeoIP(new.GeoIP)
+		}
+	})
+}
+
+// openGeoIP 打开配置的数据库并替换当前的数据库,打开失败时不使用该数据库
+func openGeoIP(cfg config.GeoIPConfig) {
+	open := func(path string) *maxminddb.Reader {
+		if path == "" {
+			return nil
+		}
+		r, err := maxminddb.Open(path)
+		if err != nil {
+			log.Println("geoip.go: openGeoIP() error: ", path, err)
+			return nil
+		}
+		log.Println("geoip.go: openGeoIP() success: ", path, r.Metadata.DatabaseType)
+		return r
+	}
+	db, asnDb := open(cfg.Db), open(cfg.AsnDb)
+	geo.Lock()
+	oldDb, oldAsnDb := geo.db, geo.asnDb
+	geo.db, geo.asnDb = db, asnDb
+	geo.Unlock()
+	if oldDb != nil {
+		oldDb.Close()
+	}
+	if oldAsnDb != nil {
+		oldAsnDb.Close()
+	}
+}
+
+// lookupGeo 查询ip的国家、大洲和ASN,数据库未配置或没有记录时对应字段为空
+func lookupGeo(ip net.IP) (info geoInfo) {
+	geo.RLock()
+	defer geo.RUnlock()
+	if geo.db != nil {
+		var c geoip2.Country
+		n, ok, err := geo.db.LookupNetwork(ip, &c)
+		if err != nil {
+			geoErrors.Inc()
+			log.Println("geoip.go: lookupGeo() error: ", ip, err)
+		} else if ok {
+			info.country = c.Country.IsoCode
+			info.continent = c.Continent.Code
+			info.prefix, _ = n.Mask.Size()
+		}
+	}
+	if geo.asnDb != nil {
+		var a geoip2.ASN
+		n, ok, err := geo.asnDb.LookupNetwork(ip, &a)
+		if err != nil {
+			geoErrors.Inc()
+			log.Println("geoip.go: lookupGeo() error: ", ip, err)
+		} else if ok {
+			info.asn = a.AutonomousSystemNumber
+			info.asnPrefix, _ = n.Mask.Size()
+		}
+	}
+	return
+}
+
+// geo选择器的优先级,ASN比国家具体,国家比大洲具体
+const (
+	scoreContinent = iota + 1
+	scoreCountry
+	scoreAsn
+)
+
+// geoMatch 匹配 country:CN,HK、continent:EU、asn:4134 形式的选择器,
+// 返回匹配的优先级和应答适用的网段前缀长度,不匹配时score为-1。
+// view不是geo选择器时isGeo为false
+func geoMatch(view string, info geoInfo) (score, prefix int, isGeo bool) {
+	kind, values, ok := strings.Cut(view, ":")
+	if !ok {
+		return -1, 0, false
+	}
+	var value string
+	switch strings.ToLower(kind) {
+	case "country":
+		value, score, prefix = info.country, scoreCountry, info.prefix
+	case "continent":
+		value, score, prefix = info.continent, scoreContinent, info.prefix
+	case "asn":
+		if info.asn > 0 {
+			value = strconv.FormatUint(uint64(info.asn), 10)
+		}
+		score, prefix = scoreAsn, info.asnPrefix
+	default:
+		return -1, 0, false
+	}
+	if value == "" {
+		return -1, 0, true
+	}
+	for _, v := range strings.Split(values, ",") {
+		v = strings.ToUpper(strings.TrimSpace(v))
+		if score == scoreAsn {
+			v = strings.TrimPrefix(v, "AS")
+		}
+		if v == value {
+			return score, prefix, true
+		}
+	}
+	return -1, 0, true
+}
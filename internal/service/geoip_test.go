@@ -0,0 +1,84 @@
+package service
+
+import (
+	"fmt"
+	"net"
+	"testing"
+
+	"dnsadminserver/internal/config"
+)
+
+// openTestGeoIP 打开testdata中的数据库,只包含 81.2.69.142/32: GB、EU
+func openTestGeoIP(t *testing.T) {
+	openGeoIP(config.GeoIPConfig{Db: "testdata/GeoLite2-City.mmdb"})
+	t.Cleanup(func() { openGeoIP(config.GeoIPConfig{}) })
+	if geo.db == nil {
+		t.Fatal("testdata/GeoLite2-City.mmdb not opened")
+	}
+}
+
+func TestLookupGeo(t *testing.T) {
+	openTestGeoIP(t)
+	if info := lookupGeo(net.ParseIP("81.2.69.142")); info.country != "GB" || info.continent != "EU" || info.prefix != 32 {
+		t.Errorf("got %+v, want GB EU /32", info)
+	}
+	if info := lookupGeo(net.ParseIP("10.0.0.1")); info.country != "" || info.continent != "" {
+		t.Errorf("got %+v for an address not in the database", info)
+	}
+}
+
+func TestGeoMatch(t *testing.T) {
+	info := geoInfo{country: "GB", continent: "EU", prefix: 24, asn: 4134, asnPrefix: 16}
+	tests := []struct {
+		view          string
+		score, prefix int
+		isGeo         bool
+	}{
+		{"country:CN,gb", scoreCountry, 24, true},
+		{"country:CN", -1, 0, true},
+		{"continent:EU", scoreContinent, 24, true},
+		{"asn:AS4134", scoreAsn, 16, true},
+		{"asn:4134", scoreAsn, 16, true},
+		{"asn:4837", -1, 0, true},
+		{"10.0.0.0/8", -1, 0, false},
+		{"office", -1, 0, false},
+	}
+	for _, tc := range tests {
+		score, prefix, isGeo := geoMatch(tc.view, info)
+		if score != tc.score || prefix != tc.prefix || isGeo != tc.isGeo {
+			t.Errorf("geoMatch(%s) = %d, %d, %v, want %d, %d, %v", tc.view, score, prefix, isGeo, tc.score, tc.prefix, tc.isGeo)
+		}
+	}
+	// 数据库中没有ASN时不匹配
+	if score, _, _ := geoMatch("asn:0", geoInfo{}); score != -1 {
+		t.Errorf("asn:0 matched an address without ASN")
+	}
+}
+
+func TestSelectViewGeo(t *testing.T) {
+	openTestGeoIP(t)
+	config.SetForTest(config.AppConfig{}, nil)
+	tests := []struct {
+		ip    string
+		views []string
+		ids   []int64
+		scope uint8
+	}{
+		// 国家比大洲具体
+		{"81.2.69.142", []string{"", "continent:EU", "country:GB"}, []int64{3}, 32},
+		{"81.2.69.142", []string{"", "continent:EU", "country:CN"}, []int64{2}, 32},
+		// 网段优先于geo选择器
+		{"81.2.69.142", []string{"country:GB", "81.2.0.0/16"}, []int64{2}, 16},
+		{"10.0.0.1", []string{"", "country:GB"}, []int64{1}, 0},
+	}
+	for _, tc := range tests {
+		c := &client{ip: net.ParseIP(tc.ip)}
+		out := c.selectView("c1", viewed(tc.views...))
+		if got := ids(out); fmt.Sprint(got) != fmt.Sprint(tc.ids) {
+			t.Errorf("%s %v: got records %v, want %v", tc.ip, tc.views, got, tc.ids)
+		}
+		if c.scope != tc.scope {
+			t.Errorf("%s %v: got scope %d, want %d", tc.ip, tc.views, c.scope, tc.scope)
+		}
+	}
+}
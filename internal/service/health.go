@@ -0,0 +1,303 @@
+package service
+
+import (
+	"context"
+	"dnsadminserver/internal/config"
+	"dnsadminserver/internal/models"
+	"fmt"
+	"log"
+	"net"
+	"net/http"
+	"reflect"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/miekg/dns"
+)
+
+// 非master从redis读取健康状态的间隔
+const healthPollInterval = 5 * time.Second
+
+// health 健康检查的结果,key为 集群/域名/地址,只保存不健康的地址
+var health = struct {
+	sync.RWMutex
+	down   map[string]bool
+	cancel context.CancelFunc
+}{down: map[string]bool{}}
+
+var healthClient = &http.Client{
+	Transport: &http.Transport{DisableKeepAlives: true},
+	CheckRedirect: func(req *http.Request, via []*http.Request) error {
+		return http.ErrUseLastResponse
+	},
+}
+
+func init() {
+	startHealthChecks()
+	config.OnReload(func(old, new config.AppConfig) {
+		if !reflect.DeepEqual(old.HealthChecks, new.HealthChecks) ||
+			old.RedisConfig != new.RedisConfig {
+			startHealthChecks()
+		}
+	})
+}
+
+func healthKey(cluster, name, ip string) string {
+	return cluster + "/" + dns.CanonicalName(name) + "/" + ip
+}
+
+// startHealthChecks 按配置重新启动健康检查:master执行检查并将结果写入redis,
+// 其余pod定时从redis读取结果,避免每个副本重复检查
+func startHealthChecks() {
+	cfg := config.GetConfig()
+	health.Lock()
+	if health.cancel != nil {
+		health.cancel()
+	}
+	health.down = map[string]bool{}
+	ctx, cancel := context.WithCancel(context.Background())
+	health.cancel = cancel
+	health.Unlock()
+	if len(cfg.HealthChecks) == 0 {
+		return
+	}
+	if cfg.RedisConfig.RedisAddrs == "" {
+		// 检查结果通过redis共享,非master不会去掉不健康的地址
+		log.Println("health.go: startHealthChecks() warning: ", "配置了健康检查但没有配置redis,只有master的应答去掉不健康的地址")
+	}
+	if !cfg.IsMaster {
+		go pollHealth(ctx)
+		return
+	}
+	for cluster, names := range cfg.HealthChecks {
+		for name, hc := range names {
+			go runHealthCheck(ctx, cluster, name, hc)
+		}
+	}
+}
+
+// filterHealthy 去掉检查不健康的A/AAAA记录,全部不健康时返回全部记录,避免应答为空
+func filterHealthy(cluster, name string, records []models.DnsRR) []models.DnsRR {
+	health.RLock()
+	defer health.RUnlock()
+	if len(health.down) == 0 {
+		return records
+	}
+	var out []models.DnsRR
+	for _, r := range records {
+		if ip := recordIP(r.DnsRR); ip == "" || !health.down[healthKey(cluster, name, ip)] {
+			out = append(out, r)
+		}
+	}
+	if len(out) == 0 {
+		healthAllDown.WithLabelValues(cluster, dns.CanonicalName(name)).Inc()
+		return records
+	}
+	return out
+}
+
+func recordIP(rr dns.RR) string {
+	switch v := rr.(type) {
+	case *dns.A:
+		return v.A.String()
+	case *dns.AAAA:
+		return v.AAAA.String()
+	}
+	return ""
+}
+
+// runHealthCheck 定时检查域名下全部A/AAAA记录的地址
+func runHealthCheck(ctx context.Context, cluster, name string, hc config.HealthCheckConfig) {
+	fails := map[string]int{}
+	ticker := time.NewTicker(hc.CheckInterval())
+	defer ticker.Stop()
+	for {
+		fails = checkOnce(ctx, cluster, name, hc, fails)
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+		}
+	}
+}
+
+// checkOnce 检查一轮,返回每个地址连续失败的次数
+func checkOnce(ctx context.Context, cluster, name string, hc config.HealthCheckConfig, fails map[string]int) map[string]int {
+	var ips []string
+	seen := map[string]bool{}
+	for _, qtype := range []uint16{dns.TypeA, dns.TypeAAAA} {
+		for _, r := range config.GetDnsRecords(config.RecordKey(cluster, qtype, name)) {
+			if ip := recordIP(r.DnsRR); ip != "" && !seen[ip] {
+				seen[ip] = true
+				ips = append(ips, ip)
+			}
+		}
+	}
+
+	results := make([]error, len(ips))
+	var wg sync.WaitGroup
+	for i, ip := range ips {
+		wg.Add(1)
+		go func(i int, ip string) {
+			defer wg.Done()
+			results[i] = probe(ctx, hc, name, ip)
+		}(i, ip)
+	}
+	wg.Wait()
+	if ctx.Err() != nil {
+		return fails
+	}
+
+	next := map[string]int{}
+	states := map[string]bool{}
+	for i, ip := range ips {
+		key := healthKey(cluster, name, ip)
+		if results[i] != nil {
+			next[key] = fails[key] + 1
+			config.Debugf("health.go: checkOnce() 检查失败 %s %v", key, results[i])
+		}
+		down := next[key] >= hc.MaxFails()
+		if down != (fails[key] >= hc.MaxFails()) {
+			log.Println("health.go: checkOnce() 健康状态变化: ", key, "down:", down, results[i])
+		}
+		states[key] = down
+	}
+	setHealth(cluster, name, states)
+	return next
+}
+
+// setHealth 替换域名下地址的健康状态,并写入redis供其他pod读取
+func setHealth(cluster, name string, states map[string]bool) {
+	prefix := healthKey(cluster, name, "")
+	downCount := 0
+	health.Lock()
+	for key := range health.down {
+		if strings.HasPrefix(key, prefix) && !states[key] {
+			delete(health.down, key)
+		}
+	}
+	for key, down := range states {
+		if down {
+			health.down[key] = true
+			downCount++
+		}
+	}
+	health.Unlock()
+	healthDown.WithLabelValues(cluster, dns.CanonicalName(name)).Set(float64(downCount))
+
+	client, hkey := config.HealthRedis()
+	if client == nil {
+		return
+	}
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+	existing, err := client.HKeys(ctx, hkey).Result()
+	if err != nil {
+		log.Println("health.go: setHealth() error: ", err)
+		return
+	}
+	pipe := client.TxPipeline()
+	for _, key := range existing {
+		if _, ok := states[key]; !ok && strings.HasPrefix(key, prefix) {
+			pipe.HDel(ctx, hkey, key)
+		}
+	}
+	for key, down := range states {
+		pipe.HSet(ctx, hkey, key, strconv.FormatBool(down))
+	}
+	// master停止写入后状态过期,其他pod恢复为全部健康
+	pipe.Expire(ctx, hkey, time.Minute)
+	if _, err := pipe.Exec(ctx); err != nil {
+		log.Println("health.go: setHealth() error: ", err)
+	}
+}
+
+// pollHealth 定时从redis读取master写入的健康状态
+func pollHealth(ctx context.Context) {
+	ticker := time.NewTicker(healthPollInterval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+		}
+		client, hkey := config.HealthRedis()
+		if client == nil {
+			continue
+		}
+		rctx, cancel := context.WithTimeout(ctx, 5*time.Second)
+		values, err := client.HGetAll(rctx, hkey).Result()
+		cancel()
+		if err != nil {
+			log.Println("health.go: pollHealth() error: ", err)
+			continue
+		}
+		down := map[string]bool{}
+		for key, v := range values {
+			if v == "true" {
+				down[key] = true
+			}
+		}
+		health.Lock()
+		if ctx.Err() == nil {
+			health.down = down
+		}
+		health.Unlock()
+	}
+}
+
+// probe 对地址执行一次检查
+func probe(ctx context.Context, hc config.HealthCheckConfig, name, ip string) error {
+	ctx, cancel := context.WithTimeout(ctx, hc.CheckTimeout())
+	defer cancel()
+	addr := net.JoinHostPort(ip, strconv.Itoa(hc.CheckPort()))
+	switch hc.Type {
+	case config.HealthHttp:
+		path := hc.Path
+		if path == "" {
+			path = "/"
+		}
+		req, err := http.NewRequestWithContext(ctx, http.MethodGet, "http://"+addr+path, nil)
+		if err != nil {
+			return err
+		}
+		if hc.Host != "" {
+			req.Host = hc.Host
+		}
+		resp, err := healthClient.Do(req)
+		if err != nil {
+			return err
+		}
+		resp.Body.Close()
+		if resp.StatusCode >= 400 {
+			return fmt.Errorf("http状态码 %d", resp.StatusCode)
+		}
+		return nil
+	case config.HealthDns:
+		qname := hc.Host
+		if qname == "" {
+			qname = name
+		}
+		m := new(dns.Msg)
+		m.SetQuestion(dns.Fqdn(qname), dns.TypeA)
+		c := &dns.Client{Timeout: hc.CheckTimeout()}
+		r, _, err := c.ExchangeContext(ctx, m, addr)
+		if err != nil {
+			return err
+		}
+		if r.Rcode == dns.RcodeServerFailure || r.Rcode == dns.RcodeRefused {
+			return fmt.Errorf("dns应答 %s", dns.RcodeToString[r.Rcode])
+		}
+		return nil
+	default:
+		var d net.Dialer
+		conn, err := d.DialContext(ctx, "tcp", addr)
+		if err != nil {
+			return err
+		}
+		return conn.Close()
+	}
+}
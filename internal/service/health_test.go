@@ -0,0 +1,98 @@
+package service
+
+import (
+	"context"
+	"fmt"
+	"net"
+	"testing"
+
+	"dnsadminserver/internal/config"
+	"dnsadminserver/internal/models"
+
+	"github.com/miekg/dns"
+)
+
+// addressed 返回id为1..n、地址为ips的A记录
+func addressed(ips ...string) []models.DnsRR {
+	records := make([]models.DnsRR, len(ips))
+	for i, ip := range ips {
+		records[i] = models.DnsRR{Id: int64(i + 1), Weight: 1, DnsRR: mustRR("www.example.com. 60 IN A " + ip)}
+	}
+	return records
+}
+
+// setDown 将地址标记为不健康,测试结束后恢复
+func setDown(t *testing.T, keys ...string) {
+	health.Lock()
+	health.down = map[string]bool{}
+	for _, k := range keys {
+		health.down[k] = true
+	}
+	health.Unlock()
+	t.Cleanup(func() {
+		health.Lock()
+		health.down = map[string]bool{}
+		health.Unlock()
+	})
+}
+
+func TestFilterHealthy(t *testing.T) {
+	records := addressed("10.0.0.1", "10.0.0.2", "10.0.0.3")
+	setDown(t, healthKey("c1", "www.example.com.", "10.0.0.2"))
+	tests := []struct {
+		cluster, name string
+		records       []models.DnsRR
+		ids           []int64
+	}{
+		{"c1", "www.example.com.", records, []int64{1, 3}},
+		{"c1", "WWW.Example.com.", records, []int64{1, 3}},
+		// 检查结果只属于配置的集群和域名
+		{"c2", "www.example.com.", records, []int64{1, 2, 3}},
+		{"c1", "api.example.com.", records, []int64{1, 2, 3}},
+		// 全部不健康时返回全部记录
+		{"c1", "www.example.com.", records[1:2], []int64{2}},
+	}
+	for _, tc := range tests {
+		if got := ids(filterHealthy(tc.cluster, tc.name, tc.records)); fmt.Sprint(got) != fmt.Sprint(tc.ids) {
+			t.Errorf("%s %s: got %v, want %v", tc.cluster, tc.name, got, tc.ids)
+		}
+	}
+}
+
+func TestCheckOnce(t *testing.T) {
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer l.Close()
+	go func() {
+		for {
+			conn, err := l.Accept()
+			if err != nil {
+				return
+			}
+			conn.Close()
+		}
+	}()
+	port := l.Addr().(*net.TCPAddr).Port
+	config.SetForTest(config.AppConfig{}, []models.DnsRecords{
+		{Id: 1, ClusterName: "c1", Name: "www.example.com.", Qtype: dns.TypeA, Qclass: 1, Ttl: 60, Rdata: "127.0.0.1", Weight: 1},
+		{Id: 2, ClusterName: "c1", Name: "www.example.com.", Qtype: dns.TypeA, Qclass: 1, Ttl: 60, Rdata: "127.0.0.2", Weight: 1},
+	})
+	setDown(t)
+	hc := config.HealthCheckConfig{Type: config.HealthTcp, Port: port, Fails: 2}
+	records := addressed("127.0.0.1", "127.0.0.2")
+
+	// 连续失败fails次后才标记为不健康
+	fails := checkOnce(context.Background(), "c1", "www.example.com.", hc, nil)
+	if got := ids(filterHealthy("c1", "www.example.com.", records)); len(got) != 2 {
+		t.Errorf("after one failure got %v, want both records", got)
+	}
+	fails = checkOnce(context.Background(), "c1", "www.example.com.", hc, fails)
+	if got := ids(filterHealthy("c1", "www.example.com.", records)); fmt.Sprint(got) != "[1]" {
+		t.Errorf("after two failures got %v, want [1]", got)
+	}
+	if fails[healthKey("c1", "www.example.com.", "127.0.0.1")] != 0 {
+		t.Errorf("the listening address has failures: %v", fails)
+	}
+}
@@ -0,0 +1,50 @@
+package service
+
+import (
+	"dnsadminserver/internal/config"
+	"sync"
+
+	"golang.org/x/time/rate"
+)
+
+// clusterLimiter 按集群限制查询速率
+type clusterLimiter struct {
+	mu       sync.Mutex
+	limiters map[string]*rate.Limiter
+}
+
+var limiter = &clusterLimiter{limiters: map[string]*rate.Limiter{}}
+
+func init() {
+	// 限流配置变更后丢弃已有的limiter,下次查询时按新配置创建
+	config.OnReload(func(old, new config.AppConfig) {
+		if old.RateLimit != new.RateLimit {
+			limiter.reset()
+		}
+	})
+}
+
+func (l *clusterLimiter) allow(cluster string) bool {
+	c := config.GetConfig().RateLimit
+	if c.Qps <= 0 {
+		return true
+	}
+	l.mu.Lock()
+	rl, ok := l.limiters[cluster]
+	if !ok {
+		burst := c.Burst
+		if burst <= 0 {
+			burst = int(c.Qps) + 1
+		}
+		rl = rate.NewLimiter(rate.Limit(c.Qps), burst)
+		l.limiters[cluster] = rl
+	}
+	l.mu.Unlock()
+	return rl.Allow()
+}
+
+func (l *clusterLimiter) reset() {
+	l.mu.Lock()
+	l.limiters = map[string]*rate.Limiter{}
+	l.mu.Unlock()
+}
@@ -0,0 +1,39 @@
+package service
+
+import (
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/promauto"
+)
+
+const metricsNamespace = "dnsadmin"
+
+// Variables declared for monitoring.
+var (
+	viewSelections = promauto.NewCounterVec(prometheus.CounterOpts{
+		Namespace: metricsNamespace,
+		Subsystem: "view",
+		Name:      "selections_total",
+		Help:      "Counter of answers chosen by each record view (CIDR, named view or GeoIP selector).",
+	}, []string{"cluster", "view"})
+
+	healthDown = promauto.NewGaugeVec(prometheus.GaugeOpts{
+		Namespace: metricsNamespace,
+		Subsystem: "health",
+		Name:      "down_targets",
+		Help:      "Number of record addresses currently marked down by health checks.",
+	}, []string{"cluster", "name"})
+
+	healthAllDown = promauto.NewCounterVec(prometheus.CounterOpts{
+		Namespace: metricsNamespace,
+		Subsystem: "health",
+		Name:      "all_down_total",
+		Help:      "Counter of answers that returned every record because all of them were down.",
+	}, []string{"cluster", "name"})
+
+	geoErrors = promauto.NewCounter(prometheus.CounterOpts{
+		Namespace: metricsNamespace,
+		Subsystem: "geoip",
+		Name:      "lookup_errors_total",
+		Help:      "Counter of failed GeoIP database lookups.",
+	})
+)
@@ -0,0 +1,87 @@
+package service
+
+import (
+	"dnsadminserver/internal/config"
+	"log"
+	"sync"
+	"time"
+
+	"github.com/miekg/dns"
+)
+
+const (
+	defaultNotifyDelay = time.Second
+	notifyRetries      = 3
+	notifyTimeout      = 2 * time.Second
+)
+
+// notifier 在zone变化后向配置的地址发送NOTIFY(RFC 1996),
+// 延迟发送以合并短时间内的多次变更
+type notifier struct {
+	mu      sync.Mutex
+	pending map[string]bool
+}
+
+var zoneNotifier = &notifier{pending: map[string]bool{}}
+
+func init() {
+	config.OnZoneChange(func(c config.ZoneChange) {
+		watchers.broadcast(c)
+		// 所有pod都会应用变更,只由master发送NOTIFY,避免从服务器收到重复的通知
+		if len(c.Zone.Notify) > 0 && config.GetConfig().IsMaster {
+			zoneNotifier.schedule(c.Zone)
+		}
+	})
+}
+
+func (n *notifier) schedule(zone config.ZoneConfig) {
+	key := zone.Cluster + "/" + zone.Name
+	n.mu.Lock()
+	defer n.mu.Unlock()
+	if n.pending[key] {
+		return
+	}
+	n.pending[key] = true
+	delay := defaultNotifyDelay
+	if d := config.GetConfig().NotifyDelay; d > 0 {
+		delay = time.Duration(d) * time.Millisecond
+	}
+	time.AfterFunc(delay, func() {
+		n.mu.Lock()
+		delete(n.pending, key)
+		n.mu.Unlock()
+		n.send(zone)
+	})
+}
+
+// send 向zone的每个地址发送NOTIFY,没有收到应答时按退避时间重试
+func (n *notifier) send(zone config.ZoneConfig) {
+	soa, ok := config.ZoneSOA(zone.Cluster, zone.Name)
+	if !ok {
+		return
+	}
+	for _, target := range zone.Notify {
+		go func(target string) {
+			msg := new(dns.Msg)
+			msg.SetNotify(zone.Name)
+			msg.Authoritative = true
+			msg.Answer = []dns.RR{soa}
+			c := &dns.Client{Net: "udp", Timeout: notifyTimeout}
+			backoff := time.Second
+			for i := 0; i < notifyRetries; i++ {
+				r, _, err := c.Exchange(msg, target)
+				if err == nil && r.Rcode == dns.RcodeSuccess {
+					config.Debugln("发送NOTIFY成功:", target, zone.Name, soa.Serial)
+					return
+				}
+				if err == nil {
+					log.Println("notify.go: send() error: ", target, zone.Name, dns.RcodeToString[r.Rcode])
+					return
+				}
+				time.Sleep(backoff)
+				backoff *= 2
+			}
+			log.Println("notify.go: send() error: ", "发送NOTIFY失败", target, zone.Name, soa.Serial)
+		}(target)
+	}
+}
@@ -0,0 +1,64 @@
+package service
+
+import (
+	"net"
+	"testing"
+	"time"
+
+	"dnsadminserver/internal/config"
+
+	"github.com/miekg/dns"
+)
+
+// startSecondary 启动接收NOTIFY的从服务器,通过返回的通道发送收到的NOTIFY
+func startSecondary(t *testing.T) (string, chan *dns.Msg) {
+	t.Helper()
+	pc, err := net.ListenPacket("udp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	notifies := make(chan *dns.Msg, 10)
+	srv := &dns.Server{PacketConn: pc, Handler: dns.HandlerFunc(func(w dns.ResponseWriter, r *dns.Msg) {
+		notifies <- r
+		m := new(dns.Msg)
+		m.SetReply(r)
+		w.WriteMsg(m)
+	})}
+	go srv.ActivateAndServe()
+	t.Cleanup(func() { srv.Shutdown() })
+	return pc.LocalAddr().String(), notifies
+}
+
+func TestNotifyDebounce(t *testing.T) {
+	addr, notifies := startSecondary(t)
+	zone := config.ZoneConfig{Cluster: "c1", Name: "example.com.", Notify: []string{addr}}
+	config.SetForTest(config.AppConfig{Zones: []config.ZoneConfig{zone}, NotifyDelay: 50}, nil)
+	n := &notifier{pending: map[string]bool{}}
+
+	// 延迟时间内的多次变更只发送一次NOTIFY
+	for i := 0; i < 5; i++ {
+		n.schedule(zone)
+	}
+	select {
+	case m := <-notifies:
+		soa, _ := config.ZoneSOA("c1", "example.com.")
+		if m.Opcode != dns.OpcodeNotify || len(m.Answer) != 1 || m.Answer[0].(*dns.SOA).Serial != soa.Serial {
+			t.Errorf("got %v, want a NOTIFY with the SOA of the zone", m)
+		}
+	case <-time.After(2 * time.Second):
+		t.Fatal("no NOTIFY sent")
+	}
+	select {
+	case <-notifies:
+		t.Error("changes within the delay sent more than one NOTIFY")
+	case <-time.After(200 * time.Millisecond):
+	}
+
+	// 发送后的变更再次发送
+	n.schedule(zone)
+	select {
+	case <-notifies:
+	case <-time.After(2 * time.Second):
+		t.Fatal("no NOTIFY sent for a later change")
+	}
+}
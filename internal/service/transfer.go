@@ -0,0 +1,224 @@
+package service
+
+import (
+	"dnsadminserver/internal/config"
+	"log"
+	"net"
+
+	"github.com/coredns/coredns/pb"
+	"github.com/miekg/dns"
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/metadata"
+	"google.golang.org/grpc/status"
+)
+
+// 区域传送时每个消息最多包含的记录数,消息长度也不超过 dns.MaxMsgSize
+const transferChunkSize = 500
+
+// splitRecords 将rrs分成多段,每段加上base字节的消息头和问题后不超过一个DNS消息的长度
+func splitRecords(rrs []dns.RR, base int) (chunks [][]dns.RR) {
+	start, size := 0, base
+	for i, rr := range rrs {
+		l := dns.Len(rr)
+		if i > start && (i-start == transferChunkSize || size+l > dns.MaxMsgSize) {
+			chunks = append(chunks, rrs[start:i])
+			start, size = i, base
+		}
+		size += l
+	}
+	if start < len(rrs) {
+		chunks = append(chunks, rrs[start:])
+	}
+	return
+}
+
+// messageBase 返回应答中记录以外部分的长度:消息头、问题,并为OPT和TSIG预留空间
+func messageBase(req *dns.Msg) int {
+	base := 12 + 512
+	for _, q := range req.Question {
+		base += len(q.Name) + 6
+	}
+	return base
+}
+
+// transferMessages 返回区域传送的应答消息,记录较多时分成多个消息
+func transferMessages(req *dns.Msg, rrs []dns.RR) (msgs []*dns.Msg) {
+	for _, chunk := range splitRecords(rrs, messageBase(req)) {
+		msg := new(dns.Msg)
+		msg.SetReply(req)
+		msg.Authoritative = true
+		msg.Answer = chunk
+		msgs = append(msgs, msg)
+	}
+	return
+}
+
+func isTransfer(req *dns.Msg) bool {
+	return len(req.Question) == 1 &&
+		(req.Question[0].Qtype == dns.TypeAXFR || req.Question[0].Qtype == dns.TypeIXFR)
+}
+
+// transferRecords 返回区域传送应答中的记录。
+// AXFR: SOA, 全部记录, SOA
+// IXFR: 新SOA, (旧SOA, 删除的记录, 新SOA, 新增的记录)..., 新SOA;
+// 客户端serial与当前相同时只返回SOA,变更记录不完整时按AXFR返回
+func transferRecords(cluster, zone string, req *dns.Msg) []dns.RR {
+	soa, records, ok := config.ZoneRecords(cluster, zone)
+	if !ok {
+		return nil
+	}
+	if req.Question[0].Qtype == dns.TypeIXFR && len(req.Ns) > 0 {
+		if clientSoa, ok := req.Ns[0].(*dns.SOA); ok {
+			if clientSoa.Serial == soa.Serial {
+				return []dns.RR{soa}
+			}
+			if deltas, ok := config.ZoneJournal(cluster, zone, clientSoa.Serial); ok {
+				rrs := []dns.RR{soa}
+				for _, d := range deltas {
+					oldSoa := dns.Copy(soa).(*dns.SOA)
+					oldSoa.Serial = d.OldSerial
+					newSoa := dns.Copy(soa).(*dns.SOA)
+					newSoa.Serial = d.NewSerial
+					rrs = append(rrs, oldSoa)
+					rrs = append(rrs, d.Removed...)
+					rrs = append(rrs, newSoa)
+					rrs = append(rrs, d.Added...)
+				}
+				return append(rrs, soa)
+			}
+		}
+	}
+	rrs := make([]dns.RR, 0, len(records)+2)
+	rrs = append(rrs, soa)
+	rrs = append(rrs, records...)
+	return append(rrs, soa)
+}
+
+// transferZone 查找请求的zone,未配置或不允许传送时返回false
+func transferZone(cluster string, req *dns.Msg) (config.ZoneConfig, bool) {
+	zone, ok := config.FindZone(cluster, req.Question[0].Name)
+	if !ok || !zone.Transfer || dns.CanonicalName(zone.Name) != dns.CanonicalName(req.Question[0].Name) {
+		return zone, false
+	}
+	return zone, true
+}
+
+// transfer 处理通过grpc Query发送的AXFR/IXFR请求。一个应答只能包含一个DNS消息,
+// 记录超过一个消息的长度时返回设置了TC位的空应答,客户端需要改用 Transfer 流
+func transfer(cluster string, req *dns.Msg) *dns.Msg {
+	msg := new(dns.Msg)
+	msg.SetReply(req)
+	zone, ok := transferZone(cluster, req)
+	if !ok {
+		msg.Rcode = dns.RcodeRefused
+		return msg
+	}
+	msg.Authoritative = true
+	msgs := transferMessages(req, transferRecords(cluster, zone.Name, req))
+	switch len(msgs) {
+	case 0:
+	case 1:
+		return msgs[0]
+	default:
+		msg.Truncated = true
+	}
+	return msg
+}
+
+// ServeTransfer 在addr上监听TCP,为配置的zone提供AXFR/IXFR。
+// TCP请求没有集群信息,zone名称在多个集群中存在时使用第一个允许传送的集群
+func ServeTransfer(addr string) error {
+	server := &dns.Server{Addr: addr, Net: "tcp", Handler: dns.HandlerFunc(serveTransfer)}
+	log.Println("区域传送监听:", addr)
+	return server.ListenAndServe()
+}
+
+func serveTransfer(w dns.ResponseWriter, req *dns.Msg) {
+	refuse := func() {
+		msg := new(dns.Msg)
+		msg.SetRcode(req, dns.RcodeRefused)
+		w.WriteMsg(msg)
+	}
+	if !isTransfer(req) {
+		refuse()
+		return
+	}
+	ip, _, _ := net.SplitHostPort(w.RemoteAddr().String())
+	var zone config.ZoneConfig
+	found := false
+	for _, z := range config.GetConfig().Zones {
+		if z.Transfer && dns.CanonicalName(z.Name) == dns.CanonicalName(req.Question[0].Name) &&
+			z.AllowTransferFrom(net.ParseIP(ip)) {
+			zone, found = z, true
+			break
+		}
+	}
+	if !found {
+		log.Println("拒绝区域传送:", ip, req.Question[0].Name)
+		refuse()
+		return
+	}
+	rrs := transferRecords(zone.Cluster, dns.Fqdn(zone.Name), req)
+	if len(rrs) == 0 {
+		refuse()
+		return
+	}
+
+	// 消息全部放入缓冲后再发送,Out提前返回时不会有阻塞的写入方
+	chunks := splitRecords(rrs, messageBase(req))
+	ch := make(chan *dns.Envelope, len(chunks))
+	for _, chunk := range chunks {
+		ch <- &dns.Envelope{RR: chunk}
+	}
+	close(ch)
+	tr := new(dns.Transfer)
+	if err := tr.Out(w, req, ch); err != nil {
+		log.Println("区域传送失败:", ip, req.Question[0].Name, err)
+	}
+}
+
+// Transfer 通过grpc流处理AXFR/IXFR请求,每个消息作为一个DnsPacket推送
+func (s *DnsServiceServer) Transfer(req *pb.DnsPacket, stream grpc.ServerStream) error {
+	me, ok := metadata.FromIncomingContext(stream.Context())
+	if !ok {
+		return status.Error(codes.InvalidArgument, "metadata not found")
+	}
+	cluster := firstMD(me, "cluster")
+	if err := authorize(me, cluster); err != nil {
+		return err
+	}
+	reqMsg := new(dns.Msg)
+	if err := reqMsg.Unpack(req.Msg); err != nil {
+		return status.Error(codes.InvalidArgument, err.Error())
+	}
+	if !isTransfer(reqMsg) {
+		return status.Error(codes.InvalidArgument, "not a zone transfer request")
+	}
+	t, resp, done, err := checkTsig(cluster, req.Msg, reqMsg)
+	if done {
+		if err == nil {
+			err = stream.SendMsg(resp)
+		}
+		return err
+	}
+	var msgs []*dns.Msg
+	if zone, ok := transferZone(cluster, reqMsg); ok {
+		msgs = transferMessages(reqMsg, transferRecords(cluster, zone.Name, reqMsg))
+	}
+	if len(msgs) == 0 {
+		msg := new(dns.Msg)
+		msg.SetRcode(reqMsg, dns.RcodeRefused)
+		msgs = []*dns.Msg{msg}
+	}
+	resps, err := packSignedStream(msgs, t)
+	if err != nil {
+		return status.Error(codes.Internal, err.Error())
+	}
+	for _, resp := range resps {
+		if err := stream.SendMsg(resp); err != nil {
+			return err
+		}
+	}
+	return nil
+}
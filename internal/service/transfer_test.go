@@ -0,0 +1,172 @@
+package service
+
+import (
+	"fmt"
+	"net"
+	"strings"
+	"testing"
+
+	"dnsadminserver/internal/config"
+	"dnsadminserver/internal/models"
+
+	"github.com/miekg/dns"
+)
+
+func transferRecordList(n int) (list []models.DnsRecords) {
+	for i := 0; i < n; i++ {
+		list = append(list, models.DnsRecords{
+			Id: int64(i + 1), ClusterName: "c1", Name: fmt.Sprintf("h%d.example.com.", i),
+			Qtype: dns.TypeA, Qclass: 1, Ttl: 60, Rdata: fmt.Sprintf("10.0.%d.%d", i/256, i%256), Weight: 1,
+		})
+	}
+	return
+}
+
+// setTransferConfig 配置c1中允许区域传送的zone example.com.,包含n条A记录
+func setTransferConfig(n int) {
+	config.SetForTest(config.AppConfig{
+		Zones: []config.ZoneConfig{{Cluster: "c1", Name: "example.com.", Transfer: true}},
+	}, transferRecordList(n))
+}
+
+func ixfrRequest(serial uint32) *dns.Msg {
+	req := new(dns.Msg)
+	req.SetIxfr("example.com.", serial, "ns1.example.com.", "hostmaster.example.com.")
+	return req
+}
+
+// soaSerials 返回rrs中每条SOA的serial,其余记录用0表示
+func soaSerials(rrs []dns.RR) (serials []uint32) {
+	for _, rr := range rrs {
+		if soa, ok := rr.(*dns.SOA); ok {
+			serials = append(serials, soa.Serial)
+		} else {
+			serials = append(serials, 0)
+		}
+	}
+	return
+}
+
+func TestTransferRecords(t *testing.T) {
+	setTransferConfig(2)
+	soa0, _ := config.ZoneSOA("c1", "example.com.")
+	axfr := new(dns.Msg)
+	axfr.SetAxfr("example.com.")
+	if got := soaSerials(transferRecords("c1", "example.com.", axfr)); fmt.Sprint(got) != fmt.Sprint([]uint32{soa0.Serial, 0, 0, soa0.Serial}) {
+		t.Errorf("AXFR serials %v, want SOA, 2 records, SOA", got)
+	}
+
+	// 修改一条记录后,IXFR返回 新SOA, 旧SOA, 删除的记录, 新SOA, 新增的记录, 新SOA
+	list := transferRecordList(2)
+	list[1].Rdata = "10.1.0.1"
+	config.SetRecordsForTest(list)
+	soa1, _ := config.ZoneSOA("c1", "example.com.")
+	if soa1.Serial == soa0.Serial {
+		t.Fatal("serial did not change")
+	}
+	rrs := transferRecords("c1", "example.com.", ixfrRequest(soa0.Serial))
+	want := []uint32{soa1.Serial, soa0.Serial, 0, soa1.Serial, 0, soa1.Serial}
+	if got := soaSerials(rrs); fmt.Sprint(got) != fmt.Sprint(want) {
+		t.Fatalf("IXFR serials %v, want %v", got, want)
+	}
+	if a := rrs[2].(*dns.A); a.A.String() != "10.0.0.1" {
+		t.Errorf("removed %v, want the old record", rrs[2])
+	}
+	if a := rrs[4].(*dns.A); a.A.String() != "10.1.0.1" {
+		t.Errorf("added %v, want the new record", rrs[4])
+	}
+
+	// 客户端已是最新时只返回SOA
+	if got := soaSerials(transferRecords("c1", "example.com.", ixfrRequest(soa1.Serial))); len(got) != 1 || got[0] != soa1.Serial {
+		t.Errorf("IXFR at the current serial returned %v, want only the SOA", got)
+	}
+	// 没有客户端serial之后的变更记录时按AXFR返回
+	rrs = transferRecords("c1", "example.com.", ixfrRequest(soa0.Serial-100))
+	if got := soaSerials(rrs); len(got) != 4 || got[0] != soa1.Serial || got[1] != 0 || got[3] != soa1.Serial {
+		t.Errorf("IXFR without a journal returned %v, want the AXFR layout", got)
+	}
+}
+
+func TestSplitRecords(t *testing.T) {
+	var small []dns.RR
+	for i := 0; i < 1200; i++ {
+		small = append(small, mustRR(fmt.Sprintf("h%d.example.com. 60 IN A 10.0.%d.%d", i, i/256, i%256)))
+	}
+	if chunks := splitRecords(small, 100); len(chunks) != 3 || len(chunks[0]) != transferChunkSize || len(chunks[2]) != 200 {
+		t.Errorf("got %d chunks, want 500, 500 and 200 records", len(chunks))
+	}
+
+	// 大记录按消息长度分段
+	txt := `"` + strings.Repeat("x", 250) + `" `
+	var large []dns.RR
+	for i := 0; i < 20; i++ {
+		large = append(large, mustRR(fmt.Sprintf("t%d.example.com. 60 IN TXT %s", i, strings.Repeat(txt, 60))))
+	}
+	base := messageBase(new(dns.Msg))
+	chunks := splitRecords(large, base)
+	n := 0
+	for _, chunk := range chunks {
+		size := base
+		for _, rr := range chunk {
+			if rr != large[n] {
+				t.Fatalf("record %d out of order", n)
+			}
+			size += dns.Len(rr)
+			n++
+		}
+		if size > dns.MaxMsgSize {
+			t.Errorf("chunk of %d records is %d bytes", len(chunk), size)
+		}
+	}
+	if n != len(large) || len(chunks) < 2 {
+		t.Errorf("got %d records in %d chunks, want %d records in several chunks", n, len(chunks), len(large))
+	}
+}
+
+func TestTransferQuery(t *testing.T) {
+	setTransferConfig(10)
+	req := new(dns.Msg)
+	req.SetAxfr("example.com.")
+	if msg := transfer("c1", req); msg.Truncated || len(msg.Answer) != 12 {
+		t.Errorf("got %d records, TC %v, want the whole zone in one message", len(msg.Answer), msg.Truncated)
+	}
+	// 一个消息放不下时设置TC位
+	setTransferConfig(1200)
+	if msg := transfer("c1", req); !msg.Truncated || len(msg.Answer) != 0 {
+		t.Errorf("got %d records, TC %v, want an empty truncated reply", len(msg.Answer), msg.Truncated)
+	}
+	other := new(dns.Msg)
+	other.SetAxfr("other.com.")
+	if msg := transfer("c1", other); msg.Rcode != dns.RcodeRefused {
+		t.Errorf("transfer of an unknown zone: got %s, want REFUSED", dns.RcodeToString[msg.Rcode])
+	}
+}
+
+func TestServeTransfer(t *testing.T) {
+	setTransferConfig(1200)
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	srv := &dns.Server{Listener: l, Handler: dns.HandlerFunc(serveTransfer)}
+	go srv.ActivateAndServe()
+	defer srv.Shutdown()
+
+	req := new(dns.Msg)
+	req.SetAxfr("example.com.")
+	ch, err := new(dns.Transfer).In(req, l.Addr().String())
+	if err != nil {
+		t.Fatal(err)
+	}
+	envelopes, records := 0, 0
+	for e := range ch {
+		if e.Error != nil {
+			t.Fatal(e.Error)
+		}
+		envelopes++
+		records += len(e.RR)
+	}
+	if envelopes != 3 || records != 1202 {
+		t.Errorf("got %d records in %d messages, want 1202 in 3", records, envelopes)
+	}
+}
@@ -0,0 +1,147 @@
+package service
+
+import (
+	"dnsadminserver/internal/config"
+	"log"
+	"time"
+
+	"github.com/coredns/coredns/pb"
+	"github.com/miekg/dns"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+)
+
+// tsig 签名的有效时间窗口(秒)
+const tsigFudge = 300
+
+// tsigRequest 已通过校验的请求签名,应答使用同一个密钥签名
+type tsigRequest struct {
+	rr     *dns.TSIG
+	secret string
+}
+
+// verifyTsig 使用集群的密钥校验请求的TSIG签名。
+// 请求没有签名时返回nil;校验失败时返回TSIG错误码(BADKEY、BADSIG、BADTIME)
+func verifyTsig(cluster string, raw []byte, req *dns.Msg) (*tsigRequest, int) {
+	t := req.IsTsig()
+	if t == nil {
+		return nil, dns.RcodeSuccess
+	}
+	secret, ok := config.TsigSecret(cluster, t.Hdr.Name)
+	if !ok {
+		return nil, dns.RcodeBadKey
+	}
+	switch err := dns.TsigVerify(raw, secret, "", false); err {
+	case nil:
+		return &tsigRequest{rr: t, secret: secret}, dns.RcodeSuccess
+	case dns.ErrTime:
+		return nil, dns.RcodeBadTime
+	default:
+		return nil, dns.RcodeBadSig
+	}
+}
+
+// checkTsig 按集群的TSIG策略校验请求。done为true时请求已被拒绝,直接返回resp和err
+func checkTsig(cluster string, raw []byte, req *dns.Msg) (t *tsigRequest, resp *pb.DnsPacket, done bool, err error) {
+	policy := config.GetConfig().Tsig[cluster]
+	t, tsigRcode := verifyTsig(cluster, raw, req)
+	if tsigRcode != dns.RcodeSuccess {
+		log.Println("TSIG校验失败:", cluster, dns.RcodeToString[tsigRcode])
+		if policy.OnFailure == config.TsigFailReject {
+			return nil, nil, true, status.Errorf(codes.PermissionDenied, "tsig verification failed: %s", dns.RcodeToString[tsigRcode])
+		}
+		resp, err = packMsg(tsigError(req, tsigRcode))
+		return nil, resp, true, err
+	}
+	if t == nil && policy.Policy == config.TsigRequire {
+		if policy.OnFailure == config.TsigFailReject {
+			return nil, nil, true, status.Errorf(codes.PermissionDenied, "tsig required for cluster %s", cluster)
+		}
+		msg := new(dns.Msg)
+		msg.SetRcode(req, dns.RcodeRefused)
+		resp, err = packMsg(msg)
+		return nil, resp, true, err
+	}
+	return t, nil, false, nil
+}
+
+// tsigError 返回TSIG校验失败的应答:NOTAUTH,附带带有错误码、没有MAC的TSIG记录(RFC 8945 5.3.2)
+func tsigError(req *dns.Msg, tsigRcode int) *dns.Msg {
+	msg := new(dns.Msg)
+	msg.SetRcode(req, dns.RcodeNotAuth)
+	if t := req.IsTsig(); t != nil {
+		msg.Extra = append(msg.Extra, &dns.TSIG{
+			Hdr:        dns.RR_Header{Name: t.Hdr.Name, Rrtype: dns.TypeTSIG, Class: dns.ClassANY},
+			Algorithm:  t.Algorithm,
+			TimeSigned: t.TimeSigned,
+			Fudge:      t.Fudge,
+			OrigId:     req.Id,
+			Error:      uint16(tsigRcode),
+		})
+	}
+	return msg
+}
+
+// truncate 将应答截断到客户端可以接收的大小,签名时为应答的TSIG记录预留空间
+func truncate(msg *dns.Msg, size int, t *tsigRequest) {
+	if t == nil {
+		msg.Truncate(size)
+		return
+	}
+	// 应答的TSIG记录和请求的名称、算法相同,长度也相同
+	size = max(size, dns.MinMsgSize) - dns.Len(t.rr)
+	msg.Truncate(size)
+	// Truncate 不会截断到512字节以下,继续从后向前去掉记录
+	for msg.Len() > size {
+		if i := len(msg.Extra) - 1; i >= 0 && msg.Extra[i].Header().Rrtype != dns.TypeOPT {
+			msg.Extra = msg.Extra[:i]
+		} else if i := len(msg.Ns) - 1; i >= 0 {
+			msg.Ns = msg.Ns[:i]
+			msg.Truncated = true
+		} else if i := len(msg.Answer) - 1; i >= 0 {
+			msg.Answer = msg.Answer[:i]
+			msg.Truncated = true
+		} else {
+			return
+		}
+	}
+}
+
+// packSigned 使用请求的密钥对应答签名后打包
+func packSigned(msg *dns.Msg, t *tsigRequest) (resp *pb.DnsPacket, err error) {
+	if t == nil {
+		return packMsg(msg)
+	}
+	msg.SetTsig(t.rr.Hdr.Name, t.rr.Algorithm, tsigFudge, time.Now().Unix())
+	buf, _, err := dns.TsigGenerate(msg, t.secret, t.rr.MAC, false)
+	if err != nil {
+		return nil, err
+	}
+	return &pb.DnsPacket{Msg: buf}, nil
+}
+
+// packSignedStream 打包多个消息的应答,第一个消息的签名包含请求的MAC,
+// 其后的消息包含前一个消息的MAC并只签名时间字段(RFC 8945 5.3.1)
+func packSignedStream(msgs []*dns.Msg, t *tsigRequest) (resps []*pb.DnsPacket, err error) {
+	var mac string
+	if t != nil {
+		mac = t.rr.MAC
+	}
+	for i, msg := range msgs {
+		var resp *pb.DnsPacket
+		if t == nil {
+			if resp, err = packMsg(msg); err != nil {
+				return nil, err
+			}
+		} else {
+			msg.SetTsig(t.rr.Hdr.Name, t.rr.Algorithm, tsigFudge, time.Now().Unix())
+			var buf []byte
+			if buf, mac, err = dns.TsigGenerate(msg, t.secret, mac, i > 0); err != nil {
+				return nil, err
+			}
+			resp = &pb.DnsPacket{Msg: buf}
+		}
+		resps = append(resps, resp)
+	}
+	return
+}
@@ -0,0 +1,196 @@
+package service
+
+import (
+	"fmt"
+	"testing"
+	"time"
+
+	"dnsadminserver/internal/config"
+
+	"github.com/miekg/dns"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+)
+
+const testSecret = "c2VjcmV0LWtleS1mb3ItdGVzdHMtMTIzNDU2Nzg5MA=="
+
+// signedRequest 返回使用testSecret签名的请求和校验后的签名
+func signedRequest(t *testing.T, q string, qtype uint16) (*dns.Msg, *tsigRequest) {
+	t.Helper()
+	req := new(dns.Msg)
+	req.SetQuestion(q, qtype)
+	req.SetTsig("key.", dns.HmacSHA256, tsigFudge, 0)
+	buf, mac, err := dns.TsigGenerate(req, testSecret, "", false)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := req.Unpack(buf); err != nil {
+		t.Fatal(err)
+	}
+	rr := req.IsTsig()
+	rr.MAC = mac
+	return req, &tsigRequest{rr: rr, secret: testSecret}
+}
+
+func TestTruncateSigned(t *testing.T) {
+	req, tr := signedRequest(t, "www.example.com.", dns.TypeA)
+	for _, size := range []int{512, 1232} {
+		msg := new(dns.Msg)
+		msg.SetReply(req)
+		msg.Extra = nil
+		for i := 0; i < 100; i++ {
+			msg.Answer = append(msg.Answer, mustRR(fmt.Sprintf("www.example.com. 60 IN A 10.0.%d.%d", i/256, i%256)))
+		}
+		truncate(msg, size, tr)
+		resp, err := packSigned(msg, tr)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if len(resp.Msg) > size {
+			t.Errorf("size %d: signed reply is %d bytes", size, len(resp.Msg))
+		}
+		if !msg.Truncated {
+			t.Errorf("size %d: TC not set", size)
+		}
+		if err := dns.TsigVerify(resp.Msg, testSecret, tr.rr.MAC, false); err != nil {
+			t.Errorf("size %d: %v", size, err)
+		}
+	}
+}
+
+// signWith 使用名称为name的密钥secret对req签名,返回签名后的消息
+func signWith(t *testing.T, req *dns.Msg, name, secret string) []byte {
+	t.Helper()
+	req.SetTsig(name, dns.HmacSHA256, tsigFudge, time.Now().Unix())
+	buf, _, err := dns.TsigGenerate(req, secret, "", false)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return buf
+}
+
+func TestCheckTsig(t *testing.T) {
+	const (
+		pass    = "pass"    // 继续处理,没有签名
+		signed  = "signed"  // 继续处理,应答签名
+		refused = "refused" // REFUSED应答
+		notauth = "notauth" // 带TSIG错误码的NOTAUTH应答
+		denied  = "denied"  // grpc错误
+	)
+	requests := map[string]func(*dns.Msg) []byte{
+		"unsigned":    func(m *dns.Msg) []byte { b, _ := m.Pack(); return b },
+		"valid":       func(m *dns.Msg) []byte { return signWith(t, m, "key.", testSecret) },
+		"bad sig":     func(m *dns.Msg) []byte { return signWith(t, m, "key.", "b3RoZXItc2VjcmV0") },
+		"unknown key": func(m *dns.Msg) []byte { return signWith(t, m, "other.", testSecret) },
+	}
+	tests := []struct {
+		policy, onFailure, request string
+		want                       string
+		tsigError                  int
+	}{
+		{config.TsigOptional, config.TsigFailBadsig, "unsigned", pass, 0},
+		{config.TsigOptional, config.TsigFailBadsig, "valid", signed, 0},
+		{config.TsigOptional, config.TsigFailBadsig, "bad sig", notauth, dns.RcodeBadSig},
+		{config.TsigOptional, config.TsigFailBadsig, "unknown key", notauth, dns.RcodeBadKey},
+		{config.TsigOptional, config.TsigFailReject, "unsigned", pass, 0},
+		{config.TsigOptional, config.TsigFailReject, "valid", signed, 0},
+		{config.TsigOptional, config.TsigFailReject, "bad sig", denied, 0},
+		{config.TsigOptional, config.TsigFailReject, "unknown key", denied, 0},
+		{config.TsigRequire, config.TsigFailBadsig, "unsigned", refused, 0},
+		{config.TsigRequire, config.TsigFailBadsig, "valid", signed, 0},
+		{config.TsigRequire, config.TsigFailBadsig, "bad sig", notauth, dns.RcodeBadSig},
+		{config.TsigRequire, config.TsigFailBadsig, "unknown key", notauth, dns.RcodeBadKey},
+		{config.TsigRequire, config.TsigFailReject, "unsigned", denied, 0},
+		{config.TsigRequire, config.TsigFailReject, "valid", signed, 0},
+		{config.TsigRequire, config.TsigFailReject, "bad sig", denied, 0},
+		{config.TsigRequire, config.TsigFailReject, "unknown key", denied, 0},
+	}
+	for _, tc := range tests {
+		name := tc.policy + "/" + tc.onFailure + "/" + tc.request
+		config.SetForTest(config.AppConfig{Tsig: map[string]config.TsigConfig{
+			"c1": {Keys: map[string]string{"key.": testSecret}, Policy: tc.policy, OnFailure: tc.onFailure},
+		}}, nil)
+		m := new(dns.Msg)
+		m.SetQuestion("www.example.com.", dns.TypeA)
+		raw := requests[tc.request](m)
+		req := new(dns.Msg)
+		if err := req.Unpack(raw); err != nil {
+			t.Fatal(err)
+		}
+		tr, resp, done, err := checkTsig("c1", raw, req)
+		got := pass
+		switch {
+		case err != nil:
+			if status.Code(err) != codes.PermissionDenied {
+				t.Errorf("%s: got error %v, want PermissionDenied", name, err)
+			}
+			got = denied
+		case done:
+			reply := new(dns.Msg)
+			if err := reply.Unpack(resp.Msg); err != nil {
+				t.Fatal(err)
+			}
+			switch reply.Rcode {
+			case dns.RcodeRefused:
+				got = refused
+			case dns.RcodeNotAuth:
+				got = notauth
+				if r := reply.IsTsig(); r == nil || int(r.Error) != tc.tsigError || r.MAC != "" {
+					t.Errorf("%s: got TSIG %v, want error %s without MAC", name, r, dns.RcodeToString[tc.tsigError])
+				}
+			default:
+				got = dns.RcodeToString[reply.Rcode]
+			}
+		case tr != nil:
+			got = signed
+		}
+		if got != tc.want {
+			t.Errorf("%s: got %s, want %s", name, got, tc.want)
+		}
+	}
+}
+
+func TestPackSignedStream(t *testing.T) {
+	req, tr := signedRequest(t, "example.com.", dns.TypeAXFR)
+	messages := func() (msgs []*dns.Msg) {
+		for i := 0; i < 3; i++ {
+			msg := new(dns.Msg)
+			msg.SetReply(req)
+			msg.Extra = nil
+			msg.Answer = []dns.RR{mustRR(fmt.Sprintf("h%d.example.com. 60 IN A 10.0.0.%d", i, i))}
+			msgs = append(msgs, msg)
+		}
+		return
+	}
+	resps, err := packSignedStream(messages(), tr)
+	if err != nil {
+		t.Fatal(err)
+	}
+	// 第一个消息的签名包含请求的MAC,之后的消息包含前一个消息的MAC并只签名时间字段
+	mac := tr.rr.MAC
+	for i, resp := range resps {
+		// TsigVerify 会修改消息头中的记录数,先读出签名
+		m := new(dns.Msg)
+		if err := m.Unpack(resp.Msg); err != nil {
+			t.Fatal(err)
+		}
+		if err := dns.TsigVerify(resp.Msg, testSecret, mac, i > 0); err != nil {
+			t.Fatalf("message %d: %v", i, err)
+		}
+		mac = m.IsTsig().MAC
+	}
+	// 没有包含前一个消息的MAC时校验失败
+	resps, _ = packSignedStream(messages(), tr)
+	if err := dns.TsigVerify(resps[2].Msg, testSecret, tr.rr.MAC, true); err != dns.ErrSig {
+		t.Errorf("message 2 with the MAC of the request: got %v, want %v", err, dns.ErrSig)
+	}
+
+	// 没有签名时只打包
+	resps, err = packSignedStream(messages(), nil)
+	if err != nil || len(resps) != 3 {
+		t.Fatalf("got %d messages, %v", len(resps), err)
+	}
+	if m := new(dns.Msg); m.Unpack(resps[0].Msg) != nil || m.IsTsig() != nil {
+		t.Error("unsigned stream has a TSIG record")
+	}
+}
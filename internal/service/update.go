@@ -0,0 +1,295 @@
+package service
+
+import (
+	"context"
+	"dnsadminserver/internal/config"
+	"dnsadminserver/internal/models"
+	"dnsadminserver/internal/source"
+	"errors"
+	"fmt"
+	"log"
+
+	"github.com/coredns/coredns/pb"
+	"github.com/miekg/dns"
+)
+
+// update 处理通过Query发送的动态更新,更新必须使用集群的TSIG密钥签名(t为已校验的签名),应答使用同一个密钥签名
+func (s *DnsServiceServer) update(ctx context.Context, cluster string, t *tsigRequest, req *dns.Msg) (*pb.DnsPacket, error) {
+	msg := new(dns.Msg)
+	if t == nil {
+		msg.SetRcode(req, dns.RcodeRefused)
+		return packMsg(msg)
+	}
+	msg.SetRcode(req, update(ctx, cluster, req, "dnsupdate:"+t.rr.Hdr.Name))
+	return packSigned(msg, t)
+}
+
+// update 处理动态更新(RFC 2136):校验zone和前提条件后,在一个事务中将变更写入记录来源,
+// 涉及zone文件等不能写入的记录时拒绝更新。写入后通过redis发布变更消息,所有pod收到消息后更新缓存。返回应答的rcode
+func update(ctx context.Context, cluster string, req *dns.Msg, user string) int {
+	if len(req.Question) != 1 || req.Question[0].Qtype != dns.TypeSOA {
+		return dns.RcodeFormatError
+	}
+	zoneName := dns.CanonicalName(req.Question[0].Name)
+	zone, ok := config.FindZone(cluster, zoneName)
+	if !ok || zone.Name != zoneName || !zone.AllowUpdate {
+		return dns.RcodeNotAuth
+	}
+	writer, ok := config.Source.(source.RecordWriter)
+	if !ok {
+		log.Println("update.go: update() error: ", config.Source.Name(), "不支持写入记录")
+		return dns.RcodeNotImplemented
+	}
+	if rcode := checkPrereqs(cluster, zone, req.Answer); rcode != dns.RcodeSuccess {
+		return rcode
+	}
+	for _, rr := range req.Ns {
+		h := rr.Header()
+		if !dns.IsSubDomain(zone.Name, h.Name) {
+			return dns.RcodeNotZone
+		}
+		if h.Class != dns.ClassINET && h.Class != dns.ClassANY && h.Class != dns.ClassNONE {
+			return dns.RcodeFormatError
+		}
+	}
+
+	set := newUpdateSet(cluster)
+	for _, rr := range req.Ns {
+		h := rr.Header()
+		apex := dns.CanonicalName(h.Name) == zone.Name
+		// zone顶点的SOA和配置的NS由服务生成,不接受更新
+		if h.Rrtype == dns.TypeSOA || (apex && h.Rrtype == dns.TypeNS && len(zone.Ns) > 0) {
+			continue
+		}
+		switch h.Class {
+		case dns.ClassINET:
+			set.add(rr)
+		case dns.ClassANY:
+			types := []uint16{h.Rrtype}
+			if h.Rrtype == dns.TypeANY {
+				types = set.types(h.Name)
+			}
+			for _, t := range types {
+				if apex && (t == dns.TypeSOA || t == dns.TypeNS) {
+					continue
+				}
+				set.remove(t, h.Name, nil)
+			}
+		case dns.ClassNONE:
+			set.remove(h.Rrtype, h.Name, rr)
+		}
+	}
+	adds, deletes := set.adds(), set.deletes
+	if len(adds) == 0 && len(deletes) == 0 {
+		return dns.RcodeSuccess
+	}
+
+	clusterId, err := writer.ClusterId(ctx, cluster)
+	if err != nil {
+		log.Println("update.go: update() error: ", err)
+		return dns.RcodeServerFailure
+	}
+	ids := make([]int64, 0, len(deletes))
+	for id := range deletes {
+		ids = append(ids, id)
+	}
+	if err := writer.UpdateRecords(ctx, clusterId, adds, ids, user); err != nil {
+		log.Println("update.go: update() error: ", "写入记录失败,全部回滚", err)
+		if errors.Is(err, source.ErrRecordNotFound) {
+			// 要删除的记录来自zone文件等不能写入的来源
+			return dns.RcodeRefused
+		}
+		return dns.RcodeServerFailure
+	}
+	for id, key := range deletes {
+		publish(ctx, fmt.Sprintf("%s:%d:delete", key, id))
+	}
+	reloads := map[string]bool{}
+	for _, r := range adds {
+		reloads[fmt.Sprintf("%d:%s:%d:reload", clusterId, r.Name, r.Qtype)] = true
+	}
+	for payload := range reloads {
+		publish(ctx, payload)
+	}
+	log.Println("动态更新成功:", cluster, zone.Name, user, "新增:", len(adds), "删除:", len(deletes))
+	return dns.RcodeSuccess
+}
+
+func publish(ctx context.Context, payload string) {
+	if err := config.PublishChange(ctx, payload); err != nil {
+		log.Println("update.go: publish() error: ", "发布变更消息失败", payload, err)
+	}
+}
+
+// updateSet 按顺序应用更新段的工作集合,每个名称和类型的记录在第一次用到时从缓存加载,
+// 之后的更新基于前面的更新结果,例如先新增后删除的记录不会写入
+type updateSet struct {
+	cluster string
+	keys    []string              // 加载顺序
+	rrsets  map[string][]updateRR // 缓存key -> 当前的记录
+	removed map[string][]updateRR // 缓存key -> 删除的已有记录
+	deletes map[int64]string      // 删除的记录id -> 缓存key
+}
+
+// updateRR 工作集合中的记录,id为0表示本次更新新增的记录
+type updateRR struct {
+	id int64
+	rr dns.RR
+}
+
+func newUpdateSet(cluster string) *updateSet {
+	return &updateSet{
+		cluster: cluster,
+		rrsets:  map[string][]updateRR{},
+		removed: map[string][]updateRR{},
+		deletes: map[int64]string{},
+	}
+}
+
+// rrset 返回名称和类型对应的缓存key和当前的记录
+func (s *updateSet) rrset(qtype uint16, name string) (string, []updateRR) {
+	key := config.RecordKey(s.cluster, qtype, name)
+	rrs, ok := s.rrsets[key]
+	if !ok {
+		for _, r := range config.GetDnsRecords(key) {
+			rrs = append(rrs, updateRR{id: r.Id, rr: r.DnsRR})
+		}
+		s.rrsets[key] = rrs
+		s.keys = append(s.keys, key)
+	}
+	return key, rrs
+}
+
+// add 新增rr,已存在相同的记录时忽略。重新新增本次删除的已有记录时保留原记录
+func (s *updateSet) add(rr dns.RR) {
+	rr = dns.Copy(rr)
+	rr.Header().Name = dns.CanonicalName(rr.Header().Name)
+	key, rrs := s.rrset(rr.Header().Rrtype, rr.Header().Name)
+	for _, r := range rrs {
+		if r.rr != nil && dns.IsDuplicate(r.rr, rr) {
+			return
+		}
+	}
+	for i, r := range s.removed[key] {
+		if r.rr != nil && dns.IsDuplicate(r.rr, rr) {
+			delete(s.deletes, r.id)
+			s.removed[key] = append(s.removed[key][:i:i], s.removed[key][i+1:]...)
+			s.rrsets[key] = append(rrs, r)
+			return
+		}
+	}
+	s.rrsets[key] = append(rrs, updateRR{rr: rr})
+}
+
+// remove 删除名称和类型下与match相同的记录,match为nil时删除全部记录
+func (s *updateSet) remove(qtype uint16, name string, match dns.RR) {
+	if match != nil {
+		match = dns.Copy(match)
+		match.Header().Class = dns.ClassINET
+	}
+	key, rrs := s.rrset(qtype, name)
+	var keep []updateRR
+	for _, r := range rrs {
+		if match != nil && (r.rr == nil || !dns.IsDuplicate(r.rr, match)) {
+			keep = append(keep, r)
+			continue
+		}
+		if r.id != 0 {
+			s.deletes[r.id] = key
+			s.removed[key] = append(s.removed[key], r)
+		}
+	}
+	s.rrsets[key] = keep
+}
+
+// types 返回名称下当前存在记录的全部类型
+func (s *updateSet) types(name string) (types []uint16) {
+	for t := range dns.TypeToString {
+		if _, rrs := s.rrset(t, name); len(rrs) > 0 {
+			types = append(types, t)
+		}
+	}
+	return
+}
+
+// adds 返回需要写入的新增记录
+func (s *updateSet) adds() (adds []models.DnsRecords) {
+	for _, key := range s.keys {
+		for _, r := range s.rrsets[key] {
+			if r.id == 0 {
+				adds = append(adds, source.RecordFromRR(s.cluster, r.rr))
+			}
+		}
+	}
+	return
+}
+
+// matchRecords 返回缓存中与rr名称、类型和rdata相同的记录
+func matchRecords(cluster string, rr dns.RR) (result []models.DnsRR) {
+	rr = dns.Copy(rr)
+	rr.Header().Class = dns.ClassINET
+	for _, r := range config.GetDnsRecords(config.RecordKey(cluster, rr.Header().Rrtype, rr.Header().Name)) {
+		if r.DnsRR != nil && dns.IsDuplicate(r.DnsRR, rr) {
+			result = append(result, r)
+		}
+	}
+	return
+}
+
+// nameTypes 返回名称下存在记录的全部类型
+func nameTypes(cluster, name string) (types []uint16) {
+	for t := range dns.TypeToString {
+		if len(config.GetDnsRecords(config.RecordKey(cluster, t, name))) > 0 {
+			types = append(types, t)
+		}
+	}
+	return
+}
+
+// checkPrereqs 校验更新的前提条件(RFC 2136 3.2)
+func checkPrereqs(cluster string, zone config.ZoneConfig, prereqs []dns.RR) int {
+	valueDependent := map[string][]dns.RR{}
+	for _, rr := range prereqs {
+		h := rr.Header()
+		if !dns.IsSubDomain(zone.Name, h.Name) {
+			return dns.RcodeNotZone
+		}
+		switch h.Class {
+		case dns.ClassANY:
+			if h.Rrtype == dns.TypeANY {
+				if len(nameTypes(cluster, h.Name)) == 0 {
+					return dns.RcodeNameError
+				}
+			} else if len(config.GetDnsRecords(config.RecordKey(cluster, h.Rrtype, h.Name))) == 0 {
+				return dns.RcodeNXRrset
+			}
+		case dns.ClassNONE:
+			if h.Rrtype == dns.TypeANY {
+				if len(nameTypes(cluster, h.Name)) > 0 {
+					return dns.RcodeYXDomain
+				}
+			} else if len(config.GetDnsRecords(config.RecordKey(cluster, h.Rrtype, h.Name))) > 0 {
+				return dns.RcodeYXRrset
+			}
+		case dns.ClassINET:
+			key := config.RecordKey(cluster, h.Rrtype, h.Name)
+			valueDependent[key] = append(valueDependent[key], rr)
+		default:
+			return dns.RcodeFormatError
+		}
+	}
+	// 值相关的前提条件:名称和类型相同的记录集合必须与现有记录完全一致
+	for _, rrs := range valueDependent {
+		h := rrs[0].Header()
+		existing := config.GetDnsRecords(config.RecordKey(cluster, h.Rrtype, h.Name))
+		if len(existing) != len(rrs) {
+			return dns.RcodeNXRrset
+		}
+		for _, rr := range rrs {
+			if len(matchRecords(cluster, rr)) == 0 {
+				return dns.RcodeNXRrset
+			}
+		}
+	}
+	return dns.RcodeSuccess
+}
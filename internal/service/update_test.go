@@ -0,0 +1,177 @@
+package service
+
+import (
+	"context"
+	"sort"
+	"testing"
+
+	"dnsadminserver/internal/config"
+	"dnsadminserver/internal/models"
+
+	"github.com/miekg/dns"
+)
+
+// testWriter 记录写入操作的记录来源
+type testWriter struct {
+	adds    []models.DnsRecords
+	deletes []int64
+}
+
+func (w *testWriter) LoadAll(ctx context.Context) ([]models.DnsRecords, error) { return nil, nil }
+func (w *testWriter) LoadCluster(ctx context.Context, cluster string) ([]models.DnsRecords, error) {
+	return nil, nil
+}
+func (w *testWriter) LoadByName(ctx context.Context, cluster, name string, qtype uint16) ([]models.DnsRecords, error) {
+	return nil, nil
+}
+func (w *testWriter) Watch(ctx context.Context, changed func(cluster string)) error { return nil }
+func (w *testWriter) Name() string                                                  { return "test" }
+func (w *testWriter) ClusterId(ctx context.Context, cluster string) (int64, error)  { return 1, nil }
+func (w *testWriter) UpdateRecords(ctx context.Context, clusterId int64, adds []models.DnsRecords, deletes []int64, user string) error {
+	w.adds, w.deletes = adds, deletes
+	sort.Slice(w.deletes, func(i, j int) bool { return w.deletes[i] < w.deletes[j] })
+	return nil
+}
+
+// setUpdateConfig 配置c1中允许动态更新的zone example.com.,返回记录写入操作的记录来源
+func setUpdateConfig(t *testing.T) *testWriter {
+	config.SetForTest(config.AppConfig{
+		Zones: []config.ZoneConfig{{Cluster: "c1", Name: "example.com.", AllowUpdate: true}},
+	}, []models.DnsRecords{
+		{Id: 1, ClusterName: "c1", Name: "www.example.com.", Qtype: dns.TypeA, Qclass: 1, Ttl: 60, Rdata: "10.0.0.1", Weight: 1},
+		{Id: 2, ClusterName: "c1", Name: "www.example.com.", Qtype: dns.TypeA, Qclass: 1, Ttl: 60, Rdata: "10.0.0.2", Weight: 1},
+		{Id: 3, ClusterName: "c1", Name: "Mail.Example.com.", Qtype: dns.TypeTXT, Qclass: 1, Ttl: 60, Rdata: "hello", Weight: 1},
+	})
+	w := &testWriter{}
+	config.Source = w
+	t.Cleanup(func() { config.Source = nil })
+	return w
+}
+
+func updateMsg(prereqs []string, updates ...string) *dns.Msg {
+	m := new(dns.Msg)
+	m.SetUpdate("example.com.")
+	for _, s := range prereqs {
+		m.Answer = append(m.Answer, mustRR(s))
+	}
+	for _, s := range updates {
+		m.Ns = append(m.Ns, mustRR(s))
+	}
+	return m
+}
+
+func mustRR(s string) dns.RR {
+	rr, err := dns.NewRR(s)
+	if err != nil {
+		panic(err)
+	}
+	return rr
+}
+
+// deleteRR 返回class为NONE的删除记录
+func deleteRR(s string) dns.RR {
+	rr := mustRR(s)
+	rr.Header().Class = dns.ClassNONE
+	rr.Header().Ttl = 0
+	return rr
+}
+
+// rrsetRR 返回没有rdata、class为class的记录,用于删除记录集合和前提条件
+func rrsetRR(name string, qtype, class uint16) dns.RR {
+	return &dns.ANY{Hdr: dns.RR_Header{Name: name, Rrtype: qtype, Class: class}}
+}
+
+func TestUpdateInOrder(t *testing.T) {
+	w := setUpdateConfig(t)
+	m := updateMsg(nil, "new.example.com. 60 IN A 10.0.1.1")
+	m.Ns = append(m.Ns, deleteRR("new.example.com. 60 IN A 10.0.1.1"))
+	if rcode := update(context.Background(), "c1", m, "test"); rcode != dns.RcodeSuccess {
+		t.Fatalf("rcode %s", dns.RcodeToString[rcode])
+	}
+	if w.adds != nil || w.deletes != nil {
+		t.Errorf("add followed by delete wrote adds %v, deletes %v, want nothing", w.adds, w.deletes)
+	}
+
+	// 删除已有记录后再新增相同的记录时保留原记录
+	m = updateMsg(nil)
+	m.Ns = append(m.Ns, deleteRR("www.example.com. 60 IN A 10.0.0.1"), mustRR("www.example.com. 60 IN A 10.0.0.1"), mustRR("www.example.com. 60 IN A 10.0.0.3"))
+	if rcode := update(context.Background(), "c1", m, "test"); rcode != dns.RcodeSuccess {
+		t.Fatalf("rcode %s", dns.RcodeToString[rcode])
+	}
+	if len(w.deletes) != 0 || len(w.adds) != 1 || w.adds[0].Rdata != "10.0.0.3" {
+		t.Errorf("got adds %v, deletes %v, want only the add of 10.0.0.3", w.adds, w.deletes)
+	}
+
+	// 删除整个记录集合后新增的记录仍然写入
+	w.adds, w.deletes = nil, nil
+	m = updateMsg(nil)
+	m.Ns = append(m.Ns, mustRR("www.example.com. 60 IN A 10.0.0.4"), rrsetRR("www.example.com.", dns.TypeA, dns.ClassANY))
+	m.Ns = append(m.Ns, mustRR("www.example.com. 60 IN A 10.0.0.5"))
+	if rcode := update(context.Background(), "c1", m, "test"); rcode != dns.RcodeSuccess {
+		t.Fatalf("rcode %s", dns.RcodeToString[rcode])
+	}
+	if len(w.deletes) != 2 || len(w.adds) != 1 || w.adds[0].Rdata != "10.0.0.5" {
+		t.Errorf("got adds %v, deletes %v, want deletes 1, 2 and the add of 10.0.0.5", w.adds, w.deletes)
+	}
+}
+
+func TestUpdateCanonicalNames(t *testing.T) {
+	w := setUpdateConfig(t)
+
+	// 大小写不同的名称对应相同的记录
+	m := updateMsg(nil, "WWW.Example.com. 60 IN A 10.0.0.1")
+	m.Answer = []dns.RR{rrsetRR("WWW.example.COM.", dns.TypeA, dns.ClassANY)}
+	m.Ns = append(m.Ns, deleteRR("mail.example.com. 60 IN TXT hello"))
+	if rcode := update(context.Background(), "c1", m, "test"); rcode != dns.RcodeSuccess {
+		t.Fatalf("rcode %s", dns.RcodeToString[rcode])
+	}
+	if len(w.adds) != 0 || len(w.deletes) != 1 || w.deletes[0] != 3 {
+		t.Errorf("got adds %v, deletes %v, want only the delete of record 3", w.adds, w.deletes)
+	}
+
+	// 新增的记录使用小写名称
+	m = updateMsg(nil, "New.Example.COM. 60 IN A 10.0.1.1")
+	if rcode := update(context.Background(), "c1", m, "test"); rcode != dns.RcodeSuccess {
+		t.Fatalf("rcode %s", dns.RcodeToString[rcode])
+	}
+	if len(w.adds) != 1 || w.adds[0].Name != "new.example.com." {
+		t.Errorf("got adds %v, want new.example.com.", w.adds)
+	}
+	if r := config.GetDnsRecords(config.RecordKey("c1", dns.TypeTXT, "MAIL.example.com.")); len(r) != 1 {
+		t.Errorf("lookup with a mixed case name = %d records, want 1", len(r))
+	}
+}
+
+func TestUpdatePrereqs(t *testing.T) {
+	setUpdateConfig(t)
+	tests := []struct {
+		name  string
+		qtype uint16
+		class uint16
+		rcode int
+	}{
+		{"WWW.example.com.", dns.TypeA, dns.ClassANY, dns.RcodeSuccess},
+		{"www.example.com.", dns.TypeAAAA, dns.ClassANY, dns.RcodeNXRrset},
+		{"none.example.com.", dns.TypeANY, dns.ClassANY, dns.RcodeNameError},
+		{"www.example.com.", dns.TypeANY, dns.ClassNONE, dns.RcodeYXDomain},
+		{"www.example.com.", dns.TypeA, dns.ClassNONE, dns.RcodeYXRrset},
+		{"www.other.com.", dns.TypeA, dns.ClassANY, dns.RcodeNotZone},
+	}
+	for _, tc := range tests {
+		m := updateMsg(nil)
+		m.Answer = []dns.RR{rrsetRR(tc.name, tc.qtype, tc.class)}
+		if rcode := update(context.Background(), "c1", m, "test"); rcode != tc.rcode {
+			t.Errorf("%s type %d class %d: got %s, want %s", tc.name, tc.qtype, tc.class, dns.RcodeToString[rcode], dns.RcodeToString[tc.rcode])
+		}
+	}
+
+	// 值相关的前提条件需要完全一致的记录集合
+	m := updateMsg([]string{"www.example.com. 0 IN A 10.0.0.1"})
+	if rcode := update(context.Background(), "c1", m, "test"); rcode != dns.RcodeNXRrset {
+		t.Errorf("partial rrset: got %s, want NXRRSET", dns.RcodeToString[rcode])
+	}
+	m = updateMsg([]string{"WWW.example.com. 0 IN A 10.0.0.1", "www.example.com. 0 IN A 10.0.0.2"})
+	if rcode := update(context.Background(), "c1", m, "test"); rcode != dns.RcodeSuccess {
+		t.Errorf("full rrset: got %s, want NOERROR", dns.RcodeToString[rcode])
+	}
+}
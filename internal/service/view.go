@@ -0,0 +1,135 @@
+package service
+
+import (
+	"context"
+	"dnsadminserver/internal/config"
+	"dnsadminserver/internal/models"
+	"net"
+
+	"github.com/miekg/dns"
+	"google.golang.org/grpc/metadata"
+	"google.golang.org/grpc/peer"
+)
+
+// client 查询的客户端地址,用于选择记录的view
+type client struct {
+	ip    net.IP
+	ecs   *dns.EDNS0_SUBNET // 请求中的ECS选项(RFC 7871),没有时为nil
+	scope uint8             // 应答ECS选项的scope prefix
+	geo   *geoInfo          // 第一次匹配geo选择器时查询
+}
+
+// 网段匹配优先于geo选择器,网段之间按前缀长度比较
+const scoreNet = 1000
+
+// clientFor 返回查询的客户端地址,依次使用ECS选项、grpc元数据client-ip和grpc对端的地址
+func clientFor(ctx context.Context, me metadata.MD, req *dns.Msg) *client {
+	c := &client{}
+	if opt := req.IsEdns0(); opt != nil {
+		for _, o := range opt.Option {
+			if e, ok := o.(*dns.EDNS0_SUBNET); ok {
+				c.ecs = e
+				// source prefix为0表示客户端不希望使用ECS
+				if e.SourceNetmask > 0 {
+					c.ip = e.Address
+				}
+			}
+		}
+	}
+	if c.ip == nil {
+		c.ip = net.ParseIP(firstMD(me, "client-ip"))
+	}
+	if c.ip == nil {
+		if p, ok := peer.FromContext(ctx); ok {
+			if host, _, err := net.SplitHostPort(p.Addr.String()); err == nil {
+				c.ip = net.ParseIP(host)
+			}
+		}
+	}
+	return c
+}
+
+// selectView 选择与客户端地址最匹配的view的记录:网段优先,前缀长的优先,
+// 其次是ASN、国家、大洲;没有匹配的view时使用未设置view的记录
+func (c *client) selectView(cluster string, records []models.DnsRR) []models.DnsRR {
+	type result struct{ score, prefix int }
+	best, bestResult := "", result{-1, 0}
+	scoped := false
+	matched := map[string]result{}
+	for _, r := range records {
+		if r.View == "" {
+			continue
+		}
+		scoped = true
+		m, ok := matched[r.View]
+		if !ok {
+			m.score, m.prefix = c.match(r.View)
+			matched[r.View] = m
+		}
+		if m.score > bestResult.score {
+			best, bestResult = r.View, m
+		}
+	}
+	if !scoped {
+		return records
+	}
+	// 应答适用于匹配的网段;使用默认记录时只能适用于客户端声明的网段
+	if bestResult.score >= 0 {
+		c.scope = max(c.scope, uint8(bestResult.prefix))
+	} else if c.ecs != nil {
+		c.scope = max(c.scope, c.ecs.SourceNetmask)
+	}
+	if best == "" {
+		viewSelections.WithLabelValues(cluster, "default").Inc()
+	} else {
+		viewSelections.WithLabelValues(cluster, best).Inc()
+	}
+	var out []models.DnsRR
+	for _, r := range records {
+		if r.View == best {
+			out = append(out, r)
+		}
+	}
+	return out
+}
+
+// match 返回view与客户端地址的匹配优先级和匹配网段的前缀长度,不匹配时优先级为-1
+func (c *client) match(view string) (score, prefix int) {
+	score = -1
+	if c.ip == nil {
+		return
+	}
+	if c.geo == nil {
+		if _, _, isGeo := geoMatch(view, geoInfo{}); isGeo {
+			info := lookupGeo(c.ip)
+			c.geo = &info
+		}
+	}
+	if c.geo != nil {
+		if s, p, isGeo := geoMatch(view, *c.geo); isGeo {
+			return s, p
+		}
+	}
+	for _, n := range config.ViewNets(view) {
+		if n.Contains(c.ip) {
+			ones, _ := n.Mask.Size()
+			if scoreNet+ones > score {
+				score, prefix = scoreNet+ones, ones
+			}
+		}
+	}
+	return
+}
+
+// option 返回应答的ECS选项,请求没有ECS时返回nil
+func (c *client) option() *dns.EDNS0_SUBNET {
+	if c.ecs == nil {
+		return nil
+	}
+	e := *c.ecs
+	e.SourceScope = c.scope
+	if e.SourceNetmask == 0 {
+		e.SourceScope = 0
+	}
+	return &e
+}
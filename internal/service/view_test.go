@@ -0,0 +1,135 @@
+package service
+
+import (
+	"context"
+	"fmt"
+	"net"
+	"testing"
+
+	"dnsadminserver/internal/config"
+	"dnsadminserver/internal/models"
+
+	"github.com/coredns/coredns/pb"
+	"github.com/miekg/dns"
+	"google.golang.org/grpc/metadata"
+)
+
+// viewed 返回id为1..n、view为views的记录
+func viewed(views ...string) []models.DnsRR {
+	records := make([]models.DnsRR, len(views))
+	for i, v := range views {
+		records[i] = models.DnsRR{Id: int64(i + 1), View: v, Weight: 1}
+	}
+	return records
+}
+
+func ecsRequest(ip string, netmask uint8) *dns.Msg {
+	req := new(dns.Msg)
+	req.SetQuestion("www.example.com.", dns.TypeA)
+	req.SetEdns0(4096, false)
+	family := uint16(1)
+	if net.ParseIP(ip).To4() == nil {
+		family = 2
+	}
+	opt := req.IsEdns0()
+	opt.Option = append(opt.Option, &dns.EDNS0_SUBNET{Code: dns.EDNS0SUBNET, Family: family, SourceNetmask: netmask, Address: net.ParseIP(ip)})
+	return req
+}
+
+func TestClientFor(t *testing.T) {
+	md := metadata.Pairs("client-ip", "192.0.2.1")
+	tests := []struct {
+		req  *dns.Msg
+		md   metadata.MD
+		want string
+	}{
+		{ecsRequest("10.1.2.0", 24), md, "10.1.2.0"},
+		// source prefix为0时不使用ECS的地址
+		{ecsRequest("10.1.2.0", 0), md, "192.0.2.1"},
+		{new(dns.Msg).SetQuestion("www.example.com.", dns.TypeA), md, "192.0.2.1"},
+		{new(dns.Msg).SetQuestion("www.example.com.", dns.TypeA), metadata.MD{}, "<nil>"},
+	}
+	for i, tc := range tests {
+		if c := clientFor(context.Background(), tc.md, tc.req); c.ip.String() != tc.want {
+			t.Errorf("test %d: got client %s, want %s", i, c.ip, tc.want)
+		}
+	}
+}
+
+func TestSelectView(t *testing.T) {
+	config.SetForTest(config.AppConfig{Views: map[string][]string{
+		"office": {"10.1.0.0/16", "192.168.0.0/24"},
+	}}, nil)
+	records := viewed("", "office", "10.1.2.0/24", "10.0.0.0/8", "")
+	tests := []struct {
+		ip    string
+		ids   []int64
+		scope uint8
+	}{
+		{"10.1.2.3", []int64{3}, 24}, // 前缀最长的网段
+		{"10.1.3.3", []int64{2}, 16}, // 命名的view
+		{"10.9.9.9", []int64{4}, 8},
+		{"192.168.0.9", []int64{2}, 24},
+		{"172.16.0.1", []int64{1, 5}, 0}, // 没有匹配时使用默认记录
+	}
+	for _, tc := range tests {
+		c := &client{ip: net.ParseIP(tc.ip)}
+		out := c.selectView("c1", records)
+		if got := ids(out); fmt.Sprint(got) != fmt.Sprint(tc.ids) {
+			t.Errorf("%s: got records %v, want %v", tc.ip, got, tc.ids)
+		}
+		if c.scope != tc.scope {
+			t.Errorf("%s: got scope %d, want %d", tc.ip, c.scope, tc.scope)
+		}
+	}
+
+	// 没有view的记录不设置scope
+	c := &client{ip: net.ParseIP("10.1.2.3")}
+	if out := c.selectView("c1", viewed("", "")); len(out) != 2 || c.scope != 0 {
+		t.Errorf("got %d records and scope %d, want all records and scope 0", len(out), c.scope)
+	}
+	// 使用默认记录时应答只适用于客户端声明的网段
+	c = clientFor(context.Background(), metadata.MD{}, ecsRequest("172.16.0.0", 20))
+	c.selectView("c1", records)
+	if e := c.option(); e == nil || e.SourceScope != 20 || e.SourceNetmask != 20 {
+		t.Errorf("got ECS option %v, want scope 20", e)
+	}
+}
+
+func TestQueryECS(t *testing.T) {
+	config.SetForTest(config.AppConfig{}, []models.DnsRecords{
+		{Id: 1, ClusterName: "c1", Name: "www.example.com.", Qtype: dns.TypeA, Qclass: 1, Ttl: 60, Rdata: "10.0.0.1", Weight: 1},
+		{Id: 2, ClusterName: "c1", Name: "www.example.com.", Qtype: dns.TypeA, Qclass: 1, Ttl: 60, Rdata: "10.0.0.2", Weight: 1, View: "10.1.0.0/16"},
+	})
+	ctx := metadata.NewIncomingContext(context.Background(), metadata.Pairs("cluster", "c1"))
+	for _, tc := range []struct {
+		ip    string
+		want  string
+		scope uint8
+	}{
+		{"10.1.2.0", "10.0.0.2", 16},
+		{"10.2.2.0", "10.0.0.1", 24},
+	} {
+		buf, _ := ecsRequest(tc.ip, 24).Pack()
+		resp, err := (&DnsServiceServer{}).Query(ctx, &pb.DnsPacket{Msg: buf})
+		if err != nil {
+			t.Fatal(err)
+		}
+		m := new(dns.Msg)
+		if err := m.Unpack(resp.Msg); err != nil {
+			t.Fatal(err)
+		}
+		if len(m.Answer) != 1 || m.Answer[0].(*dns.A).A.String() != tc.want {
+			t.Errorf("%s: got %v, want %s", tc.ip, m.Answer, tc.want)
+		}
+		var e *dns.EDNS0_SUBNET
+		if opt := m.IsEdns0(); opt != nil {
+			for _, o := range opt.Option {
+				e, _ = o.(*dns.EDNS0_SUBNET)
+			}
+		}
+		if e == nil || e.SourceScope != tc.scope {
+			t.Errorf("%s: got ECS option %v, want scope %d", tc.ip, e, tc.scope)
+		}
+	}
+}
@@ -0,0 +1,183 @@
+package service
+
+import (
+	"dnsadminserver/internal/config"
+	"sync"
+
+	"github.com/coredns/coredns/pb"
+	"github.com/miekg/dns"
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/metadata"
+	"google.golang.org/grpc/status"
+)
+
+// 每个订阅缓冲的变更数量,缓冲满时断开订阅,由客户端重新订阅并清空缓存
+const watchBuffer = 64
+
+// NotifyServiceServer 为CoreDNS插件提供zone变更的订阅,用于缓存失效:
+//
+//	service NotifyService {
+//	  rpc Watch (DnsPacket) returns (stream DnsPacket);
+//	  rpc Transfer (DnsPacket) returns (stream DnsPacket);
+//	}
+//
+// 请求中的DNS消息的问题为要订阅的zone,没有问题时订阅集群的全部zone。
+// 每次变更推送NOTIFY消息,问题为zone的SOA,应答部分与IXFR相同:
+// 新SOA, 旧SOA, 删除的记录, 新SOA, 新增的记录, 新SOA。
+// 记录较多时分成多个消息推送,收到本次变更的第4条SOA后推送完整。
+// Transfer 处理AXFR/IXFR请求,与TCP区域传送一样记录较多时分成多个消息推送
+type NotifyServiceServer interface {
+	Watch(*pb.DnsPacket, grpc.ServerStream) error
+	Transfer(*pb.DnsPacket, grpc.ServerStream) error
+}
+
+var notifyServiceDesc = grpc.ServiceDesc{
+	ServiceName: "coredns.dns.NotifyService",
+	HandlerType: (*NotifyServiceServer)(nil),
+	Streams: []grpc.StreamDesc{
+		{
+			StreamName:    "Watch",
+			Handler:       watchHandler,
+			ServerStreams: true,
+		},
+		{
+			StreamName:    "Transfer",
+			Handler:       transferHandler,
+			ServerStreams: true,
+		},
+	},
+	Metadata: "notify.proto",
+}
+
+func watchHandler(srv interface{}, stream grpc.ServerStream) error {
+	m := new(pb.DnsPacket)
+	if err := stream.RecvMsg(m); err != nil {
+		return err
+	}
+	return srv.(NotifyServiceServer).Watch(m, stream)
+}
+
+func transferHandler(srv interface{}, stream grpc.ServerStream) error {
+	m := new(pb.DnsPacket)
+	if err := stream.RecvMsg(m); err != nil {
+		return err
+	}
+	return srv.(NotifyServiceServer).Transfer(m, stream)
+}
+
+// RegisterNotifyServiceServer 注册zone变更订阅服务
+func RegisterNotifyServiceServer(s *grpc.Server, srv NotifyServiceServer) {
+	s.RegisterService(&notifyServiceDesc, srv)
+}
+
+type watcher struct {
+	cluster string
+	zones   map[string]bool // 为空时订阅全部zone
+	ch      chan config.ZoneChange
+}
+
+type watcherSet struct {
+	mu       sync.Mutex
+	watchers map[*watcher]bool
+}
+
+var watchers = &watcherSet{watchers: map[*watcher]bool{}}
+
+func (s *watcherSet) add(w *watcher) {
+	s.mu.Lock()
+	s.watchers[w] = true
+	s.mu.Unlock()
+}
+
+func (s *watcherSet) remove(w *watcher) {
+	s.mu.Lock()
+	if s.watchers[w] {
+		delete(s.watchers, w)
+		close(w.ch)
+	}
+	s.mu.Unlock()
+}
+
+func (s *watcherSet) broadcast(c config.ZoneChange) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	for w := range s.watchers {
+		if w.cluster != c.Zone.Cluster || (len(w.zones) > 0 && !w.zones[c.Zone.Name]) {
+			continue
+		}
+		select {
+		case w.ch <- c:
+		default:
+			// 订阅方处理不过来,断开订阅
+			delete(s.watchers, w)
+			close(w.ch)
+		}
+	}
+}
+
+func (s *DnsServiceServer) Watch(req *pb.DnsPacket, stream grpc.ServerStream) error {
+	me, ok := metadata.FromIncomingContext(stream.Context())
+	if !ok {
+		return status.Error(codes.InvalidArgument, "metadata not found")
+	}
+	cluster := firstMD(me, "cluster")
+	if err := authorize(me, cluster); err != nil {
+		return err
+	}
+	w := &watcher{cluster: cluster, zones: map[string]bool{}, ch: make(chan config.ZoneChange, watchBuffer)}
+	if len(req.Msg) > 0 {
+		reqMsg := new(dns.Msg)
+		if err := reqMsg.Unpack(req.Msg); err != nil {
+			return status.Error(codes.InvalidArgument, err.Error())
+		}
+		for _, q := range reqMsg.Question {
+			w.zones[dns.CanonicalName(q.Name)] = true
+		}
+	}
+	watchers.add(w)
+	defer watchers.remove(w)
+
+	for {
+		select {
+		case <-stream.Context().Done():
+			return nil
+		case c, ok := <-w.ch:
+			if !ok {
+				return status.Error(codes.ResourceExhausted, "watcher too slow, resubscribe")
+			}
+			for _, msg := range changeMessages(c) {
+				buf, err := msg.Pack()
+				if err != nil {
+					return status.Error(codes.Internal, err.Error())
+				}
+				if err := stream.SendMsg(&pb.DnsPacket{Msg: buf}); err != nil {
+					return err
+				}
+			}
+		}
+	}
+}
+
+// changeMessages 返回一次变更推送的NOTIFY消息,记录按IXFR的格式排列
+func changeMessages(c config.ZoneChange) (msgs []*dns.Msg) {
+	oldSoa := dns.Copy(c.SOA).(*dns.SOA)
+	oldSoa.Serial = c.Delta.OldSerial
+	rrs := make([]dns.RR, 0, len(c.Delta.Removed)+len(c.Delta.Added)+4)
+	rrs = append(rrs, c.SOA, oldSoa)
+	rrs = append(rrs, c.Delta.Removed...)
+	rrs = append(rrs, c.SOA)
+	rrs = append(rrs, c.Delta.Added...)
+	rrs = append(rrs, c.SOA)
+
+	notify := new(dns.Msg)
+	notify.SetNotify(c.Zone.Name)
+	for _, chunk := range splitRecords(rrs, messageBase(notify)) {
+		msg := new(dns.Msg)
+		msg.SetNotify(c.Zone.Name)
+		msg.Authoritative = true
+		msg.Answer = chunk
+		msgs = append(msgs, msg)
+	}
+	return
+}
@@ -0,0 +1,88 @@
+package service
+
+import (
+	"dnsadminserver/internal/config"
+	"dnsadminserver/internal/models"
+	"math"
+	"math/rand"
+	"sort"
+	"sync"
+	"time"
+)
+
+// weightRand 按权重选择记录使用的随机数
+var weightRand = struct {
+	sync.Mutex
+	r *rand.Rand
+}{r: rand.New(rand.NewSource(time.Now().UnixNano()))}
+
+// SeedWeights 使用固定的种子,测试中使按权重选择的结果可以复现
+func SeedWeights(seed int64) {
+	weightRand.Lock()
+	weightRand.r = rand.New(rand.NewSource(seed))
+	weightRand.Unlock()
+}
+
+func randFloat() float64 {
+	weightRand.Lock()
+	defer weightRand.Unlock()
+	return weightRand.r.Float64()
+}
+
+// applyWeights 按域名配置的方式根据记录的权重选择记录。权重为0的记录不会被single选中,
+// shuffle时排在最后;全部记录的权重都为0时按相同权重处理
+func applyWeights(cluster, name string, records []models.DnsRR) []models.DnsRR {
+	mode := config.WeightMode(cluster, name)
+	if mode == config.WeightAll || len(records) < 2 {
+		return records
+	}
+	weights := make([]float64, len(records))
+	total := 0.0
+	for i, r := range records {
+		weights[i] = float64(r.Weight)
+		total += weights[i]
+	}
+	if total == 0 {
+		for i := range weights {
+			weights[i] = 1
+		}
+		total = float64(len(weights))
+	}
+
+	if mode == config.WeightSingle {
+		x := randFloat() * total
+		for i, w := range weights {
+			if w == 0 {
+				continue
+			}
+			if x -= w; x < 0 {
+				return records[i : i+1]
+			}
+		}
+		// 浮点误差时返回最后一条权重不为0的记录
+		for i := len(weights) - 1; i >= 0; i-- {
+			if weights[i] > 0 {
+				return records[i : i+1]
+			}
+		}
+	}
+
+	// 加权随机排序(Efraimidis-Spirakis):每条记录的键为 u^(1/w),按键从大到小排序
+	type keyed struct {
+		key float64
+		r   models.DnsRR
+	}
+	list := make([]keyed, len(records))
+	for i, r := range records {
+		list[i] = keyed{key: -1, r: r}
+		if weights[i] > 0 {
+			list[i].key = math.Pow(randFloat(), 1/weights[i])
+		}
+	}
+	sort.SliceStable(list, func(i, j int) bool { return list[i].key > list[j].key })
+	out := make([]models.DnsRR, len(list))
+	for i, k := range list {
+		out[i] = k.r
+	}
+	return out
+}
@@ -0,0 +1,139 @@
+package service
+
+import (
+	"testing"
+
+	"dnsadminserver/internal/config"
+	"dnsadminserver/internal/models"
+)
+
+// setWeightsConfig 配置c1中按single和shuffle选择的域名
+func setWeightsConfig() {
+	config.SetForTest(config.AppConfig{
+		Weights: map[string]map[string]string{
+			"c1": {"single.example.com.": config.WeightSingle, "shuffle.example.com.": config.WeightShuffle},
+		},
+	}, nil)
+}
+
+// weighted 返回id为1..n、权重为weights的记录
+func weighted(weights ...uint32) []models.DnsRR {
+	records := make([]models.DnsRR, len(weights))
+	for i, w := range weights {
+		records[i] = models.DnsRR{Id: int64(i + 1), Weight: w}
+	}
+	return records
+}
+
+func ids(records []models.DnsRR) (out []int64) {
+	for _, r := range records {
+		out = append(out, r.Id)
+	}
+	return
+}
+
+func TestApplyWeightsSingle(t *testing.T) {
+	setWeightsConfig()
+	tests := []struct {
+		name    string
+		weights []uint32
+		never   []int64 // 不会被选中的记录
+	}{
+		{"equal", []uint32{1, 1, 1}, nil},
+		{"zero weight", []uint32{1, 0, 3}, []int64{2}},
+		{"only one positive", []uint32{0, 5, 0}, []int64{1, 3}},
+		{"all zero", []uint32{0, 0, 0}, nil},
+	}
+	SeedWeights(1)
+	for _, tc := range tests {
+		counts := map[int64]int{}
+		for i := 0; i < 2000; i++ {
+			out := applyWeights("c1", "single.example.com.", weighted(tc.weights...))
+			if len(out) != 1 {
+				t.Fatalf("%s: got %d records, want 1", tc.name, len(out))
+			}
+			counts[out[0].Id]++
+		}
+		for _, id := range tc.never {
+			if counts[id] > 0 {
+				t.Errorf("%s: record %d picked %d times", tc.name, id, counts[id])
+			}
+		}
+		// 全部为0时按相同权重处理
+		effective := append([]uint32(nil), tc.weights...)
+		total := uint32(0)
+		for _, w := range effective {
+			total += w
+		}
+		if total == 0 {
+			for i := range effective {
+				effective[i] = 1
+			}
+			total = uint32(len(effective))
+		}
+		for i, w := range effective {
+			if w == 0 {
+				continue
+			}
+			// 选中次数与权重成比例,允许±20%
+			want := 2000 * float64(w) / float64(total)
+			if got := float64(counts[int64(i+1)]); got < want*0.8 || got > want*1.2 {
+				t.Errorf("%s: record %d picked %.0f times, want about %.0f", tc.name, i+1, got, want)
+			}
+		}
+	}
+}
+
+func TestApplyWeightsShuffle(t *testing.T) {
+	setWeightsConfig()
+	tests := []struct {
+		name    string
+		weights []uint32
+		last    int64 // 总是排在最后的记录,0表示不检查
+	}{
+		{"equal", []uint32{1, 1, 1}, 0},
+		{"zero weight last", []uint32{0, 2, 1}, 1},
+		{"all zero", []uint32{0, 0, 0}, 0},
+	}
+	SeedWeights(2)
+	for _, tc := range tests {
+		firsts := map[int64]int{}
+		for i := 0; i < 1000; i++ {
+			out := applyWeights("c1", "shuffle.example.com.", weighted(tc.weights...))
+			if len(out) != len(tc.weights) {
+				t.Fatalf("%s: got %d records, want %d", tc.name, len(out), len(tc.weights))
+			}
+			seen := map[int64]bool{}
+			for _, r := range out {
+				seen[r.Id] = true
+			}
+			if len(seen) != len(tc.weights) {
+				t.Fatalf("%s: records lost or duplicated: %v", tc.name, ids(out))
+			}
+			if tc.last != 0 && out[len(out)-1].Id != tc.last {
+				t.Fatalf("%s: got order %v, want record %d last", tc.name, ids(out), tc.last)
+			}
+			firsts[out[0].Id]++
+		}
+		// 权重大于0的记录都会排在第一位
+		for i, w := range tc.weights {
+			if (w > 0 || tc.last == 0) && firsts[int64(i+1)] == 0 {
+				t.Errorf("%s: record %d never first", tc.name, i+1)
+			}
+		}
+	}
+}
+
+func TestApplyWeightsAll(t *testing.T) {
+	setWeightsConfig()
+	for _, name := range []string{"www.example.com.", "unconfigured.example.com."} {
+		out := applyWeights("c1", name, weighted(0, 3, 1))
+		if got := ids(out); len(got) != 3 || got[0] != 1 || got[1] != 2 || got[2] != 3 {
+			t.Errorf("%s: got %v, want original order [1 2 3]", name, got)
+		}
+	}
+	// 只有一条记录时不做选择
+	if out := applyWeights("c1", "single.example.com.", weighted(0)); len(out) != 1 {
+		t.Errorf("single record: got %d records, want 1", len(out))
+	}
+}
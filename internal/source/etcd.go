@@ -0,0 +1,112 @@
+package source
+
+import (
+	"context"
+	"dnsadminserver/internal/models"
+	"encoding/json"
+	"log"
+	"strconv"
+	"strings"
+
+	clientv3 "go.etcd.io/etcd/client/v3"
+)
+
+// Etcd 从etcd加载记录,key为 <prefix>/<cluster>/<id>,value为记录的json:
+//
+//	{"Name":"www.example.com.","Qtype":1,"Ttl":60,"Rdata":"10.0.0.1"}
+//
+// id不是数字时根据key生成
+type Etcd struct {
+	client *clientv3.Client
+	prefix string
+}
+
+// NewEtcd 返回从etcd中prefix下加载记录的来源
+func NewEtcd(client *clientv3.Client, prefix string) *Etcd {
+	return &Etcd{client: client, prefix: strings.TrimSuffix(prefix, "/") + "/"}
+}
+
+func (e *Etcd) Name() string { return "etcd" }
+
+func (e *Etcd) load(ctx context.Context, prefix string) (list []models.DnsRecords, err error) {
+	resp, err := e.client.Get(ctx, prefix, clientv3.WithPrefix())
+	if err != nil {
+		return nil, err
+	}
+	for _, kv := range resp.Kvs {
+		cluster, id, ok := e.parseKey(string(kv.Key))
+		if !ok {
+			continue
+		}
+		// 没有weight字段的记录权重为1
+		r := models.SampleDnsRecords{Weight: 1}
+		if err := json.Unmarshal(kv.Value, &r); err != nil {
+			log.Println("etcd.go: load() error: ", "记录格式不正确", string(kv.Key), err)
+			continue
+		}
+		list = append(list, models.DnsRecords{
+			Id:          id,
+			ClusterName: cluster,
+			Name:        r.Name,
+			Qtype:       r.Qtype,
+			Qclass:      r.Qclass,
+			Ttl:         r.Ttl,
+			Rdata:       r.Rdata,
+			View:        r.View,
+			Weight:      r.Weight,
+		})
+	}
+	return list, nil
+}
+
+// parseKey 从key中解析集群和id
+func (e *Etcd) parseKey(key string) (cluster string, id int64, ok bool) {
+	parts := strings.SplitN(strings.TrimPrefix(key, e.prefix), "/", 2)
+	if len(parts) != 2 || parts[0] == "" {
+		return "", 0, false
+	}
+	id, err := strconv.ParseInt(parts[1], 10, 64)
+	if err != nil || id <= 0 {
+		id = recordId(key)
+	}
+	return parts[0], id, true
+}
+
+func (e *Etcd) LoadAll(ctx context.Context) ([]models.DnsRecords, error) {
+	return e.load(ctx, e.prefix)
+}
+
+func (e *Etcd) LoadCluster(ctx context.Context, cluster string) ([]models.DnsRecords, error) {
+	return e.load(ctx, e.prefix+cluster+"/")
+}
+
+func (e *Etcd) LoadByName(ctx context.Context, cluster, name string, qtype uint16) ([]models.DnsRecords, error) {
+	list, err := e.LoadCluster(ctx, cluster)
+	if err != nil {
+		return nil, err
+	}
+	return filterByName(list, name, qtype), nil
+}
+
+// Watch 监听prefix下的变化,通知发生变化的集群
+func (e *Etcd) Watch(ctx context.Context, changed func(cluster string)) error {
+	wch := e.client.Watch(ctx, e.prefix, clientv3.WithPrefix())
+	for resp := range wch {
+		if err := resp.Err(); err != nil {
+			log.Println("etcd.go: Watch() error: ", err)
+			// 无法确定丢失了哪些事件,通知全部集群
+			changed("")
+			continue
+		}
+		clusters := map[string]bool{}
+		for _, ev := range resp.Events {
+			if cluster, _, ok := e.parseKey(string(ev.Kv.Key)); ok {
+				clusters[cluster] = true
+			}
+		}
+		for c := range clusters {
+			changed(c)
+		}
+	}
+	return ctx.Err()
+}
@@ -0,0 +1,112 @@
+package source
+
+import (
+	"context"
+	"sort"
+	"strings"
+	"testing"
+
+	"go.etcd.io/etcd/api/v3/mvccpb"
+	clientv3 "go.etcd.io/etcd/client/v3"
+)
+
+// testKV 只实现Get的etcd KV,按前缀返回kvs中的记录
+type testKV struct {
+	clientv3.KV
+	kvs map[string]string
+}
+
+func (kv *testKV) Get(ctx context.Context, key string, opts ...clientv3.OpOption) (*clientv3.GetResponse, error) {
+	var keys []string
+	for k := range kv.kvs {
+		if strings.HasPrefix(k, key) {
+			keys = append(keys, k)
+		}
+	}
+	sort.Strings(keys)
+	resp := &clientv3.GetResponse{}
+	for _, k := range keys {
+		resp.Kvs = append(resp.Kvs, &mvccpb.KeyValue{Key: []byte(k), Value: []byte(kv.kvs[k])})
+	}
+	return resp, nil
+}
+
+// testWatcher 返回事件由测试发送的watch通道
+type testWatcher struct {
+	clientv3.Watcher
+	ch chan clientv3.WatchResponse
+}
+
+func (w *testWatcher) Watch(ctx context.Context, key string, opts ...clientv3.OpOption) clientv3.WatchChan {
+	return w.ch
+}
+
+func newTestEtcd(kvs map[string]string) (*Etcd, *testWatcher) {
+	w := &testWatcher{ch: make(chan clientv3.WatchResponse)}
+	return NewEtcd(&clientv3.Client{KV: &testKV{kvs: kvs}, Watcher: w}, "/dns/"), w
+}
+
+func TestEtcdLoad(t *testing.T) {
+	e, _ := newTestEtcd(map[string]string{
+		"/dns/c1/1":     `{"Name":"www.example.com.","Qtype":1,"Qclass":1,"Ttl":60,"Rdata":"10.0.0.1"}`,
+		"/dns/c1/web-2": `{"Name":"www.example.com.","Qtype":1,"Qclass":1,"Ttl":60,"Rdata":"10.0.0.2","View":"office","Weight":3}`,
+		"/dns/c1/3":     `not json`,
+		"/dns/c10/4":    `{"Name":"www.example.com.","Qtype":1,"Qclass":1,"Ttl":60,"Rdata":"10.0.1.1"}`,
+		"/dns/5":        `{"Name":"nocluster.example.com.","Qtype":1}`,
+	})
+	ctx := context.Background()
+
+	all, err := e.LoadAll(ctx)
+	if err != nil || len(all) != 3 {
+		t.Fatalf("LoadAll = %d records, %v, want 3", len(all), err)
+	}
+	list, err := e.LoadCluster(ctx, "c1")
+	if err != nil || len(list) != 2 {
+		t.Fatalf("LoadCluster(c1) = %d records, %v, want 2 without the records of c10", len(list), err)
+	}
+	for _, r := range list {
+		switch r.Rdata {
+		case "10.0.0.1":
+			if r.Id != 1 || r.Weight != 1 || r.ClusterName != "c1" {
+				t.Errorf("record %+v: want id 1, weight 1 and cluster c1", r)
+			}
+		case "10.0.0.2":
+			if r.Id != recordId("/dns/c1/web-2") || r.Weight != 3 || r.View != "office" {
+				t.Errorf("record %+v: want the id of its key, weight 3 and view office", r)
+			}
+		}
+	}
+	if list, _ := e.LoadByName(ctx, "c1", "www.example.com.", 28); len(list) != 0 {
+		t.Errorf("LoadByName AAAA = %d records, want 0", len(list))
+	}
+}
+
+func TestEtcdWatch(t *testing.T) {
+	e, w := newTestEtcd(nil)
+	ctx, cancel := context.WithCancel(context.Background())
+	changed := make(chan string, 10)
+	done := make(chan error)
+	go func() { done <- e.Watch(ctx, func(c string) { changed <- c }) }()
+
+	// 同一次响应中一个集群的多个事件只通知一次
+	w.ch <- clientv3.WatchResponse{Events: []*clientv3.Event{
+		{Kv: &mvccpb.KeyValue{Key: []byte("/dns/c1/1")}},
+		{Kv: &mvccpb.KeyValue{Key: []byte("/dns/c1/2")}},
+	}}
+	if c := <-changed; c != "c1" {
+		t.Errorf("changed(%q), want c1", c)
+	}
+	// watch出错时通知全部集群
+	w.ch <- clientv3.WatchResponse{Canceled: true}
+	if c := <-changed; c != "" {
+		t.Errorf("changed(%q) after an error, want all clusters", c)
+	}
+	cancel()
+	close(w.ch)
+	if err := <-done; err != context.Canceled {
+		t.Errorf("Watch returned %v, want context.Canceled", err)
+	}
+	if len(changed) != 0 {
+		t.Errorf("unexpected changes: %d", len(changed))
+	}
+}
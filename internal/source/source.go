@@ -0,0 +1,63 @@
+// Package source 定义dns记录的来源,记录可以来自关系数据库、zone文件目录或etcd。
+package source
+
+import (
+	"context"
+	"dnsadminserver/internal/models"
+	"errors"
+	"hash/fnv"
+	"math"
+)
+
+// RecordSource 是dns记录的来源
+type RecordSource interface {
+	// LoadAll 加载全部集群的记录
+	LoadAll(ctx context.Context) ([]models.DnsRecords, error)
+	// LoadCluster 加载一个集群的记录
+	LoadCluster(ctx context.Context, cluster string) ([]models.DnsRecords, error)
+	// LoadByName 加载一个集群中指定域名的记录,qtype为0时返回全部类型
+	LoadByName(ctx context.Context, cluster, name string, qtype uint16) ([]models.DnsRecords, error)
+	// Watch 监听记录变化,阻塞直到ctx取消。changed 的参数为发生变化的集群,为空表示全部集群。
+	// 不能自己感知变化的来源(如数据库,变更通过redis通知)直接等待ctx取消
+	Watch(ctx context.Context, changed func(cluster string)) error
+	// Name 返回来源的名称
+	Name() string
+}
+
+// ClusterIdLoader 由使用集群id的来源(数据库)实现,用于处理redis中携带集群id的reload消息
+type ClusterIdLoader interface {
+	LoadByClusterId(ctx context.Context, clusterId int64, name string, qtype uint16) ([]models.DnsRecords, error)
+	// LoadById 加载一条记录,用于处理不包含view和权重的add/update消息
+	LoadById(ctx context.Context, id int64) (models.DnsRecords, error)
+	// ClusterName 返回集群id对应的名称,reload的记录已全部删除时用于确定要清理的缓存
+	ClusterName(ctx context.Context, clusterId int64) (string, error)
+}
+
+// ForwardLoader 由保存了转发规则的来源(数据库)实现
+type ForwardLoader interface {
+	// LoadForwards 加载全部集群的转发规则
+	LoadForwards(ctx context.Context) ([]models.DnsForwards, error)
+}
+
+// RecordWriter 由可以写入记录的来源实现,用于动态更新
+type RecordWriter interface {
+	// ClusterId 返回集群名称对应的id
+	ClusterId(ctx context.Context, cluster string) (int64, error)
+	// UpdateRecords 在一个事务中删除和新增集群的记录,任一操作失败时全部回滚。
+	// 要删除的记录不是来源中的记录(如zone文件中的记录)时返回 ErrRecordNotFound
+	UpdateRecords(ctx context.Context, clusterId int64, adds []models.DnsRecords, deletes []int64, user string) error
+}
+
+// ErrRecordNotFound 要删除的记录不在记录来源中
+var ErrRecordNotFound = errors.New("记录不存在")
+
+// recordId 为没有id的记录(zone文件、etcd)生成稳定的正数id
+func recordId(s string) int64 {
+	h := fnv.New64a()
+	h.Write([]byte(s))
+	id := int64(h.Sum64() & math.MaxInt64)
+	if id == 0 {
+		id = 1
+	}
+	return id
+}
@@ -0,0 +1,235 @@
+package source
+
+import (
+	"context"
+	"dnsadminserver/internal/models"
+	"fmt"
+	"log"
+	"slices"
+	"strings"
+	"sync"
+	"time"
+
+	"gorm.io/gorm"
+)
+
+// SQL 从 dns_records 表中加载记录,支持 MySQL、PostgreSQL 和 SQLite
+type SQL struct {
+	db   *gorm.DB
+	name string
+
+	mu      sync.Mutex
+	missing []string // 没有执行迁移时 dns_records 缺少的列,为nil时还没有检查
+}
+
+const recordsSql = `select id,
+            (select cluster_name from envoy_cluster where id=cluster_id) as cluster_name,
+            name,qtype,qclass,ttl,rdata,%s,
+            create_user,create_time,update_user,update_time
+            from dns_records where is_delete=0`
+
+// migratedColumns 迁移后新增的列和没有该列时使用的值
+var migratedColumns = []struct{ name, fallback string }{
+	{"view", "''"},
+	{"weight", "1"},
+}
+
+// NewSQL 返回使用db的记录来源,name为数据库类型
+func NewSQL(db *gorm.DB, name string) *SQL {
+	return &SQL{db: db, name: name}
+}
+
+func (s *SQL) Name() string { return s.name }
+
+// missingColumns 返回 dns_records 中没有的迁移列。检查结果缓存,查询表结构失败时下次重新检查
+func (s *SQL) missingColumns(ctx context.Context) []string {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if s.missing != nil {
+		return s.missing
+	}
+	types, err := s.db.WithContext(ctx).Migrator().ColumnTypes("dns_records")
+	if err != nil {
+		log.Println("sql.go: missingColumns() error: ", err)
+		return nil
+	}
+	exists := map[string]bool{}
+	for _, t := range types {
+		exists[strings.ToLower(t.Name())] = true
+	}
+	missing := []string{}
+	for _, c := range migratedColumns {
+		if !exists[c.name] {
+			missing = append(missing, c.name)
+		}
+	}
+	if len(missing) > 0 {
+		log.Println("sql.go: missingColumns() error: ", "dns_records 缺少列", missing,
+			"请执行迁移;迁移前记录的view为空、权重为1,迁移后需要重启")
+	}
+	s.missing = missing
+	return missing
+}
+
+func (s *SQL) query(ctx context.Context, where string, args ...any) (list []models.DnsRecords, err error) {
+	missing := s.missingColumns(ctx)
+	cols := make([]string, 0, len(migratedColumns))
+	for _, c := range migratedColumns {
+		if slices.Contains(missing, c.name) {
+			cols = append(cols, c.fallback+" as "+c.name)
+		} else {
+			cols = append(cols, c.name)
+		}
+	}
+	err = s.db.WithContext(ctx).Raw(fmt.Sprintf(recordsSql, strings.Join(cols, ","))+where, args...).Find(&list).Error
+	return
+}
+
+func (s *SQL) LoadAll(ctx context.Context) ([]models.DnsRecords, error) {
+	return s.query(ctx, "")
+}
+
+func (s *SQL) LoadCluster(ctx context.Context, cluster string) ([]models.DnsRecords, error) {
+	return s.query(ctx, " and cluster_id in (select id from envoy_cluster where cluster_name=?)", cluster)
+}
+
+func (s *SQL) LoadByName(ctx context.Context, cluster, name string, qtype uint16) ([]models.DnsRecords, error) {
+	where := " and cluster_id in (select id from envoy_cluster where cluster_name=?) and name=?"
+	args := []any{cluster, name}
+	if qtype != 0 {
+		where += " and qtype=?"
+		args = append(args, qtype)
+	}
+	return s.query(ctx, where, args...)
+}
+
+// LoadByClusterId 实现 ClusterIdLoader,clusterId为0时不按集群过滤
+func (s *SQL) LoadByClusterId(ctx context.Context, clusterId int64, name string, qtype uint16) ([]models.DnsRecords, error) {
+	where := ""
+	args := []any{}
+	if name != "" {
+		where += " and name=?"
+		args = append(args, name)
+	}
+	if qtype != 0 {
+		where += " and qtype=?"
+		args = append(args, qtype)
+	}
+	if clusterId > 0 {
+		where += " and cluster_id=?"
+		args = append(args, clusterId)
+	}
+	return s.query(ctx, where, args...)
+}
+
+// LoadById 实现 ClusterIdLoader,记录不存在或已删除时返回 ErrRecordNotFound
+func (s *SQL) LoadById(ctx context.Context, id int64) (models.DnsRecords, error) {
+	list, err := s.query(ctx, " and id=?", id)
+	if err != nil {
+		return models.DnsRecords{}, err
+	}
+	if len(list) == 0 {
+		return models.DnsRecords{}, fmt.Errorf("%w: %d", ErrRecordNotFound, id)
+	}
+	return list[0], nil
+}
+
+// ClusterName 实现 ClusterIdLoader
+func (s *SQL) ClusterName(ctx context.Context, clusterId int64) (name string, err error) {
+	err = s.db.WithContext(ctx).Raw("select cluster_name from envoy_cluster where id=?", clusterId).Scan(&name).Error
+	if err == nil && name == "" {
+		err = fmt.Errorf("集群 %d 不存在", clusterId)
+	}
+	return
+}
+
+// Watch 数据库的变更通过redis通知,这里只等待ctx取消
+func (s *SQL) Watch(ctx context.Context, changed func(cluster string)) error {
+	<-ctx.Done()
+	return nil
+}
+
+// dnsRecordRow dns_records 表中写入时需要的列
+type dnsRecordRow struct {
+	Id         int64     `gorm:"column:id;primary_key"`
+	ClusterId  int64     `gorm:"column:cluster_id"`
+	Name       string    `gorm:"column:name"`
+	Qtype      uint16    `gorm:"column:qtype"`
+	Qclass     uint16    `gorm:"column:qclass"`
+	Ttl        uint32    `gorm:"column:ttl"`
+	Rdata      string    `gorm:"column:rdata"`
+	View       string    `gorm:"column:view"`
+	Weight     uint32    `gorm:"column:weight"`
+	IsDelete   int       `gorm:"column:is_delete"`
+	CreateUser string    `gorm:"column:create_user"`
+	UpdateUser string    `gorm:"column:update_user"`
+	CreateTime time.Time `gorm:"column:create_time"`
+	UpdateTime time.Time `gorm:"column:update_time"`
+}
+
+func (dnsRecordRow) TableName() string {
+	return "dns_records"
+}
+
+// ClusterId 实现 RecordWriter
+func (s *SQL) ClusterId(ctx context.Context, cluster string) (id int64, err error) {
+	err = s.db.WithContext(ctx).Raw("select id from envoy_cluster where cluster_name=?", cluster).Scan(&id).Error
+	if err == nil && id == 0 {
+		err = fmt.Errorf("集群 %s 不存在", cluster)
+	}
+	return
+}
+
+// UpdateRecords 实现 RecordWriter
+func (s *SQL) UpdateRecords(ctx context.Context, clusterId int64, adds []models.DnsRecords, deletes []int64, user string) error {
+	// 没有迁移的列不写入
+	omit := s.missingColumns(ctx)
+	if omit == nil {
+		return fmt.Errorf("查询 dns_records 表结构失败")
+	}
+	return s.db.WithContext(ctx).Transaction(func(tx *gorm.DB) error {
+		now := time.Now()
+		for _, id := range deletes {
+			// 与管理后台一样只标记删除
+			res := tx.Model(&dnsRecordRow{}).Where("id=? and cluster_id=? and is_delete=0", id, clusterId).
+				Updates(map[string]any{"is_delete": 1, "update_user": user, "update_time": now})
+			if res.Error != nil {
+				return res.Error
+			}
+			if res.RowsAffected == 0 {
+				return fmt.Errorf("%w: %d", ErrRecordNotFound, id)
+			}
+		}
+		for _, r := range adds {
+			row := dnsRecordRow{
+				ClusterId:  clusterId,
+				Name:       r.Name,
+				Qtype:      r.Qtype,
+				Qclass:     r.Qclass,
+				Ttl:        r.Ttl,
+				Rdata:      r.Rdata,
+				View:       r.View,
+				Weight:     r.Weight,
+				CreateUser: user,
+				UpdateUser: user,
+				CreateTime: now,
+				UpdateTime: now,
+			}
+			if err := tx.Omit(omit...).Create(&row).Error; err != nil {
+				return err
+			}
+		}
+		return nil
+	})
+}
+
+const forwardsSql = `select id,
+            (select cluster_name from envoy_cluster where id=cluster_id) as cluster_name,
+            zone,upstreams,policy,tls_server_name,except_list
+            from dns_forwards where is_delete=0`
+
+// LoadForwards 实现 ForwardLoader
+func (s *SQL) LoadForwards(ctx context.Context) (list []models.DnsForwards, err error) {
+	err = s.db.WithContext(ctx).Raw(forwardsSql).Find(&list).Error
+	return
+}
@@ -0,0 +1,188 @@
+package source
+
+import (
+	"context"
+	"errors"
+	"path/filepath"
+	"testing"
+
+	"dnsadminserver/internal/models"
+
+	"github.com/glebarez/sqlite"
+	"gorm.io/gorm"
+)
+
+const testSchema = `
+create table envoy_cluster (id integer primary key, cluster_name text);
+create table dns_records (id integer primary key autoincrement, cluster_id integer, name text, qtype integer,
+	qclass integer, ttl integer, rdata text, view text default '', weight integer default 1, is_delete integer default 0,
+	create_user text, create_time datetime, update_user text, update_time datetime);
+create table dns_forwards (id integer primary key, cluster_id integer, zone text, upstreams text, policy text,
+	tls_server_name text, except_list text, is_delete integer default 0);
+insert into envoy_cluster values (1, 'c1'), (2, 'c2');
+insert into dns_records (cluster_id, name, qtype, qclass, ttl, rdata, view, weight) values
+	(1, 'a.example.com.', 1, 1, 60, '10.0.0.1', '', 1),
+	(1, 'a.example.com.', 1, 1, 60, '10.0.0.2', 'office', 3),
+	(1, 'a.example.com.', 16, 1, 60, '"txt"', '', 1),
+	(2, 'b.example.com.', 1, 1, 60, '10.0.1.1', '', 1);
+insert into dns_records (cluster_id, name, qtype, qclass, ttl, rdata, is_delete) values
+	(1, 'deleted.example.com.', 1, 1, 60, '10.0.0.9', 1);
+insert into dns_forwards values (1, 1, 'corp.', '10.0.0.53', 'random', '', '', 0), (2, 1, 'old.', '10.0.0.54', '', '', '', 1);
+`
+
+// newTestSQL 返回使用临时SQLite数据库的来源
+func newTestSQL(t *testing.T, schema string) *SQL {
+	t.Helper()
+	db, err := gorm.Open(sqlite.Open(filepath.Join(t.TempDir(), "dns.db")), &gorm.Config{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := db.Exec(schema).Error; err != nil {
+		t.Fatal(err)
+	}
+	return NewSQL(db, "sqlite")
+}
+
+func TestSQLLoad(t *testing.T) {
+	s := newTestSQL(t, testSchema)
+	ctx := context.Background()
+
+	tests := []struct {
+		name string
+		load func() ([]models.DnsRecords, error)
+		want int
+	}{
+		{"all", func() ([]models.DnsRecords, error) { return s.LoadAll(ctx) }, 4},
+		{"cluster", func() ([]models.DnsRecords, error) { return s.LoadCluster(ctx, "c1") }, 3},
+		{"unknown cluster", func() ([]models.DnsRecords, error) { return s.LoadCluster(ctx, "c3") }, 0},
+		{"name", func() ([]models.DnsRecords, error) { return s.LoadByName(ctx, "c1", "a.example.com.", 0) }, 3},
+		{"name and type", func() ([]models.DnsRecords, error) { return s.LoadByName(ctx, "c1", "a.example.com.", 1) }, 2},
+		{"cluster id", func() ([]models.DnsRecords, error) { return s.LoadByClusterId(ctx, 2, "", 0) }, 1},
+		{"any cluster id", func() ([]models.DnsRecords, error) { return s.LoadByClusterId(ctx, 0, "a.example.com.", 16) }, 1},
+	}
+	for _, tc := range tests {
+		list, err := tc.load()
+		if err != nil {
+			t.Fatalf("%s: %v", tc.name, err)
+		}
+		if len(list) != tc.want {
+			t.Errorf("%s: got %d records, want %d", tc.name, len(list), tc.want)
+		}
+	}
+
+	list, _ := s.LoadByName(ctx, "c1", "a.example.com.", 1)
+	for _, r := range list {
+		if r.ClusterName != "c1" {
+			t.Errorf("record %d: cluster %q, want c1", r.Id, r.ClusterName)
+		}
+		if r.Rdata == "10.0.0.2" && (r.View != "office" || r.Weight != 3) {
+			t.Errorf("record %d: view %q weight %d, want office 3", r.Id, r.View, r.Weight)
+		}
+	}
+}
+
+func TestSQLClusterName(t *testing.T) {
+	s := newTestSQL(t, testSchema)
+	ctx := context.Background()
+	if name, err := s.ClusterName(ctx, 2); err != nil || name != "c2" {
+		t.Errorf("ClusterName(2) = %q, %v, want c2", name, err)
+	}
+	if _, err := s.ClusterName(ctx, 3); err == nil {
+		t.Error("ClusterName(3): expected error for unknown cluster")
+	}
+	if id, err := s.ClusterId(ctx, "c1"); err != nil || id != 1 {
+		t.Errorf("ClusterId(c1) = %d, %v, want 1", id, err)
+	}
+	if _, err := s.ClusterId(ctx, "c3"); err == nil {
+		t.Error("ClusterId(c3): expected error for unknown cluster")
+	}
+}
+
+func TestSQLUpdateRecords(t *testing.T) {
+	s := newTestSQL(t, testSchema)
+	ctx := context.Background()
+	add := models.DnsRecords{Name: "c.example.com.", Qtype: 1, Qclass: 1, Ttl: 30, Rdata: "10.0.1.2", Weight: 1}
+	if err := s.UpdateRecords(ctx, 2, []models.DnsRecords{add}, nil, "test"); err != nil {
+		t.Fatal(err)
+	}
+	list, err := s.LoadByName(ctx, "c2", "c.example.com.", 1)
+	if err != nil || len(list) != 1 || list[0].CreateUser != "test" {
+		t.Fatalf("added record not loaded: %+v, %v", list, err)
+	}
+	id := list[0].Id
+
+	// 删除不存在的记录时整个更新回滚,新增的记录也不写入
+	add.Rdata = "10.0.1.3"
+	err = s.UpdateRecords(ctx, 2, []models.DnsRecords{add}, []int64{id, 12345}, "test")
+	if !errors.Is(err, ErrRecordNotFound) {
+		t.Fatalf("expected ErrRecordNotFound, got %v", err)
+	}
+	if list, _ := s.LoadByName(ctx, "c2", "c.example.com.", 1); len(list) != 1 || list[0].Id != id {
+		t.Errorf("update not rolled back: %+v", list)
+	}
+
+	// 其他集群的记录不能删除
+	if err := s.UpdateRecords(ctx, 1, nil, []int64{id}, "test"); !errors.Is(err, ErrRecordNotFound) {
+		t.Errorf("expected ErrRecordNotFound deleting a record of another cluster, got %v", err)
+	}
+
+	if err := s.UpdateRecords(ctx, 2, []models.DnsRecords{add}, []int64{id}, "test"); err != nil {
+		t.Fatal(err)
+	}
+	if list, _ := s.LoadByName(ctx, "c2", "c.example.com.", 1); len(list) != 1 || list[0].Rdata != "10.0.1.3" {
+		t.Errorf("LoadByName after update = %+v, want only 10.0.1.3", list)
+	}
+}
+
+func TestSQLLoadById(t *testing.T) {
+	s := newTestSQL(t, testSchema)
+	ctx := context.Background()
+	r, err := s.LoadById(ctx, 2)
+	if err != nil || r.View != "office" || r.Weight != 3 || r.ClusterName != "c1" {
+		t.Errorf("LoadById(2) = %+v, %v", r, err)
+	}
+	// 已删除的记录
+	if _, err := s.LoadById(ctx, 5); !errors.Is(err, ErrRecordNotFound) {
+		t.Errorf("LoadById(5): expected ErrRecordNotFound, got %v", err)
+	}
+}
+
+// 没有执行迁移的 dns_records 没有 view 和 weight 列
+const unmigratedSchema = `
+create table envoy_cluster (id integer primary key, cluster_name text);
+create table dns_records (id integer primary key autoincrement, cluster_id integer, name text, qtype integer,
+	qclass integer, ttl integer, rdata text, is_delete integer default 0,
+	create_user text, create_time datetime, update_user text, update_time datetime);
+insert into envoy_cluster values (1, 'c1');
+insert into dns_records (cluster_id, name, qtype, qclass, ttl, rdata) values (1, 'a.example.com.', 1, 1, 60, '10.0.0.1');
+`
+
+func TestSQLUnmigrated(t *testing.T) {
+	s := newTestSQL(t, unmigratedSchema)
+	ctx := context.Background()
+	list, err := s.LoadAll(ctx)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(list) != 1 || list[0].View != "" || list[0].Weight != 1 {
+		t.Errorf("LoadAll = %+v, want one record with empty view and weight 1", list)
+	}
+	add := models.DnsRecords{Name: "b.example.com.", Qtype: 1, Qclass: 1, Ttl: 30, Rdata: "10.0.0.2", View: "office", Weight: 2}
+	if err := s.UpdateRecords(ctx, 1, []models.DnsRecords{add}, nil, "test"); err != nil {
+		t.Fatal(err)
+	}
+	if list, _ := s.LoadByName(ctx, "c1", "b.example.com.", 1); len(list) != 1 || list[0].Weight != 1 {
+		t.Errorf("LoadByName after add = %+v", list)
+	}
+}
+
+func TestSQLLoadForwards(t *testing.T) {
+	s := newTestSQL(t, testSchema)
+	list, err := s.LoadForwards(context.Background())
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(list) != 1 || list[0].ClusterName != "c1" || list[0].Zone != "corp." {
+		t.Errorf("LoadForwards = %+v, want the corp. rule of c1", list)
+	}
+}
@@ -0,0 +1,218 @@
+package source
+
+import (
+	"context"
+	"dnsadminserver/internal/models"
+	"errors"
+	"fmt"
+	"io/fs"
+	"log"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/miekg/dns"
+)
+
+// zone文件检查间隔,与配置文件一样使用轮询,兼容ConfigMap挂载
+const zoneCheckInterval = 10 * time.Second
+
+// ParseZoneFile 解析RFC 1035格式的zone文件,记录归属于cluster。
+// origin为空时使用文件名(去掉.zone/.db后缀)作为origin,文件中的$ORIGIN优先
+func ParseZoneFile(path, cluster, origin string) (list []models.DnsRecords, err error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+	if origin == "" {
+		origin = strings.TrimSuffix(strings.TrimSuffix(filepath.Base(path), ".zone"), ".db")
+	}
+	zp := dns.NewZoneParser(f, dns.Fqdn(origin), path)
+	for rr, ok := zp.Next(); ok; rr, ok = zp.Next() {
+		list = append(list, RecordFromRR(cluster, rr))
+	}
+	if err := zp.Err(); err != nil {
+		return nil, err
+	}
+	return list, nil
+}
+
+// RecordFromRR 将记录转换为 DnsRecords,rdata为记录的文本格式,权重为1。
+// 只有一个字符串的TXT记录使用不带引号的旧格式,与管理后台写入的格式一致
+func RecordFromRR(cluster string, rr dns.RR) models.DnsRecords {
+	hdr := rr.Header()
+	rdata := strings.TrimPrefix(rr.String(), hdr.String())
+	if txt, ok := rr.(*dns.TXT); ok && len(txt.Txt) == 1 && !strings.HasPrefix(txt.Txt[0], `"`) {
+		rdata = txt.Txt[0]
+	}
+	return models.DnsRecords{
+		Id:          recordId(cluster + " " + rr.String()),
+		ClusterName: cluster,
+		Name:        hdr.Name,
+		Qtype:       hdr.Rrtype,
+		Qclass:      hdr.Class,
+		Ttl:         hdr.Ttl,
+		Rdata:       rdata,
+		Weight:      1,
+	}
+}
+
+// ZoneDir 从目录中加载zone文件,每个子目录是一个集群,子目录中的每个文件是一个zone:
+//
+//	<dir>/<cluster>/<zone>.zone
+//
+// 解析失败的文件使用上次解析成功的记录,不影响其他文件和集群;删除的集群目录按没有记录处理
+type ZoneDir struct {
+	dir string
+
+	mu       sync.Mutex
+	lastGood map[string][]models.DnsRecords // 文件路径 -> 上次解析成功的记录
+}
+
+// NewZoneDir 返回从dir加载zone文件的记录来源
+func NewZoneDir(dir string) *ZoneDir {
+	return &ZoneDir{dir: dir, lastGood: map[string][]models.DnsRecords{}}
+}
+
+func (z *ZoneDir) Name() string { return "zonedir" }
+
+func (z *ZoneDir) clusters() ([]string, error) {
+	entries, err := os.ReadDir(z.dir)
+	if err != nil {
+		return nil, err
+	}
+	var clusters []string
+	for _, e := range entries {
+		// ConfigMap 挂载时会有 ..data 等隐藏目录
+		if e.IsDir() && !strings.HasPrefix(e.Name(), ".") {
+			clusters = append(clusters, e.Name())
+		}
+	}
+	return clusters, nil
+}
+
+// zoneFiles 返回集群目录中的zone文件,目录不存在时返回空
+func (z *ZoneDir) zoneFiles(cluster string) ([]string, error) {
+	entries, err := os.ReadDir(filepath.Join(z.dir, cluster))
+	if errors.Is(err, fs.ErrNotExist) {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	var files []string
+	for _, e := range entries {
+		if !e.IsDir() && !strings.HasPrefix(e.Name(), ".") {
+			files = append(files, filepath.Join(z.dir, cluster, e.Name()))
+		}
+	}
+	return files, nil
+}
+
+func (z *ZoneDir) LoadAll(ctx context.Context) ([]models.DnsRecords, error) {
+	clusters, err := z.clusters()
+	if err != nil {
+		return nil, err
+	}
+	var list []models.DnsRecords
+	for _, c := range clusters {
+		l, err := z.LoadCluster(ctx, c)
+		if err != nil {
+			return nil, err
+		}
+		list = append(list, l...)
+	}
+	return list, nil
+}
+
+func (z *ZoneDir) LoadCluster(ctx context.Context, cluster string) ([]models.DnsRecords, error) {
+	files, err := z.zoneFiles(cluster)
+	if err != nil {
+		return nil, err
+	}
+	prefix := filepath.Join(z.dir, cluster) + string(filepath.Separator)
+	present := map[string]bool{}
+	var list []models.DnsRecords
+	z.mu.Lock()
+	defer z.mu.Unlock()
+	for _, f := range files {
+		present[f] = true
+		l, err := ParseZoneFile(f, cluster, "")
+		if err != nil {
+			log.Println("zonefile.go: LoadCluster() error: ", "解析zone文件失败,使用上次解析成功的记录", f, err)
+			l = z.lastGood[f]
+		} else {
+			z.lastGood[f] = l
+		}
+		list = append(list, l...)
+	}
+	for f := range z.lastGood {
+		if strings.HasPrefix(f, prefix) && !present[f] {
+			delete(z.lastGood, f)
+		}
+	}
+	return list, nil
+}
+
+func (z *ZoneDir) LoadByName(ctx context.Context, cluster, name string, qtype uint16) ([]models.DnsRecords, error) {
+	list, err := z.LoadCluster(ctx, cluster)
+	if err != nil {
+		return nil, err
+	}
+	return filterByName(list, name, qtype), nil
+}
+
+// Watch 定时检查每个集群目录中文件的修改时间
+func (z *ZoneDir) Watch(ctx context.Context, changed func(cluster string)) error {
+	ticker := time.NewTicker(zoneCheckInterval)
+	defer ticker.Stop()
+	last := z.snapshot()
+	for {
+		select {
+		case <-ctx.Done():
+			return nil
+		case <-ticker.C:
+		}
+		cur := z.snapshot()
+		for c, sig := range cur {
+			if last[c] != sig {
+				changed(c)
+			}
+		}
+		for c := range last {
+			if _, ok := cur[c]; !ok {
+				changed(c)
+			}
+		}
+		last = cur
+	}
+}
+
+// snapshot 返回每个集群目录中文件名、大小和修改时间组成的签名
+func (z *ZoneDir) snapshot() map[string]string {
+	sigs := map[string]string{}
+	clusters, _ := z.clusters()
+	for _, c := range clusters {
+		files, _ := z.zoneFiles(c)
+		var sb strings.Builder
+		for _, f := range files {
+			if fi, err := os.Stat(f); err == nil {
+				fmt.Fprintf(&sb, "%s:%d:%d;", f, fi.Size(), fi.ModTime().UnixNano())
+			}
+		}
+		sigs[c] = sb.String()
+	}
+	return sigs
+}
+
+func filterByName(list []models.DnsRecords, name string, qtype uint16) (result []models.DnsRecords) {
+	for _, v := range list {
+		if v.Name == name && (qtype == 0 || v.Qtype == qtype) {
+			result = append(result, v)
+		}
+	}
+	return
+}
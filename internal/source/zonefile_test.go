@@ -0,0 +1,109 @@
+package source
+
+import (
+	"context"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+const exampleZone = `$ORIGIN example.com.
+$TTL 60
+@	IN SOA ns1 hostmaster 1 3600 600 604800 300
+www	IN A 10.0.0.1
+www	IN A 10.0.0.2
+txt	IN TXT "hello"
+`
+
+// writeZone 在dir/cluster中写入zone文件
+func writeZone(t *testing.T, dir, cluster, file, content string) {
+	t.Helper()
+	if err := os.MkdirAll(filepath.Join(dir, cluster), 0o755); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.WriteFile(filepath.Join(dir, cluster, file), []byte(content), 0o644); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestParseZoneFile(t *testing.T) {
+	dir := t.TempDir()
+	writeZone(t, dir, "c1", "example.com.zone", exampleZone)
+	list, err := ParseZoneFile(filepath.Join(dir, "c1", "example.com.zone"), "c1", "")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(list) != 4 {
+		t.Fatalf("got %d records, want 4", len(list))
+	}
+	ids := map[int64]bool{}
+	for _, r := range list {
+		if r.ClusterName != "c1" || r.Weight != 1 || r.Id <= 0 {
+			t.Errorf("record %+v: want cluster c1, weight 1 and a positive id", r)
+		}
+		ids[r.Id] = true
+	}
+	if len(ids) != len(list) {
+		t.Errorf("records share ids: %v", ids)
+	}
+	if txt := filterByName(list, "txt.example.com.", 16); len(txt) != 1 || txt[0].Rdata != "hello" {
+		t.Errorf("TXT record = %+v, want unquoted rdata hello", txt)
+	}
+}
+
+func TestZoneDirLoad(t *testing.T) {
+	dir := t.TempDir()
+	writeZone(t, dir, "c1", "example.com.zone", exampleZone)
+	writeZone(t, dir, "c2", "example.com.zone", exampleZone)
+	writeZone(t, dir, "c2", "bad.zone", "www IN A not-an-address\n")
+	writeZone(t, dir, ".hidden", "example.com.zone", exampleZone)
+	z := NewZoneDir(dir)
+	ctx := context.Background()
+
+	// c2中的错误文件不影响其他文件和集群
+	list, err := z.LoadAll(ctx)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(list) != 8 {
+		t.Errorf("LoadAll: got %d records, want 8", len(list))
+	}
+	if list, _ := z.LoadByName(ctx, "c1", "www.example.com.", 1); len(list) != 2 {
+		t.Errorf("LoadByName: got %d records, want 2", len(list))
+	}
+
+	// 解析失败时使用上次解析成功的记录
+	writeZone(t, dir, "c1", "example.com.zone", "www IN A broken\n")
+	if list, err := z.LoadCluster(ctx, "c1"); err != nil || len(list) != 4 {
+		t.Errorf("LoadCluster after a bad edit = %d records, %v, want the 4 last good records", len(list), err)
+	}
+
+	// 删除的集群没有记录
+	if err := os.RemoveAll(filepath.Join(dir, "c1")); err != nil {
+		t.Fatal(err)
+	}
+	if list, err := z.LoadCluster(ctx, "c1"); err != nil || len(list) != 0 {
+		t.Errorf("LoadCluster of a deleted cluster = %d records, %v, want none", len(list), err)
+	}
+	// 重新创建的集群不使用删除之前的记录
+	writeZone(t, dir, "c1", "example.com.zone", "www IN A broken\n")
+	if list, _ := z.LoadCluster(ctx, "c1"); len(list) != 0 {
+		t.Errorf("LoadCluster of a recreated cluster = %d records, want none", len(list))
+	}
+}
+
+func TestZoneDirWatchSnapshot(t *testing.T) {
+	dir := t.TempDir()
+	writeZone(t, dir, "c1", "example.com.zone", exampleZone)
+	writeZone(t, dir, "c2", "example.com.zone", exampleZone)
+	z := NewZoneDir(dir)
+	before := z.snapshot()
+	writeZone(t, dir, "c1", "other.com.zone", exampleZone)
+	after := z.snapshot()
+	if before["c1"] == after["c1"] {
+		t.Error("adding a file did not change the snapshot of c1")
+	}
+	if before["c2"] != after["c2"] {
+		t.Error("snapshot of c2 changed")
+	}
+}